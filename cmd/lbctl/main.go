@@ -2,10 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/ari23/loadbalancer/pkg/loadbalancer"
 	"github.com/ari23/loadbalancer/utils"
@@ -18,7 +27,45 @@ var rootCmd = &cobra.Command{
 	Short: "CLI tool for managing the TCP load balancer",
 }
 
-var configPath string
+var (
+	configPath string
+	clientID   string
+
+	// Flags of eval-policy, describing a sample connection.
+	certPath            string
+	commonName          string
+	organizations       []string
+	organizationalUnits []string
+	sans                []string
+	sourceIP            string
+	serverName          string
+	evalTime            string
+	targetGroup         string
+)
+
+var (
+	errNoPolicies    = errors.New("the configuration has no policies")
+	errNoCertificate = errors.New("no PEM certificate found")
+)
+
+// loadConfig parses the configuration file at configPath.
+func loadConfig() (*loadbalancer.LoadBalancerConfig, error) {
+	dataFile, err := os.Open(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open config file: %v", err)
+		return nil, err
+	}
+
+	defer dataFile.Close()
+
+	config, err := loadbalancer.ParseConfig(dataFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse configuration: %v\n", err)
+		return nil, err
+	}
+
+	return config, nil
+}
 
 var startCmd = &cobra.Command{
 	Use:   "start",
@@ -38,17 +85,8 @@ var startCmd = &cobra.Command{
 		}()
 
 		// Parse the configuration file.
-		dataFile, err := os.Open(configPath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open config file: %v", err)
-			return err
-		}
-
-		defer dataFile.Close()
-
-		config, err := loadbalancer.ParseConfig(dataFile)
+		config, err := loadConfig()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to parse configuration: %v\n", err)
 			return err
 		}
 
@@ -61,6 +99,23 @@ var startCmd = &cobra.Command{
 			return err
 		}
 
+		// Reload the TLS material on SIGHUP, e.g. after the certificates were rotated.
+		reloadChan := make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
+
+		defer signal.Stop(reloadChan)
+
+		go func() {
+			for range reloadChan {
+				if err := lb.ReloadTLS(); err != nil {
+					config.Logger.Errorf("[reloadTLS] Error: %s", err.Error())
+					continue
+				}
+
+				config.Logger.Infof("Reloaded TLS material")
+			}
+		}()
+
 		if err := lb.Start(ctx); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to start Load Balancer due to: %v\n", err)
 			return err
@@ -70,9 +125,221 @@ var startCmd = &cobra.Command{
 	},
 }
 
+var getQuotaCmd = &cobra.Command{
+	Use:   "get-quota",
+	Short: "Shows the remaining quota of the configured clients",
+	Long: "Shows the remaining quota of the clients configured by client ID, as last persisted to the " +
+		"quota store by the load balancer, so it may be up to quotas.flushInterval old. The usage of " +
+		"the identities matched by a client ID pattern is tracked per identity and is not shown.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		clientsStore := loadbalancer.NewClientStore()
+		if err := clientsStore.AddClientsFromClientConfigList(config.Clients); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load clients: %v\n", err)
+			return err
+		}
+
+		quotasStore, err := loadbalancer.NewQuotasStore(config.Quotas.StorePath, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load quota store: %v\n", err)
+			return err
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "CLIENT\tRESOURCE\tPERIOD\tPERIOD START\tLIMIT\tREMAINING")
+
+		for _, c := range config.Clients {
+			if clientID != "" && c.ClientId != clientID {
+				continue
+			}
+
+			// Usage is tracked per identity matched by a pattern, not under the pattern.
+			if loadbalancer.IsClientIDPattern(c.ClientId) {
+				continue
+			}
+
+			clientInfo, _ := clientsStore.GetClient(c.ClientId)
+			for _, status := range quotasStore.GetQuotaStatus(clientInfo) {
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%d\n", c.ClientId, status.Resource, status.Period,
+					status.PeriodStart.Format(time.RFC3339), status.Limit, status.Remaining)
+			}
+		}
+
+		return writer.Flush()
+	},
+}
+
+var evalPolicyCmd = &cobra.Command{
+	Use:   "eval-policy",
+	Short: "Evaluates the authorization policy against a sample connection",
+	Long: "Evaluates the authorization policy of the configuration against a sample connection, " +
+		"described by a client certificate file or by its subject and SANs, and shows which target " +
+		"groups it may access and the rule that decided.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		policy, err := loadbalancer.NewPolicy(config.Policies)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load policies: %v\n", err)
+			return err
+		}
+
+		if policy == nil {
+			return errNoPolicies
+		}
+
+		request, err := sampleAuthzRequest(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build the sample connection: %v\n", err)
+			return err
+		}
+
+		targetGroups := []string{targetGroup}
+		if targetGroup == "" {
+			targetGroups = targetGroups[:0]
+			for _, tg := range config.TargetGroups {
+				targetGroups = append(targetGroups, tg.Name)
+			}
+		}
+
+		fmt.Printf("Client: %s\n", request.ClientID)
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "TARGET GROUP\tDECISION\tRULE")
+
+		for _, tg := range targetGroups {
+			decision := policy.Evaluate(request, tg)
+
+			outcome, rule := "deny", decision.Rule
+			if decision.Allowed {
+				outcome = "allow"
+			}
+
+			if rule == "" {
+				rule = "(no rule matched)"
+			}
+
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", tg, outcome, rule)
+		}
+
+		return writer.Flush()
+	},
+}
+
+// sampleAuthzRequest builds the connection described by the eval-policy flags. The client is
+// identified among the configured clients like the load balancer would.
+func sampleAuthzRequest(config *loadbalancer.LoadBalancerConfig) (*loadbalancer.AuthzRequest, error) {
+	cert, err := sampleCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	request := &loadbalancer.AuthzRequest{Certificate: cert, ServerName: serverName, Time: time.Now()}
+
+	if evalTime != "" {
+		if request.Time, err = time.Parse(time.RFC3339, evalTime); err != nil {
+			return nil, err
+		}
+	}
+
+	if sourceIP != "" {
+		if request.SourceIP, err = netip.ParseAddr(sourceIP); err != nil {
+			return nil, err
+		}
+	}
+
+	clientsStore := loadbalancer.NewClientStore()
+	if err := clientsStore.SetIdentityPrecedence(config.ClientIdentityPrecedence); err != nil {
+		return nil, err
+	}
+
+	if err := clientsStore.AddClientsFromClientConfigList(config.Clients); err != nil {
+		return nil, err
+	}
+
+	clientsStore.SetIdentifyUnknownClients(true)
+
+	if clientInfo, _, ok := clientsStore.GetClientByCertificate(cert); ok {
+		request.ClientID = clientInfo.GetClientID()
+	}
+
+	return request, nil
+}
+
+// sampleCertificate reads the certificate file, or makes up a certificate with the subject and
+// SANs of the flags.
+func sampleCertificate() (*x509.Certificate, error) {
+	if certPath != "" {
+		data, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errNoCertificate
+		}
+
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName:         commonName,
+		Organization:       organizations,
+		OrganizationalUnit: organizationalUnits,
+	}}
+
+	for _, san := range sans {
+		sanType, value, _ := strings.Cut(san, ":")
+
+		switch sanType {
+		case loadbalancer.IdentityTypeDNS:
+			cert.DNSNames = append(cert.DNSNames, value)
+		case loadbalancer.IdentityTypeEmail:
+			cert.EmailAddresses = append(cert.EmailAddresses, value)
+		case loadbalancer.IdentityTypeURI:
+			uri, err := url.Parse(value)
+			if err != nil {
+				return nil, err
+			}
+
+			cert.URIs = append(cert.URIs, uri)
+		default:
+			return nil, fmt.Errorf("invalid SAN %s, expected dns:, uri: or email: followed by a value", san)
+		}
+	}
+
+	return cert, nil
+}
+
 func init() {
 	startCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the load balancer configuration file")
 	rootCmd.AddCommand(startCmd)
+
+	getQuotaCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the load balancer configuration file")
+	getQuotaCmd.Flags().StringVar(&clientID, "client", "", "Only show the quota of this client")
+	rootCmd.AddCommand(getQuotaCmd)
+
+	evalPolicyCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the load balancer configuration file")
+	evalPolicyCmd.Flags().StringVar(&certPath, "cert", "", "Client certificate file (PEM), instead of the flags below")
+	evalPolicyCmd.Flags().StringVar(&commonName, "cn", "", "Subject CommonName of the client certificate")
+	evalPolicyCmd.Flags().StringSliceVar(&organizations, "o", nil, "Subject Organization of the client certificate")
+	evalPolicyCmd.Flags().StringSliceVar(&organizationalUnits, "ou", nil,
+		"Subject OrganizationalUnit of the client certificate")
+	evalPolicyCmd.Flags().StringSliceVar(&sans, "san", nil,
+		"SAN of the client certificate, e.g. dns:clientA.bardomain.com or uri:spiffe://corp/ns/x/sa/y")
+	evalPolicyCmd.Flags().StringVar(&sourceIP, "source", "", "Source IP of the connection")
+	evalPolicyCmd.Flags().StringVar(&serverName, "server-name", "", "TLS server name (SNI) of the connection")
+	evalPolicyCmd.Flags().StringVar(&evalTime, "time", "", "Time of the connection, RFC 3339. Defaults to now")
+	evalPolicyCmd.Flags().StringVar(&targetGroup, "target-group", "", "Only evaluate this target group")
+	rootCmd.AddCommand(evalPolicyCmd)
 }
 
 func main() {
@@ -0,0 +1,76 @@
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers. Code that depends on the passing of time takes a Clock
+// instead of using the time package directly, so that tests can control time with a Fake.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// NewTimer creates a Timer that fires once after d.
+	NewTimer(d time.Duration) Timer
+	// NewTicker creates a Ticker that fires every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event timer, see time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker delivers ticks at intervals, see time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// New returns the Clock of the time package.
+func New() Clock {
+	return realClock{}
+}
+
+// OrDefault returns c, or the Clock of the time package if c is nil.
+func OrDefault(c Clock) Clock {
+	if c == nil {
+		return New()
+	}
+
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
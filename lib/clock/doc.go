@@ -0,0 +1,2 @@
+// Package clock provides an injectable clock, with a fake implementation for tests.
+package clock
@@ -0,0 +1,161 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when told to. Its timers and tickers fire when Advance moves the
+// time past their deadline.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending timer or ticker of a Fake.
+type fakeWaiter struct {
+	deadline time.Time
+	// period is the interval of a ticker, and zero for a timer.
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewFake creates a Fake set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return &fakeTimer{clock: f, waiter: f.add(d, 0)}
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	return &fakeTicker{clock: f, waiter: f.add(d, d)}
+}
+
+// Advance moves the time forward by d and fires the timers and tickers that are due, in deadline
+// order. Like a time.Ticker, a ticker whose tick was not received yet drops the next ones.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := f.now.Add(d)
+
+	for {
+		sort.Slice(f.waiters, func(i, j int) bool {
+			return f.waiters[i].deadline.Before(f.waiters[j].deadline)
+		})
+
+		if len(f.waiters) == 0 || f.waiters[0].deadline.After(end) {
+			break
+		}
+
+		waiter := f.waiters[0]
+		f.now = waiter.deadline
+
+		select {
+		case waiter.c <- f.now:
+		default:
+		}
+
+		if waiter.period > 0 {
+			waiter.deadline = waiter.deadline.Add(waiter.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+
+	f.now = end
+}
+
+// BlockUntil blocks until at least n timers and tickers are pending, e.g. until the goroutine
+// under test started waiting on the clock.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+func (f *Fake) add(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	waiter := &fakeWaiter{deadline: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		// Like time.NewTimer, a non-positive duration fires right away.
+		waiter.c <- f.now
+
+		return waiter
+	}
+
+	f.waiters = append(f.waiters, waiter)
+	f.cond.Broadcast()
+
+	return waiter
+}
+
+// remove stops the waiter and reports whether it was still pending.
+func (f *Fake) remove(waiter *fakeWaiter) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, w := range f.waiters {
+		if w == waiter {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	waiter *fakeWaiter
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.waiter.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t.waiter)
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	waiter *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.waiter.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.remove(t.waiter)
+}
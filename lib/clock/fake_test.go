@@ -0,0 +1,59 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeTimer(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+
+	timer := fake.NewTimer(time.Second)
+
+	fake.Advance(999 * time.Millisecond)
+	assert.Empty(t, timer.C(), "Timer should not fire before its deadline")
+
+	fake.Advance(time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), <-timer.C())
+	assert.False(t, timer.Stop(), "A fired timer is no longer pending")
+	assert.Equal(t, time.Second, fake.Since(start))
+}
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+
+	ticker := fake.NewTicker(time.Second)
+
+	fake.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-ticker.C())
+
+	// Ticks that are not received are dropped.
+	fake.Advance(3 * time.Second)
+	assert.Equal(t, start.Add(2*time.Second), <-ticker.C())
+	assert.Empty(t, ticker.C())
+
+	ticker.Stop()
+	fake.Advance(time.Second)
+	assert.Empty(t, ticker.C(), "A stopped ticker should not fire")
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		timer := fake.NewTimer(time.Minute)
+		<-timer.C()
+	}()
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	<-done
+}
@@ -3,19 +3,26 @@ package loadbalance
 import (
 	"context"
 	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
 )
 
-// HealthCheck performs a health check on an upstream server.
+// healthCheckInterval is the time between two probes of an upstream server.
+const healthCheckInterval = time.Second
+
+// HealthCheck performs a health check on an upstream server. Probes are scheduled on clk, which
+// defaults to the time package if nil.
 func HealthCheck(
 	ctx context.Context,
 	server UpstreamServerInterface,
 	dialer NetDialerInterface,
+	clk clock.Clock,
 ) (bool, error) {
 	if dialer == nil {
 		return false, ErrDialerIsNil
 	}
 
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := clock.OrDefault(clk).NewTicker(healthCheckInterval)
 	defer ticker.Stop()
 
 	failureCount := 0
@@ -29,10 +36,17 @@ func HealthCheck(
 			ticker.Stop()
 
 			return false, nil
-		case <-ticker.C:
-			_, err := dialer.DialTimeout(
-				"tcp", serverAddress, timeout)
-			// defer conn.Close()
+		case <-ticker.C():
+			dialCtx, cancel := context.WithTimeout(ctx, timeout)
+			conn, err := dialer.DialContext(dialCtx, "tcp", serverAddress)
+
+			cancel()
+
+			// The probe only checks that a connection, and a TLS handshake if the dialer does
+			// one, can be made.
+			if err == nil {
+				conn.Close()
+			}
 
 			if err != nil {
 				failureCount++
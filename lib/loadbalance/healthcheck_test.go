@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ari23/loadbalancer/lib/clock"
 	"github.com/ari23/loadbalancer/lib/loadbalance"
 	"github.com/ari23/loadbalancer/tests/mocks"
 	"github.com/golang/mock/gomock"
@@ -18,6 +19,7 @@ func TestHealthCheckServerNotReachableRetryLimit(t *testing.T) {
 
 	server := mocks.NewMockUpstreamServerInterface(ctrl)
 	dialer := mocks.NewMockNetDialerInterface(ctrl)
+	fakeClock := clock.NewFake(time.Now())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
 	defer cancel()
@@ -25,16 +27,61 @@ func TestHealthCheckServerNotReachableRetryLimit(t *testing.T) {
 	// Setup mocks
 	serverAddress := "192.168.1.1:8081"
 	server.EXPECT().GetAddress().Return(serverAddress).AnyTimes()
-	dialer.EXPECT().DialTimeout("tcp", serverAddress, 2*time.Second).Return(nil, errors.New("connection error")).AnyTimes()
+	dialer.EXPECT().DialContext(gomock.Any(), "tcp", serverAddress).Return(nil, errors.New("connection error")).AnyTimes()
 	dialer.EXPECT().GetTimeout().Return(2 * time.Second).Times(1)
 	dialer.EXPECT().GetRetryLimit().Return(1).Times(1)
 	server.EXPECT().SetHealthy(false).Times(1)
 
 	// Call HealthCheck
-	_, err := loadbalance.HealthCheck(ctx, server, dialer)
+	errCh := make(chan error)
+
+	go func() {
+		_, err := loadbalance.HealthCheck(ctx, server, dialer, fakeClock)
+		errCh <- err
+	}()
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(time.Second)
+
+	// Assert
+	assert.Error(t, <-errCh)
+}
+
+func TestHealthCheckServerNotReachableAfterRetries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	server := mocks.NewMockUpstreamServerInterface(ctrl)
+	dialer := mocks.NewMockNetDialerInterface(ctrl)
+	fakeClock := clock.NewFake(time.Now())
+
+	// Setup mocks
+	serverAddress := "192.168.1.1:8081"
+	server.EXPECT().GetAddress().Return(serverAddress).AnyTimes()
+	dialed := make(chan struct{}, 2)
+	dialer.EXPECT().DialContext(gomock.Any(), "tcp", serverAddress).
+		Do(func(context.Context, string, string) { dialed <- struct{}{} }).
+		Return(nil, errors.New("connection error")).Times(2)
+	dialer.EXPECT().GetTimeout().Return(2 * time.Second).Times(1)
+	dialer.EXPECT().GetRetryLimit().Return(2).Times(1)
+	server.EXPECT().SetHealthy(false).Times(1)
+
+	// Call HealthCheck
+	errCh := make(chan error)
+
+	go func() {
+		_, err := loadbalance.HealthCheck(context.Background(), server, dialer, fakeClock)
+		errCh <- err
+	}()
+
+	// The server is only marked unhealthy after the second failed probe.
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(time.Second)
+	<-dialed
+	fakeClock.Advance(time.Second)
 
 	// Assert
-	assert.Error(t, err)
+	assert.ErrorIs(t, <-errCh, loadbalance.ErrHealthCheckFailedAfterRetry)
 }
 
 func TestHealthCheckServerReachable(t *testing.T) {
@@ -44,20 +91,30 @@ func TestHealthCheckServerReachable(t *testing.T) {
 	server := mocks.NewMockUpstreamServerInterface(ctrl)
 	dialer := mocks.NewMockNetDialerInterface(ctrl)
 	mockConn := mocks.NewMockConn(ctrl)
+	fakeClock := clock.NewFake(time.Now())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Setup mocks
 	serverAddress := "192.168.1.1:8081"
 	server.EXPECT().GetAddress().Return(serverAddress).AnyTimes()
-	dialer.EXPECT().DialTimeout("tcp", serverAddress, 2*time.Second).Return(mockConn, nil).AnyTimes()
+	dialer.EXPECT().DialContext(gomock.Any(), "tcp", serverAddress).Return(mockConn, nil).Times(1)
+	mockConn.EXPECT().Close().Return(nil).Times(1)
 	dialer.EXPECT().GetTimeout().Return(2 * time.Second).Times(1)
 	dialer.EXPECT().GetRetryLimit().Return(1).Times(1)
-	server.EXPECT().SetHealthy(true).Times(1)
+	server.EXPECT().SetHealthy(true).Times(1).Do(func(bool) { cancel() })
 
 	// Call HealthCheck
-	_, err := loadbalance.HealthCheck(ctx, server, dialer)
+	errCh := make(chan error)
+
+	go func() {
+		_, err := loadbalance.HealthCheck(ctx, server, dialer, fakeClock)
+		errCh <- err
+	}()
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(time.Second)
 
-	assert.NoError(t, err)
+	assert.NoError(t, <-errCh)
 }
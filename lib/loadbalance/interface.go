@@ -1,6 +1,7 @@
 package loadbalance
 
 import (
+	"context"
 	"net"
 	"time"
 )
@@ -22,6 +23,9 @@ type UpstreamServerInterface interface {
 
 type NetDialerInterface interface {
 	Dial(network, address string) (net.Conn, error)
+	// DialContext connects to the address on the named network. The dial is aborted as soon as
+	// ctx is done.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 	DialTimeout(network, address string, timeout time.Duration) (net.Conn, error)
 	GetTimeout() time.Duration
 	GetRetryLimit() int
@@ -0,0 +1,297 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+)
+
+// ConcurrencyAlgorithm is the name of an adaptive concurrency limiting algorithm.
+type ConcurrencyAlgorithm string
+
+const (
+	// ConcurrencyAlgorithmAIMD grows the limit by one while it is in use and multiplies it by a
+	// backoff ratio when an event fails or is slower than a latency threshold. It is the default.
+	ConcurrencyAlgorithmAIMD ConcurrencyAlgorithm = "aimd"
+	// ConcurrencyAlgorithmGradient scales the limit by the ratio between the long term and the
+	// current latency, so that it shrinks as soon as queueing shows up in the latency.
+	ConcurrencyAlgorithmGradient ConcurrencyAlgorithm = "gradient"
+)
+
+const (
+	defaultInitialConcurrency = 20
+	defaultMinConcurrency     = 1
+	defaultMaxConcurrency     = 1000
+	defaultBackoffRatio       = 0.9
+	defaultGradientTolerance  = 2.0
+	defaultGradientSmoothing  = 0.2
+	defaultConcurrencyHistory = 64
+	// longLatencySamples is the number of samples the gradient algorithm averages the latency
+	// without load over.
+	longLatencySamples = 100
+	// minGradient and maxGradient bound how much the gradient algorithm scales the limit by. A
+	// failure scales it by minGradient.
+	minGradient = 0.5
+	maxGradient = 1.0
+)
+
+// ConcurrencyParams are the parameters a ConcurrencyLimiter is built from. Zero values use the
+// defaults.
+type ConcurrencyParams struct {
+	// InitialLimit is the limit before any event was observed. Defaults to 20.
+	InitialLimit int
+	// MinLimit and MaxLimit bound the limit. Default to 1 and 1000.
+	MinLimit int
+	MaxLimit int
+	// BackoffRatio is what AIMD multiplies the limit by on failure. Defaults to 0.9.
+	BackoffRatio float64
+	// LatencyThreshold is the latency above which AIMD treats an event as failed. 0 only backs
+	// off on failures.
+	LatencyThreshold time.Duration
+	// Tolerance is how many times the long term latency the gradient algorithm tolerates before
+	// shrinking the limit. Defaults to 2.
+	Tolerance float64
+	// Smoothing is the weight of a new gradient limit against the current one. Defaults to 0.2.
+	Smoothing float64
+	// HistorySize is the number of limit changes kept by History. Defaults to 64.
+	HistorySize int
+	// Clock timestamps the history. Defaults to the time package.
+	Clock clock.Clock
+}
+
+// LimitChange is a change of the limit of a ConcurrencyLimiter.
+type LimitChange struct {
+	Time  time.Time
+	Limit int
+}
+
+// ConcurrencyLimiter limits the number of events in flight, e.g. open upstream connections, and
+// adapts the limit to the latency and failures observed for them. Callers TryAcquire a slot,
+// Observe the outcome once it is known, and Release the slot when the event is over.
+type ConcurrencyLimiter struct {
+	mu        sync.Mutex
+	algorithm concurrencyAlgorithm
+	params    ConcurrencyParams
+	limit     float64
+	inFlight  int
+	// history holds the last HistorySize limit changes, oldest first.
+	history []LimitChange
+}
+
+// concurrencyAlgorithm computes the next limit from an observed event.
+type concurrencyAlgorithm interface {
+	update(limit float64, inFlight int, latency time.Duration, failed bool) float64
+}
+
+// ParseConcurrencyAlgorithm returns the ConcurrencyAlgorithm with the given name. An empty name
+// is ConcurrencyAlgorithmAIMD.
+func ParseConcurrencyAlgorithm(name string) (ConcurrencyAlgorithm, error) {
+	switch algorithm := ConcurrencyAlgorithm(name); algorithm {
+	case "":
+		return ConcurrencyAlgorithmAIMD, nil
+	case ConcurrencyAlgorithmAIMD, ConcurrencyAlgorithmGradient:
+		return algorithm, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownAlgorithm, name)
+	}
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter using the given algorithm.
+func NewConcurrencyLimiter(algorithm ConcurrencyAlgorithm, params ConcurrencyParams) (*ConcurrencyLimiter, error) {
+	params = withConcurrencyDefaults(params)
+
+	limiter := &ConcurrencyLimiter{
+		params: params,
+		limit:  float64(params.InitialLimit),
+	}
+
+	switch algorithm {
+	case ConcurrencyAlgorithmAIMD, "":
+		limiter.algorithm = &aimd{backoffRatio: params.BackoffRatio, latencyThreshold: params.LatencyThreshold}
+	case ConcurrencyAlgorithmGradient:
+		limiter.algorithm = &gradient{tolerance: params.Tolerance, smoothing: params.Smoothing}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, algorithm)
+	}
+
+	limiter.limit = limiter.clamp(limiter.limit)
+	limiter.record(params.Clock.Now())
+
+	return limiter, nil
+}
+
+func withConcurrencyDefaults(params ConcurrencyParams) ConcurrencyParams {
+	if params.MinLimit < 1 {
+		params.MinLimit = defaultMinConcurrency
+	}
+
+	if params.MaxLimit < 1 {
+		params.MaxLimit = defaultMaxConcurrency
+	}
+
+	if params.InitialLimit < 1 {
+		params.InitialLimit = defaultInitialConcurrency
+	}
+
+	if params.BackoffRatio <= 0 || params.BackoffRatio >= 1 {
+		params.BackoffRatio = defaultBackoffRatio
+	}
+
+	if params.Tolerance < 1 {
+		params.Tolerance = defaultGradientTolerance
+	}
+
+	if params.Smoothing <= 0 || params.Smoothing > 1 {
+		params.Smoothing = defaultGradientSmoothing
+	}
+
+	if params.HistorySize < 1 {
+		params.HistorySize = defaultConcurrencyHistory
+	}
+
+	params.Clock = clock.OrDefault(params.Clock)
+
+	return params
+}
+
+// TryAcquire takes a slot if fewer events than the limit are in flight. It reports whether it
+// did.
+func (c *ConcurrencyLimiter) TryAcquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight >= int(c.limit) {
+		return false
+	}
+
+	c.inFlight++
+
+	return true
+}
+
+// Release gives back a slot taken by TryAcquire.
+func (c *ConcurrencyLimiter) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inFlight > 0 {
+		c.inFlight--
+	}
+}
+
+// Observe adapts the limit to the latency of an event that holds a slot, or to its failure.
+func (c *ConcurrencyLimiter) Observe(latency time.Duration, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := c.clamp(c.algorithm.update(c.limit, c.inFlight, latency, failed))
+	changed := int(limit) != int(c.limit)
+	c.limit = limit
+
+	if changed {
+		c.record(c.params.Clock.Now())
+	}
+}
+
+// Limit returns the current limit.
+func (c *ConcurrencyLimiter) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return int(c.limit)
+}
+
+// InFlight returns the number of slots taken.
+func (c *ConcurrencyLimiter) InFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inFlight
+}
+
+// History returns the last limit changes, oldest first. The first entry is the initial limit
+// until it is pushed out.
+func (c *ConcurrencyLimiter) History() []LimitChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	history := make([]LimitChange, len(c.history))
+	copy(history, c.history)
+
+	return history
+}
+
+// record appends the current limit to the history. c.mu must be held.
+func (c *ConcurrencyLimiter) record(now time.Time) {
+	if len(c.history) == c.params.HistorySize {
+		copy(c.history, c.history[1:])
+		c.history = c.history[:len(c.history)-1]
+	}
+
+	c.history = append(c.history, LimitChange{Time: now, Limit: int(c.limit)})
+}
+
+func (c *ConcurrencyLimiter) clamp(limit float64) float64 {
+	return math.Min(math.Max(limit, float64(c.params.MinLimit)), float64(c.params.MaxLimit))
+}
+
+// aimd is additive increase, multiplicative decrease.
+type aimd struct {
+	backoffRatio     float64
+	latencyThreshold time.Duration
+}
+
+func (a *aimd) update(limit float64, inFlight int, latency time.Duration, failed bool) float64 {
+	if failed || (a.latencyThreshold > 0 && latency > a.latencyThreshold) {
+		return limit * a.backoffRatio
+	}
+
+	// Only grow the limit while at least half of it is in use, otherwise an idle target group
+	// would end up with an unbounded limit.
+	if 2*inFlight >= int(limit) {
+		return limit + 1
+	}
+
+	return limit
+}
+
+// gradient compares each latency to an average over the last samples, which stands for the
+// latency without load.
+type gradient struct {
+	tolerance   float64
+	smoothing   float64
+	longLatency float64
+}
+
+func (g *gradient) update(limit float64, inFlight int, latency time.Duration, failed bool) float64 {
+	sample := float64(latency)
+	if sample <= 0 {
+		sample = 1
+	}
+
+	if g.longLatency == 0 {
+		g.longLatency = sample
+	} else {
+		g.longLatency += (sample - g.longLatency) / longLatencySamples
+	}
+
+	gradient := minGradient
+	if !failed {
+		// Leave the limit alone while less than half of it is in use, there is nothing to learn
+		// from it.
+		if 2*inFlight < int(limit) {
+			return limit
+		}
+
+		gradient = math.Min(math.Max(g.tolerance*g.longLatency/sample, minGradient), maxGradient)
+	}
+
+	// The square root of the limit is the queue allowed on top of it, which lets the limit grow
+	// while the latency stays within the tolerance.
+	next := limit*gradient + math.Sqrt(limit)
+
+	return limit*(1-g.smoothing) + next*g.smoothing
+}
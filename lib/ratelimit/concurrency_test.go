@@ -0,0 +1,113 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiterTryAcquire(t *testing.T) {
+	limiter, err := ratelimit.NewConcurrencyLimiter(ratelimit.ConcurrencyAlgorithmAIMD, ratelimit.ConcurrencyParams{
+		InitialLimit: 2,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, limiter.TryAcquire())
+	assert.True(t, limiter.TryAcquire())
+	assert.False(t, limiter.TryAcquire(), "Acquire over the limit should fail")
+	assert.Equal(t, 2, limiter.InFlight())
+
+	limiter.Release()
+	assert.True(t, limiter.TryAcquire(), "A released slot should be available again")
+}
+
+func TestConcurrencyLimiterAIMD(t *testing.T) {
+	limiter, err := ratelimit.NewConcurrencyLimiter(ratelimit.ConcurrencyAlgorithmAIMD, ratelimit.ConcurrencyParams{
+		InitialLimit:     10,
+		MaxLimit:         12,
+		LatencyThreshold: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// The limit does not grow while it is mostly unused.
+	limiter.Observe(time.Millisecond, false)
+	assert.Equal(t, 10, limiter.Limit())
+
+	for i := 0; i < 6; i++ {
+		require.True(t, limiter.TryAcquire())
+	}
+
+	// It grows by one per success while in use, up to the max.
+	limiter.Observe(time.Millisecond, false)
+	assert.Equal(t, 11, limiter.Limit())
+
+	limiter.Observe(time.Millisecond, false)
+	limiter.Observe(time.Millisecond, false)
+	assert.Equal(t, 12, limiter.Limit())
+
+	// Failures and slow events back it off.
+	limiter.Observe(time.Millisecond, true)
+	assert.Equal(t, 10, limiter.Limit())
+
+	limiter.Observe(time.Second, false)
+	assert.Equal(t, 9, limiter.Limit())
+
+	history := limiter.History()
+	require.NotEmpty(t, history)
+	assert.Equal(t, 10, history[0].Limit, "History should start with the initial limit")
+	assert.Equal(t, 9, history[len(history)-1].Limit)
+}
+
+func TestConcurrencyLimiterGradient(t *testing.T) {
+	limiter, err := ratelimit.NewConcurrencyLimiter(ratelimit.ConcurrencyAlgorithmGradient, ratelimit.ConcurrencyParams{
+		InitialLimit: 20,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		require.True(t, limiter.TryAcquire())
+	}
+
+	// The limit grows while the latency stays at its usual level.
+	for i := 0; i < 10; i++ {
+		limiter.Observe(10*time.Millisecond, false)
+	}
+
+	grown := limiter.Limit()
+	assert.Greater(t, grown, 20)
+
+	// And shrinks once the latency climbs well above it.
+	for i := 0; i < 10; i++ {
+		limiter.Observe(200*time.Millisecond, false)
+	}
+
+	assert.Less(t, limiter.Limit(), grown)
+}
+
+func TestConcurrencyLimiterHistorySize(t *testing.T) {
+	limiter, err := ratelimit.NewConcurrencyLimiter(ratelimit.ConcurrencyAlgorithmAIMD, ratelimit.ConcurrencyParams{
+		InitialLimit: 100,
+		HistorySize:  3,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		limiter.Observe(0, true)
+	}
+
+	history := limiter.History()
+	require.Len(t, history, 3)
+	assert.Equal(t, limiter.Limit(), history[2].Limit)
+}
+
+func TestParseConcurrencyAlgorithm(t *testing.T) {
+	algorithm, err := ratelimit.ParseConcurrencyAlgorithm("")
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.ConcurrencyAlgorithmAIMD, algorithm)
+
+	_, err = ratelimit.ParseConcurrencyAlgorithm("vegas")
+	assert.ErrorIs(t, err, ratelimit.ErrUnknownAlgorithm)
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+)
+
+const (
+	defaultBackendTimeout       = 50 * time.Millisecond
+	defaultBackendRetryInterval = time.Second
+)
+
+// Backend stores rate limiting counters shared by several processes, e.g. the replicas of a load
+// balancer, so that they enforce one combined limit.
+type Backend interface {
+	// Add adds cost, which may be negative, to the counter of key in the given window and returns
+	// the counters of that window and of the previous one. Counters may be dropped after ttl.
+	Add(ctx context.Context, key string, window int64, cost int, ttl time.Duration) (current, previous int64, err error)
+}
+
+// DistributedParams are the parameters of a DistributedLimiter.
+type DistributedParams struct {
+	// Limit is the number of events allowed per Window across all processes.
+	Limit int
+	// Window is the period Limit applies to. Defaults to DefaultWindow.
+	Window time.Duration
+	// KeyPrefix is prepended to the keys in the backend, so that several limiters can share it.
+	KeyPrefix string
+	// Timeout bounds every call to the backend. Defaults to 50ms.
+	Timeout time.Duration
+	// RetryInterval is how long the limiter stays local only after the backend failed. Defaults to
+	// 1s.
+	RetryInterval time.Duration
+	// Clock is the clock windows are computed with. Defaults to the time package.
+	Clock clock.Clock
+	// OnStateChange, if set, is called with the backend error when the limiter falls back to local
+	// limiting, and with nil when it uses the backend again.
+	OnStateChange func(err error)
+}
+
+// DistributedLimiter is a sliding window counter limiter whose counters live in a Backend. While
+// the backend is unreachable it degrades to a local Limiter, i.e. every process enforces the limit
+// on its own, and it tries the backend again after RetryInterval.
+type DistributedLimiter struct {
+	backend Backend
+	local   Limiter
+	params  DistributedParams
+
+	mu sync.Mutex
+	// degradedUntil is the time until which the backend is not used after a failure.
+	degradedUntil time.Time
+	lastErr       error
+	// degraded is true from a backend failure until the backend is used successfully again.
+	degraded bool
+}
+
+// NewDistributedLimiter creates a DistributedLimiter on top of the backend, falling back to local.
+func NewDistributedLimiter(backend Backend, local Limiter, params DistributedParams) *DistributedLimiter {
+	if params.Window <= 0 {
+		params.Window = DefaultWindow
+	}
+
+	if params.Timeout <= 0 {
+		params.Timeout = defaultBackendTimeout
+	}
+
+	if params.RetryInterval <= 0 {
+		params.RetryInterval = defaultBackendRetryInterval
+	}
+
+	params.Clock = clock.OrDefault(params.Clock)
+
+	return &DistributedLimiter{
+		backend: backend,
+		local:   local,
+		params:  params,
+	}
+}
+
+func (d *DistributedLimiter) Allow(key string, cost int) bool {
+	reservation := d.Reserve(key, cost)
+	if reservation.Allowed && reservation.Delay > 0 {
+		d.Cancel(key, cost)
+
+		return false
+	}
+
+	return reservation.Allowed
+}
+
+func (d *DistributedLimiter) Reserve(key string, cost int) Reservation {
+	now := d.params.Clock.Now()
+	if d.isDegraded(now) {
+		return d.local.Reserve(key, cost)
+	}
+
+	if cost > d.params.Limit {
+		return Reservation{RetryAfter: InfDuration}
+	}
+
+	window := now.UnixNano() / int64(d.params.Window)
+
+	current, previous, err := d.add(now, key, window, cost)
+	if err != nil {
+		return d.local.Reserve(key, cost)
+	}
+
+	// Weigh the previous window by how much of it still overlaps the sliding window.
+	elapsed := float64(now.UnixNano()%int64(d.params.Window)) / float64(d.params.Window)
+	estimate := float64(previous)*(1-elapsed) + float64(current)
+
+	if estimate <= float64(d.params.Limit) {
+		return Reservation{Allowed: true}
+	}
+
+	// Give back what was added, the events are rejected.
+	_, _, _ = d.add(now, key, window, -cost)
+
+	return Reservation{RetryAfter: d.retryAfter(elapsed, previous, current-int64(cost), cost)}
+}
+
+func (d *DistributedLimiter) Wait(ctx context.Context, key string, cost int) error {
+	return wait(ctx, d, d.params.Clock, key, cost)
+}
+
+func (d *DistributedLimiter) Cancel(key string, cost int) {
+	now := d.params.Clock.Now()
+	if d.isDegraded(now) {
+		d.local.Cancel(key, cost)
+
+		return
+	}
+
+	_, _, _ = d.add(now, key, now.UnixNano()/int64(d.params.Window), -cost)
+}
+
+// Degraded returns the last backend error if the limiter currently falls back to local limiting,
+// and nil otherwise.
+func (d *DistributedLimiter) Degraded() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.params.Clock.Now().Before(d.degradedUntil) {
+		return d.lastErr
+	}
+
+	return nil
+}
+
+// add adds cost to the counter of key in the backend. A failure makes the limiter fall back to
+// local limiting for RetryInterval.
+func (d *DistributedLimiter) add(now time.Time, key string, window int64, cost int) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.params.Timeout)
+	defer cancel()
+
+	current, previous, err := d.backend.Add(ctx, d.params.KeyPrefix+key, window, cost, 2*d.params.Window)
+	d.setBackendError(now, err)
+
+	return current, previous, err
+}
+
+func (d *DistributedLimiter) isDegraded(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return now.Before(d.degradedUntil)
+}
+
+// setBackendError records the outcome of a backend call, and reports the limiter falling back to
+// local limiting or recovering from it to OnStateChange.
+func (d *DistributedLimiter) setBackendError(now time.Time, err error) {
+	d.mu.Lock()
+
+	if err != nil {
+		d.degradedUntil = now.Add(d.params.RetryInterval)
+		d.lastErr = err
+	}
+
+	changed := d.degraded != (err != nil)
+	d.degraded = err != nil
+
+	d.mu.Unlock()
+
+	if changed && d.params.OnStateChange != nil {
+		d.params.OnStateChange(err)
+	}
+}
+
+// retryAfter estimates when cost events fit under the limit, assuming no other events happen.
+// Only the previous window's share of the estimate decays within the current window.
+func (d *DistributedLimiter) retryAfter(elapsed float64, previous, current int64, cost int) time.Duration {
+	room := float64(int64(d.params.Limit) - current - int64(cost))
+	if room >= 0 && previous > 0 {
+		// Wait until previous*(1-elapsed') <= room.
+		remaining := 1 - room/float64(previous) - elapsed
+		if remaining > 0 {
+			return time.Duration(math.Ceil(remaining * float64(d.params.Window)))
+		}
+	}
+
+	// Wait for the next window, where the current counter becomes the previous one.
+	return time.Duration(math.Ceil((1 - elapsed) * float64(d.params.Window)))
+}
@@ -0,0 +1,130 @@
+package ratelimit_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDistributedLimiter(t *testing.T, addr string, limit int, clk clock.Clock) *ratelimit.DistributedLimiter {
+	t.Helper()
+
+	return newDistributedLimiterWithStateChange(t, addr, limit, clk, nil)
+}
+
+func newDistributedLimiterWithStateChange(
+	t *testing.T,
+	addr string,
+	limit int,
+	clk clock.Clock,
+	onStateChange func(error),
+) *ratelimit.DistributedLimiter {
+	t.Helper()
+
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	local, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: limit})
+	require.NoError(t, err)
+
+	return ratelimit.NewDistributedLimiter(ratelimit.NewRedisBackend(client), local, ratelimit.DistributedParams{
+		Limit:         limit,
+		Window:        time.Minute,
+		KeyPrefix:     "test:",
+		Timeout:       time.Second,
+		RetryInterval: 100 * time.Millisecond,
+		Clock:         clk,
+		OnStateChange: onStateChange,
+	})
+}
+
+func TestDistributedLimiterSharedLimit(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	// Two load balancer instances share one limit.
+	instanceA := newDistributedLimiter(t, server.Addr(), 4, nil)
+	instanceB := newDistributedLimiter(t, server.Addr(), 4, nil)
+
+	allowed := 0
+
+	for i := 0; i < 4; i++ {
+		if instanceA.Allow("clientA", 1) {
+			allowed++
+		}
+
+		if instanceB.Allow("clientA", 1) {
+			allowed++
+		}
+	}
+
+	assert.Equal(t, 4, allowed, "Both instances together should allow the limit once")
+	assert.NoError(t, instanceA.Degraded())
+
+	// Rejected events are given back, so the counter stays at the limit.
+	count, err := server.Get("test:clientA:" + currentWindow(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "4", count)
+
+	reservation := instanceA.Reserve("clientA", 1)
+	assert.False(t, reservation.Allowed)
+	assert.Greater(t, reservation.RetryAfter, time.Duration(0))
+
+	// Other keys have their own limit.
+	assert.True(t, instanceB.Allow("clientB", 1))
+}
+
+func TestDistributedLimiterCancel(t *testing.T) {
+	server := miniredis.RunT(t)
+	limiter := newDistributedLimiter(t, server.Addr(), 1, nil)
+
+	require.True(t, limiter.Allow("clientA", 1))
+	require.False(t, limiter.Allow("clientA", 1))
+
+	limiter.Cancel("clientA", 1)
+	assert.True(t, limiter.Allow("clientA", 1), "A cancelled event should free its slot")
+}
+
+func TestDistributedLimiterDegradesToLocal(t *testing.T) {
+	server := miniredis.RunT(t)
+	fakeClock := clock.NewFake(time.Now())
+
+	var stateChanges []error
+
+	limiter := newDistributedLimiterWithStateChange(t, server.Addr(), 2, fakeClock, func(err error) {
+		stateChanges = append(stateChanges, err)
+	})
+
+	require.True(t, limiter.Allow("clientA", 1))
+
+	server.Close()
+
+	// The local limiter takes over with its own, empty state.
+	assert.True(t, limiter.Allow("clientA", 1))
+	assert.Error(t, limiter.Degraded())
+	assert.True(t, limiter.Allow("clientA", 1))
+	assert.False(t, limiter.Allow("clientA", 1), "The local limit should still apply")
+
+	// The backend is used again once it is back.
+	require.NoError(t, server.Restart())
+	fakeClock.Advance(150 * time.Millisecond)
+
+	assert.True(t, limiter.Allow("clientA", 1))
+	assert.NoError(t, limiter.Degraded())
+
+	// Falling back and recovering are reported once each.
+	require.Len(t, stateChanges, 2)
+	assert.Error(t, stateChanges[0])
+	assert.NoError(t, stateChanges[1])
+}
+
+// currentWindow returns the index of the current window as used in backend keys.
+func currentWindow(window time.Duration) string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(window), 10)
+}
@@ -0,0 +1,17 @@
+package ratelimit
+
+import "errors"
+
+var (
+	// ErrUnknownAlgorithm is returned when a rate limiting algorithm name is not registered.
+	ErrUnknownAlgorithm = errors.New("unknown rate limiting algorithm")
+	// ErrAlgorithmAlreadyRegistered is returned when registering an algorithm name twice.
+	ErrAlgorithmAlreadyRegistered = errors.New("rate limiting algorithm already registered")
+	// ErrCostExceedsLimit is returned by Wait when the cost can never be allowed.
+	ErrCostExceedsLimit = errors.New("cost exceeds rate limit")
+	// ErrUnknownQuotaPeriod is returned when a quota period name is not recognized.
+	ErrUnknownQuotaPeriod = errors.New("unknown quota period")
+	// ErrWaitExceedsDeadline is returned by Wait when the events would not be allowed before the
+	// context's deadline.
+	ErrWaitExceedsDeadline = errors.New("rate limit wait would exceed context deadline")
+)
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// FixedWindow is a fixed window counter rate limiter. The timeline is divided in windows that
+// start with the first request after the previous window ended, and at most limit events are
+// allowed per window.
+type FixedWindow struct {
+	mu          sync.Mutex
+	limit       int
+	window      time.Duration
+	windowStart time.Time
+	count       int
+}
+
+// NewFixedWindow creates a fixed window counter that allows limit events per window. The first
+// window starts now.
+func NewFixedWindow(limit int, window time.Duration) *FixedWindow {
+	return newFixedWindow(limit, window, time.Now())
+}
+
+func newFixedWindow(limit int, window time.Duration, now time.Time) *FixedWindow {
+	return &FixedWindow{
+		limit:       limit,
+		window:      window,
+		windowStart: now,
+	}
+}
+
+// AllowAt reports whether an event is allowed at the given time and counts it if it is.
+func (f *FixedWindow) AllowAt(now time.Time) bool {
+	return f.ReserveAt(now, 1).Allowed
+}
+
+// ReserveAt reports whether cost events are allowed at the given time and counts them if they
+// are.
+func (f *FixedWindow) ReserveAt(now time.Time, cost int) Reservation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.windowStart) > f.window {
+		f.windowStart = now
+		f.count = 0
+	}
+
+	if cost > f.limit {
+		return Reservation{RetryAfter: InfDuration}
+	}
+
+	if f.count+cost > f.limit {
+		return Reservation{RetryAfter: f.windowStart.Add(f.window).Sub(now)}
+	}
+
+	f.count += cost
+
+	return Reservation{Allowed: true}
+}
+
+// CancelAt gives back cost events counted in the current window.
+func (f *FixedWindow) CancelAt(now time.Time, cost int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.windowStart) <= f.window {
+		f.count = max(0, f.count-cost)
+	}
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import "time"
+
+// Level is one level of a hierarchical rate limit, e.g. the whole listener, a target group or a
+// single client.
+type Level struct {
+	// Name identifies the level when it rejects an event.
+	Name string
+	// Limiter enforces the level's limit. A nil Limiter never rejects.
+	Limiter Limiter
+	// Key is the key the events are accounted under in Limiter.
+	Key string
+	// DryRun makes the level only record whether it would reject events without rejecting them.
+	DryRun bool
+}
+
+// Decision is the outcome of Hierarchy.Decide.
+type Decision struct {
+	// Allowed is true if every enforced level allowed the events.
+	Allowed bool
+	// Rejected is the first enforced level that rejected the events if they are not allowed, and
+	// RetryAfter is how long until it expects to allow them.
+	Rejected   Level
+	RetryAfter time.Duration
+	// ShadowRejected are the dry run levels that would have rejected the events.
+	ShadowRejected []Level
+}
+
+// Hierarchy checks several levels of rate limits at once. An event is only allowed if every level
+// allows it, and no level accounts for an event that another level rejected.
+//
+// Decisions are not serialized: each limiter synchronizes its own keys, so that a slow level, e.g.
+// a DistributedLimiter waiting on its backend, only holds up the events it is checking. An event
+// rejected by a level gives its events back to the levels checked before, so a concurrent event
+// may briefly see them accounted for.
+type Hierarchy struct{}
+
+// Allow reports whether cost events are allowed by all levels. If they are not, the first level
+// that rejected them is returned together with how long until it expects to allow them, and the
+// levels checked before it are given their events back.
+func (h *Hierarchy) Allow(levels []Level, cost int) (Level, time.Duration, bool) {
+	decision := h.Decide(levels, cost)
+
+	return decision.Rejected, decision.RetryAfter, decision.Allowed
+}
+
+// Decide is like Allow but also evaluates the dry run levels. They account for the events like
+// enforced levels do, so that they reflect what would happen once enforced, but never reject them.
+func (h *Hierarchy) Decide(levels []Level, cost int) Decision {
+	decision := Decision{Allowed: true}
+
+	var accounted []Level
+
+	for _, level := range levels {
+		if level.Limiter == nil || level.DryRun {
+			continue
+		}
+
+		allowed, retryAfter := reserve(level, cost)
+		if allowed {
+			accounted = append(accounted, level)
+
+			continue
+		}
+
+		decision = Decision{Rejected: level, RetryAfter: retryAfter}
+
+		break
+	}
+
+	for _, level := range levels {
+		if level.Limiter == nil || !level.DryRun {
+			continue
+		}
+
+		allowed, _ := reserve(level, cost)
+		if !allowed {
+			decision.ShadowRejected = append(decision.ShadowRejected, level)
+
+			continue
+		}
+
+		accounted = append(accounted, level)
+	}
+
+	if !decision.Allowed {
+		// The events do not happen, so no level may account for them.
+		for _, level := range accounted {
+			level.Limiter.Cancel(level.Key, cost)
+		}
+	}
+
+	return decision
+}
+
+// reserve reserves cost events at the level and reports whether they may happen right away. If
+// they may not, it returns how long until the level expects to allow them.
+func reserve(level Level, cost int) (bool, time.Duration) {
+	reservation := level.Limiter.Reserve(level.Key, cost)
+	if reservation.Allowed && reservation.Delay == 0 {
+		return true, 0
+	}
+
+	if reservation.Allowed {
+		// Levels are not allowed to delay the events, only to reject them.
+		level.Limiter.Cancel(level.Key, cost)
+
+		return false, reservation.Delay
+	}
+
+	return false, reservation.RetryAfter
+}
@@ -0,0 +1,143 @@
+package ratelimit_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHierarchyRejectsAtTightestLevel(t *testing.T) {
+	group, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 3})
+	require.NoError(t, err)
+
+	clientA, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 2})
+	require.NoError(t, err)
+
+	clientB, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 2})
+	require.NoError(t, err)
+
+	var hierarchy ratelimit.Hierarchy
+
+	levelsA := []ratelimit.Level{
+		{Name: "global"},
+		{Name: "targetGroup", Limiter: group, Key: "DBService"},
+		{Name: "client", Limiter: clientA, Key: "clientA"},
+	}
+	levelsB := []ratelimit.Level{
+		{Name: "targetGroup", Limiter: group, Key: "DBService"},
+		{Name: "client", Limiter: clientB, Key: "clientB"},
+	}
+
+	_, _, ok := hierarchy.Allow(levelsA, 1)
+	assert.True(t, ok)
+	_, _, ok = hierarchy.Allow(levelsA, 1)
+	assert.True(t, ok)
+
+	// Client A is over its own limit. The group must not account for the rejected request.
+	tripped, retryAfter, ok := hierarchy.Allow(levelsA, 1)
+	assert.False(t, ok)
+	assert.Equal(t, "client", tripped.Name)
+	assert.Greater(t, retryAfter, time.Duration(0))
+
+	// Each client is within its own limit, but together they exceed the group's.
+	_, _, ok = hierarchy.Allow(levelsB, 1)
+	assert.True(t, ok)
+
+	tripped, _, ok = hierarchy.Allow(levelsB, 1)
+	assert.False(t, ok)
+	assert.Equal(t, "targetGroup", tripped.Name)
+	assert.True(t, clientB.Allow("clientB", 1), "Client B should have been given its request back")
+}
+
+func TestHierarchyDryRun(t *testing.T) {
+	group, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 2})
+	require.NoError(t, err)
+
+	client, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 1})
+	require.NoError(t, err)
+
+	var hierarchy ratelimit.Hierarchy
+
+	levels := []ratelimit.Level{
+		{Name: "targetGroup", Limiter: group, Key: "DBService"},
+		{Name: "client", Limiter: client, Key: "clientA", DryRun: true},
+	}
+
+	decision := hierarchy.Decide(levels, 1)
+	assert.True(t, decision.Allowed)
+	assert.Empty(t, decision.ShadowRejected)
+
+	// The dry run client level would reject, but only the group is enforced.
+	decision = hierarchy.Decide(levels, 1)
+	assert.True(t, decision.Allowed)
+	require.Len(t, decision.ShadowRejected, 1)
+	assert.Equal(t, "client", decision.ShadowRejected[0].Name)
+
+	// Both levels reject now, only the enforced one counts as the rejection.
+	decision = hierarchy.Decide(levels, 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "targetGroup", decision.Rejected.Name)
+	require.Len(t, decision.ShadowRejected, 1)
+}
+
+// barrierBackend is a slow Backend: every call waits until another one is in flight too, or until
+// its context is done.
+type barrierBackend struct {
+	arrived chan struct{}
+	once    sync.Once
+	both    chan struct{}
+}
+
+func (b *barrierBackend) Add(ctx context.Context, _ string, _ int64, _ int, _ time.Duration) (int64, int64, error) {
+	select {
+	case b.arrived <- struct{}{}:
+	default:
+		b.once.Do(func() { close(b.both) })
+	}
+
+	select {
+	case <-b.both:
+		return 1, 0, nil
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+}
+
+func TestHierarchyDoesNotSerializeSlowLevels(t *testing.T) {
+	backend := &barrierBackend{arrived: make(chan struct{}, 1), both: make(chan struct{})}
+
+	local, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 10})
+	require.NoError(t, err)
+
+	// A backend call that is not joined by the other one in time degrades the limiter.
+	clients := ratelimit.NewDistributedLimiter(backend, local, ratelimit.DistributedParams{
+		Limit:         10,
+		Timeout:       time.Second,
+		RetryInterval: time.Hour,
+	})
+
+	var (
+		hierarchy ratelimit.Hierarchy
+		wg        sync.WaitGroup
+	)
+
+	for _, client := range []string{"clientA", "clientB"} {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			assert.True(t, hierarchy.Decide([]ratelimit.Level{{Name: "client", Limiter: clients, Key: client}}, 1).Allowed)
+		}()
+	}
+
+	wg.Wait()
+
+	// Both clients reached the backend at the same time.
+	assert.NoError(t, clients.Degraded())
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// LeakyBucket is a leaky bucket used as a queue. Events leave the bucket evenly spaced at rate
+// events per second. An event that arrives while the bucket is still draining is queued behind
+// the others, i.e. it is allowed with a Delay, as long as no more than queueSize events are
+// waiting. Unlike the other algorithms it smooths traffic instead of only capping it.
+type LeakyBucket struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	queueSize int
+	// nextFree is the time the next event may leave the bucket.
+	nextFree time.Time
+}
+
+// NewLeakyBucket creates an empty leaky bucket. A queueSize smaller than 1 defaults to the rate.
+func NewLeakyBucket(rate float64, queueSize int) *LeakyBucket {
+	if queueSize < 1 {
+		queueSize = int(rate)
+	}
+
+	interval := InfDuration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return &LeakyBucket{
+		interval:  interval,
+		queueSize: queueSize,
+	}
+}
+
+// ReserveAt queues cost events at the given time. They are allowed with the Delay after which
+// they leave the bucket, or rejected if the queue is full.
+func (lb *LeakyBucket) ReserveAt(now time.Time, cost int) Reservation {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if cost > lb.queueSize || lb.interval == InfDuration {
+		return Reservation{RetryAfter: InfDuration}
+	}
+
+	start := lb.nextFree
+	if start.Before(now) {
+		start = now
+	}
+
+	// Events still queued ahead of this reservation, including the one currently leaving.
+	queued := int(start.Sub(now) / lb.interval)
+	if excess := queued + cost - lb.queueSize; excess > 0 {
+		return Reservation{RetryAfter: time.Duration(excess) * lb.interval}
+	}
+
+	lb.nextFree = start.Add(time.Duration(cost) * lb.interval)
+
+	return Reservation{Allowed: true, Delay: start.Sub(now)}
+}
+
+// CancelAt gives back the queue slots of cost events.
+func (lb *LeakyBucket) CancelAt(now time.Time, cost int) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.nextFree = lb.nextFree.Add(-time.Duration(cost) * lb.interval)
+	if lb.nextFree.Before(now) {
+		lb.nextFree = now
+	}
+}
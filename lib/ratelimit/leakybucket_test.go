@@ -0,0 +1,85 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeakyBucketQueuesEvents(t *testing.T) {
+	lb := ratelimit.NewLeakyBucket(10, 3)
+	now := time.Now()
+
+	assert.Equal(t, ratelimit.Reservation{Allowed: true}, lb.ReserveAt(now, 1))
+	assert.Equal(t, ratelimit.Reservation{Allowed: true, Delay: 100 * time.Millisecond}, lb.ReserveAt(now, 1))
+	assert.Equal(t, ratelimit.Reservation{Allowed: true, Delay: 200 * time.Millisecond}, lb.ReserveAt(now, 1))
+
+	reservation := lb.ReserveAt(now, 1)
+	assert.False(t, reservation.Allowed, "Event should be rejected when the queue is full")
+	assert.Equal(t, 100*time.Millisecond, reservation.RetryAfter)
+
+	// Once the bucket drained a slot the next event is queued behind the remaining ones.
+	assert.Equal(t, ratelimit.Reservation{Allowed: true, Delay: 200 * time.Millisecond},
+		lb.ReserveAt(now.Add(100*time.Millisecond), 1))
+}
+
+func TestLeakyBucketCancel(t *testing.T) {
+	lb := ratelimit.NewLeakyBucket(10, 3)
+	now := time.Now()
+
+	lb.ReserveAt(now, 1)
+	lb.ReserveAt(now, 1)
+	lb.CancelAt(now, 1)
+
+	assert.Equal(t, ratelimit.Reservation{Allowed: true, Delay: 100 * time.Millisecond}, lb.ReserveAt(now, 1))
+}
+
+func TestLeakyBucketShapesWaiters(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	limiter, err := ratelimit.New(ratelimit.AlgorithmLeakyBucket, ratelimit.Params{
+		Limit: 20,
+		Burst: 5,
+		Clock: fakeClock,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, limiter.Allow("clientA", 1))
+	assert.False(t, limiter.Allow("clientA", 1), "Allow should not admit queued events")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := fakeClock.Now()
+	errs := make(chan error, 1)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := limiter.Wait(ctx, "clientA", 1); err != nil {
+				errs <- err
+
+				return
+			}
+		}
+
+		errs <- nil
+	}()
+
+	// Events leave the bucket 50ms apart.
+	for i := 0; i < 3; i++ {
+		fakeClock.BlockUntil(1)
+		fakeClock.Advance(50 * time.Millisecond)
+	}
+
+	require.NoError(t, <-errs)
+	assert.Equal(t, 150*time.Millisecond, fakeClock.Since(start))
+
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+
+	assert.ErrorIs(t, limiter.Wait(short, "clientA", 1), ratelimit.ErrWaitExceedsDeadline)
+}
@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+)
+
+// InfDuration is the RetryAfter of a Reservation that can never be allowed, e.g. because its
+// cost is larger than the limit.
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Limiter limits the rate of events per key. Limiters keep their own state, so the same Limiter
+// can be shared by any number of keys (e.g. client IDs) and goroutines.
+type Limiter interface {
+	// Allow reports whether cost events may happen now for key and accounts for them if they may.
+	Allow(key string, cost int) bool
+	// Reserve is like Allow but also reports when the events are expected to be allowed if they
+	// are not allowed now. Shaping limiters may instead accept the events for a later time, in
+	// which case the caller has to wait for the reservation's Delay before proceeding.
+	Reserve(key string, cost int) Reservation
+	// Wait blocks until cost events are allowed for key and accounts for them, or until ctx is
+	// done.
+	Wait(ctx context.Context, key string, cost int) error
+	// Cancel gives back cost events previously allowed for key, e.g. when the event was rejected
+	// by another limiter after this one allowed it.
+	Cancel(key string, cost int)
+}
+
+// Reservation is the outcome of Limiter.Reserve.
+type Reservation struct {
+	// Allowed is true if the events were allowed and accounted for.
+	Allowed bool
+	// Delay is how long the caller has to wait before the allowed events may happen. It is only
+	// set by shaping limiters, which queue events instead of rejecting them.
+	Delay time.Duration
+	// RetryAfter is how long to wait before the events are expected to be allowed when Allowed is
+	// false. It is InfDuration if they will never be allowed.
+	RetryAfter time.Duration
+}
+
+// bucket is the rate limiting state of a single key.
+type bucket interface {
+	ReserveAt(now time.Time, cost int) Reservation
+	CancelAt(now time.Time, cost int)
+}
+
+// keyedLimiter implements Limiter by keeping one bucket per key. If maxKeys is set, only the
+// buckets of the maxKeys most recently used keys are kept.
+type keyedLimiter struct {
+	mu        sync.RWMutex
+	clock     clock.Clock
+	buckets   map[string]bucket
+	newBucket func(now time.Time) bucket
+	maxKeys   int
+	// recent orders the keys from most to least recently used when maxKeys is set.
+	recent   *list.List
+	elements map[string]*list.Element
+}
+
+func newKeyedLimiter(maxKeys int, clk clock.Clock, newBucket func(now time.Time) bucket) *keyedLimiter {
+	limiter := &keyedLimiter{
+		clock:     clock.OrDefault(clk),
+		buckets:   make(map[string]bucket),
+		newBucket: newBucket,
+		maxKeys:   maxKeys,
+	}
+
+	if maxKeys > 0 {
+		limiter.recent = list.New()
+		limiter.elements = make(map[string]*list.Element)
+	}
+
+	return limiter
+}
+
+func (l *keyedLimiter) Allow(key string, cost int) bool {
+	reservation := l.Reserve(key, cost)
+	if reservation.Allowed && reservation.Delay > 0 {
+		// Allow only admits events that may happen right away.
+		l.Cancel(key, cost)
+
+		return false
+	}
+
+	return reservation.Allowed
+}
+
+func (l *keyedLimiter) Reserve(key string, cost int) Reservation {
+	return l.bucket(key).ReserveAt(l.clock.Now(), cost)
+}
+
+func (l *keyedLimiter) Wait(ctx context.Context, key string, cost int) error {
+	return wait(ctx, l, l.clock, key, cost)
+}
+
+func (l *keyedLimiter) Cancel(key string, cost int) {
+	l.bucket(key).CancelAt(l.clock.Now(), cost)
+}
+
+func (l *keyedLimiter) bucket(key string) bucket {
+	if l.maxKeys > 0 {
+		return l.recentBucket(key)
+	}
+
+	l.mu.RLock()
+	b, ok := l.buckets[key]
+	l.mu.RUnlock()
+
+	if ok {
+		return b
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok = l.buckets[key]; !ok {
+		b = l.newBucket(l.clock.Now())
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+// recentBucket returns the bucket of key, marking it as the most recently used one and forgetting
+// the least recently used key if there are more than maxKeys.
+func (l *keyedLimiter) recentBucket(key string) bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if element, ok := l.elements[key]; ok {
+		l.recent.MoveToFront(element)
+
+		return l.buckets[key]
+	}
+
+	b := l.newBucket(l.clock.Now())
+	l.buckets[key] = b
+	l.elements[key] = l.recent.PushFront(key)
+
+	if l.recent.Len() > l.maxKeys {
+		oldest := l.recent.Remove(l.recent.Back()).(string) //nolint:forcetypeassert
+		delete(l.buckets, oldest)
+		delete(l.elements, oldest)
+	}
+
+	return b
+}
+
+// wait implements Limiter.Wait on top of Limiter.Reserve, waiting on clk. It gives up early if ctx
+// has a deadline that ends before the events are expected to be allowed. Context deadlines are
+// always in real time, so they are compared to the time left rather than to clk.
+func wait(ctx context.Context, limiter Limiter, clk clock.Clock, key string, cost int) error {
+	for {
+		reservation := limiter.Reserve(key, cost)
+		if reservation.Allowed && reservation.Delay == 0 {
+			return nil
+		}
+
+		if !reservation.Allowed && reservation.RetryAfter == InfDuration {
+			return ErrCostExceedsLimit
+		}
+
+		delay := reservation.RetryAfter
+		if reservation.Allowed {
+			delay = reservation.Delay
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && delay > time.Until(deadline) {
+			if reservation.Allowed {
+				limiter.Cancel(key, cost)
+			}
+
+			return ErrWaitExceedsDeadline
+		}
+
+		timer := clk.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			if reservation.Allowed {
+				limiter.Cancel(key, cost)
+			}
+
+			return ctx.Err()
+		case <-timer.C():
+		}
+
+		if reservation.Allowed {
+			return nil
+		}
+	}
+}
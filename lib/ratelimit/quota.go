@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QuotaPeriod is the period a quota applies to. Periods are calendar aligned in UTC, e.g. a daily
+// quota resets at midnight UTC.
+type QuotaPeriod string
+
+// Supported quota periods.
+const (
+	QuotaPeriodHour  QuotaPeriod = "hour"
+	QuotaPeriodDay   QuotaPeriod = "day"
+	QuotaPeriodMonth QuotaPeriod = "month"
+)
+
+// ParseQuotaPeriod returns the QuotaPeriod with the given name.
+func ParseQuotaPeriod(name string) (QuotaPeriod, error) {
+	switch period := QuotaPeriod(name); period {
+	case QuotaPeriodHour, QuotaPeriodDay, QuotaPeriodMonth:
+		return period, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownQuotaPeriod, name)
+	}
+}
+
+// Start returns the start of the period that contains t.
+func (p QuotaPeriod) Start(t time.Time) time.Time {
+	t = t.UTC()
+
+	switch p {
+	case QuotaPeriodHour:
+		return t.Truncate(time.Hour)
+	case QuotaPeriodMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// QuotaUsage is the usage of a quota in its current period.
+type QuotaUsage struct {
+	PeriodStart time.Time `json:"periodStart"`
+	Used        int64     `json:"used"`
+}
+
+// QuotaStorage persists quota usage so that it survives restarts.
+type QuotaStorage interface {
+	// Load returns the usage saved by the last Save, keyed by quota key.
+	Load() (map[string]QuotaUsage, error)
+	// Save replaces the saved usage.
+	Save(usage map[string]QuotaUsage) error
+}
+
+// QuotaTracker tracks the usage of long horizon quotas, e.g. connections per day or bytes per
+// month, per key. Usage is kept in memory and written to the storage by Flush.
+type QuotaTracker struct {
+	mu      sync.Mutex
+	usage   map[string]QuotaUsage
+	storage QuotaStorage
+	dirty   bool
+}
+
+// NewQuotaTracker creates a QuotaTracker and loads the saved usage from storage. storage may be
+// nil, in which case usage is only kept in memory.
+func NewQuotaTracker(storage QuotaStorage) (*QuotaTracker, error) {
+	tracker := &QuotaTracker{
+		usage:   make(map[string]QuotaUsage),
+		storage: storage,
+	}
+
+	if storage != nil {
+		usage, err := storage.Load()
+		if err != nil {
+			return nil, err
+		}
+
+		for key, u := range usage {
+			tracker.usage[key] = u
+		}
+	}
+
+	return tracker, nil
+}
+
+// Add adds amount to the usage of key in the current period, regardless of any limit. It is meant
+// for usage that is only known after the fact, e.g. bytes transferred.
+func (q *QuotaTracker) Add(key string, period QuotaPeriod, amount int64, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.current(key, period, now)
+	usage.Used += amount
+	q.usage[key] = usage
+	q.dirty = true
+}
+
+// Remaining returns how much of limit is left for key in the current period. It is negative if
+// the usage exceeded the limit.
+func (q *QuotaTracker) Remaining(key string, period QuotaPeriod, limit int64, now time.Time) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return limit - q.current(key, period, now).Used
+}
+
+// Flush writes the usage to the storage if it changed since the last flush.
+func (q *QuotaTracker) Flush() error {
+	q.mu.Lock()
+
+	if q.storage == nil || !q.dirty {
+		q.mu.Unlock()
+
+		return nil
+	}
+
+	usage := make(map[string]QuotaUsage, len(q.usage))
+	for key, u := range q.usage {
+		usage[key] = u
+	}
+
+	q.dirty = false
+	q.mu.Unlock()
+
+	if err := q.storage.Save(usage); err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// current returns the usage of key, reset if a new period started. q.mu must be held.
+func (q *QuotaTracker) current(key string, period QuotaPeriod, now time.Time) QuotaUsage {
+	periodStart := period.Start(now)
+
+	usage := q.usage[key]
+	if !usage.PeriodStart.Equal(periodStart) {
+		usage = QuotaUsage{PeriodStart: periodStart}
+	}
+
+	return usage
+}
+
+// FileQuotaStorage persists quota usage as JSON in a local file.
+type FileQuotaStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileQuotaStorage creates a FileQuotaStorage for the file at path.
+func NewFileQuotaStorage(path string) *FileQuotaStorage {
+	return &FileQuotaStorage{path: path}
+}
+
+// Load reads the usage from the file. A missing file is an empty usage.
+func (f *FileQuotaStorage) Load() (map[string]QuotaUsage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]QuotaUsage{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]QuotaUsage{}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("failed to parse quota file %s: %w", f.path, err)
+	}
+
+	return usage, nil
+}
+
+// Save writes the usage to a temporary file and renames it over the file, so that a crash never
+// leaves a partially written file behind.
+func (f *FileQuotaStorage) Save(usage map[string]QuotaUsage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
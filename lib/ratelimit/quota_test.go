@@ -0,0 +1,68 @@
+package ratelimit_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	now := time.Date(2024, time.March, 15, 13, 45, 10, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2024, time.March, 15, 13, 0, 0, 0, time.UTC), ratelimit.QuotaPeriodHour.Start(now))
+	assert.Equal(t, time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC), ratelimit.QuotaPeriodDay.Start(now))
+	assert.Equal(t, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), ratelimit.QuotaPeriodMonth.Start(now))
+
+	_, err := ratelimit.ParseQuotaPeriod("week")
+	assert.ErrorIs(t, err, ratelimit.ErrUnknownQuotaPeriod)
+}
+
+func TestQuotaTrackerRemaining(t *testing.T) {
+	tracker, err := ratelimit.NewQuotaTracker(nil)
+	require.NoError(t, err)
+
+	now := time.Date(2024, time.March, 15, 23, 0, 0, 0, time.UTC)
+
+	tracker.Add("clientA", ratelimit.QuotaPeriodDay, 1, now)
+	assert.Equal(t, int64(1), tracker.Remaining("clientA", ratelimit.QuotaPeriodDay, 2, now))
+	tracker.Add("clientA", ratelimit.QuotaPeriodDay, 1, now)
+	assert.Equal(t, int64(0), tracker.Remaining("clientA", ratelimit.QuotaPeriodDay, 2, now), "Quota should be used up")
+
+	// Keys are independent.
+	assert.Equal(t, int64(2), tracker.Remaining("clientB", ratelimit.QuotaPeriodDay, 2, now))
+
+	// The quota resets when the next day starts.
+	now = now.Add(time.Hour)
+	assert.Equal(t, int64(2), tracker.Remaining("clientA", ratelimit.QuotaPeriodDay, 2, now))
+}
+
+func TestQuotaTrackerAdd(t *testing.T) {
+	tracker, err := ratelimit.NewQuotaTracker(nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	tracker.Add("clientA", ratelimit.QuotaPeriodMonth, 150, now)
+
+	assert.Equal(t, int64(-50), tracker.Remaining("clientA", ratelimit.QuotaPeriodMonth, 100, now))
+}
+
+func TestFileQuotaStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	now := time.Now()
+
+	tracker, err := ratelimit.NewQuotaTracker(ratelimit.NewFileQuotaStorage(path))
+	require.NoError(t, err)
+
+	tracker.Add("clientA", ratelimit.QuotaPeriodDay, 4, now)
+	require.NoError(t, tracker.Flush())
+
+	// A new tracker on the same file picks up the saved usage.
+	tracker, err = ratelimit.NewQuotaTracker(ratelimit.NewFileQuotaStorage(path))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(6), tracker.Remaining("clientA", ratelimit.QuotaPeriodDay, 10, now))
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBackend is a Backend storing counters in Redis. Every window has its own key, which
+// expires on its own once it is no longer needed.
+type RedisBackend struct {
+	client redis.UniversalClient
+}
+
+// NewRedisBackend creates a RedisBackend using the given client.
+func NewRedisBackend(client redis.UniversalClient) *RedisBackend {
+	return &RedisBackend{client: client}
+}
+
+// Add increments the counter of the window and reads the previous one in a single round trip.
+func (r *RedisBackend) Add(
+	ctx context.Context,
+	key string,
+	window int64,
+	cost int,
+	ttl time.Duration,
+) (int64, int64, error) {
+	currentKey := key + ":" + strconv.FormatInt(window, 10)
+	previousKey := key + ":" + strconv.FormatInt(window-1, 10)
+
+	var (
+		current  *redis.IntCmd
+		previous *redis.StringCmd
+	)
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		current = pipe.IncrBy(ctx, currentKey, int64(cost))
+		pipe.PExpire(ctx, currentKey, ttl)
+		previous = pipe.Get(ctx, previousKey)
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, err
+	}
+
+	previousCount, err := previous.Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, err
+	}
+
+	return current.Val(), previousCount, nil
+}
@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+)
+
+// Algorithm is the name of a rate limiting algorithm in the registry.
+type Algorithm string
+
+const (
+	// AlgorithmFixedWindow counts events in fixed windows. It is the default.
+	AlgorithmFixedWindow Algorithm = "fixedWindow"
+	// AlgorithmTokenBucket allows bursts up to a configured size and refills at a steady rate.
+	AlgorithmTokenBucket Algorithm = "tokenBucket"
+	// AlgorithmSlidingWindowLog enforces the limit exactly over a sliding window.
+	AlgorithmSlidingWindowLog Algorithm = "slidingWindowLog"
+	// AlgorithmSlidingWindowCounter approximates a sliding window with two counters.
+	AlgorithmSlidingWindowCounter Algorithm = "slidingWindowCounter"
+	// AlgorithmLeakyBucket queues events and releases them evenly spaced. It is meant to be used
+	// with Limiter.Wait to shape traffic.
+	AlgorithmLeakyBucket Algorithm = "leakyBucket"
+)
+
+// DefaultWindow is the window used when Params.Window is not set.
+const DefaultWindow = time.Second
+
+// Params are the parameters a Limiter is built from.
+type Params struct {
+	// Limit is the number of events allowed per Window.
+	Limit int
+	// Burst is the number of events allowed at once by the token bucket, or the number of events
+	// that can be queued by the leaky bucket. Defaults to Limit.
+	Burst int
+	// Window is the period Limit applies to. Defaults to DefaultWindow.
+	Window time.Duration
+	// MaxKeys bounds the number of keys whose state is kept. When it is exceeded the least
+	// recently used key is forgotten, i.e. its limit starts over. 0 means unbounded.
+	MaxKeys int
+	// Clock is the clock the limiter tells the time with. Defaults to the time package.
+	Clock clock.Clock
+}
+
+// Factory builds a Limiter from Params.
+type Factory func(params Params) (Limiter, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[Algorithm]Factory{
+		AlgorithmFixedWindow: func(params Params) (Limiter, error) {
+			return newKeyedLimiter(params.MaxKeys, params.Clock, func(now time.Time) bucket {
+				return newFixedWindow(params.Limit, params.Window, now)
+			}), nil
+		},
+		AlgorithmTokenBucket: func(params Params) (Limiter, error) {
+			rate := float64(params.Limit) / params.Window.Seconds()
+
+			return newKeyedLimiter(params.MaxKeys, params.Clock, func(now time.Time) bucket {
+				return newTokenBucket(rate, params.Burst, now)
+			}), nil
+		},
+		AlgorithmSlidingWindowLog: func(params Params) (Limiter, error) {
+			return newKeyedLimiter(params.MaxKeys, params.Clock, func(now time.Time) bucket {
+				return NewSlidingWindowLog(params.Limit, params.Window)
+			}), nil
+		},
+		AlgorithmSlidingWindowCounter: func(params Params) (Limiter, error) {
+			return newKeyedLimiter(params.MaxKeys, params.Clock, func(now time.Time) bucket {
+				return newSlidingWindowCounter(params.Limit, params.Window, now)
+			}), nil
+		},
+		AlgorithmLeakyBucket: func(params Params) (Limiter, error) {
+			rate := float64(params.Limit) / params.Window.Seconds()
+
+			return newKeyedLimiter(params.MaxKeys, params.Clock, func(now time.Time) bucket {
+				return NewLeakyBucket(rate, params.Burst)
+			}), nil
+		},
+	}
+)
+
+// Register adds a rate limiting algorithm to the registry so it can be selected by name.
+func Register(algorithm Algorithm, factory Factory) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[algorithm]; ok {
+		return fmt.Errorf("%w: %s", ErrAlgorithmAlreadyRegistered, algorithm)
+	}
+
+	registry[algorithm] = factory
+
+	return nil
+}
+
+// ParseAlgorithm returns the registered Algorithm with the given name. An empty name selects the
+// fixed window algorithm.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	if name == "" {
+		return AlgorithmFixedWindow, nil
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if _, ok := registry[Algorithm(name)]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownAlgorithm, name)
+	}
+
+	return Algorithm(name), nil
+}
+
+// New builds a Limiter using the registered algorithm.
+func New(algorithm Algorithm, params Params) (Limiter, error) {
+	registryMu.RLock()
+	factory, ok := registry[algorithm]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, algorithm)
+	}
+
+	if params.Window <= 0 {
+		params.Window = DefaultWindow
+	}
+
+	return factory(params)
+}
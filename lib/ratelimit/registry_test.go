@@ -0,0 +1,101 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAlgorithm(t *testing.T) {
+	algorithm, err := ratelimit.ParseAlgorithm("")
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.AlgorithmFixedWindow, algorithm)
+
+	algorithm, err = ratelimit.ParseAlgorithm("tokenBucket")
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.AlgorithmTokenBucket, algorithm)
+
+	_, err = ratelimit.ParseAlgorithm("unknown")
+	assert.ErrorIs(t, err, ratelimit.ErrUnknownAlgorithm)
+}
+
+func TestRegister(t *testing.T) {
+	err := ratelimit.Register(ratelimit.AlgorithmTokenBucket, nil)
+	assert.ErrorIs(t, err, ratelimit.ErrAlgorithmAlreadyRegistered)
+
+	err = ratelimit.Register("allowAll", func(_ ratelimit.Params) (ratelimit.Limiter, error) {
+		return ratelimit.New(ratelimit.AlgorithmTokenBucket, ratelimit.Params{Limit: 1000})
+	})
+	require.NoError(t, err)
+
+	algorithm, err := ratelimit.ParseAlgorithm("allowAll")
+	require.NoError(t, err)
+
+	limiter, err := ratelimit.New(algorithm, ratelimit.Params{})
+	require.NoError(t, err)
+	assert.True(t, limiter.Allow("clientA", 1))
+}
+
+func TestLimiterKeysAreIndependent(t *testing.T) {
+	algorithms := []ratelimit.Algorithm{
+		ratelimit.AlgorithmFixedWindow,
+		ratelimit.AlgorithmTokenBucket,
+		ratelimit.AlgorithmSlidingWindowLog,
+		ratelimit.AlgorithmSlidingWindowCounter,
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			limiter, err := ratelimit.New(algorithm, ratelimit.Params{Limit: 2})
+			require.NoError(t, err)
+
+			assert.True(t, limiter.Allow("clientA", 2))
+			assert.False(t, limiter.Allow("clientA", 1))
+			assert.True(t, limiter.Allow("clientB", 2), "Another key should have its own limit")
+
+			reservation := limiter.Reserve("clientA", 1)
+			assert.False(t, reservation.Allowed)
+			assert.Greater(t, reservation.RetryAfter, time.Duration(0))
+
+			assert.Equal(t, ratelimit.InfDuration, limiter.Reserve("clientA", 3).RetryAfter)
+		})
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.AlgorithmTokenBucket, ratelimit.Params{Limit: 100, Burst: 1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, limiter.Wait(ctx, "clientA", 1))
+	assert.NoError(t, limiter.Wait(ctx, "clientA", 1), "Wait should block until a token is refilled")
+	assert.ErrorIs(t, limiter.Wait(ctx, "clientA", 2), ratelimit.ErrCostExceedsLimit)
+
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+
+	slow, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 1, Window: time.Hour})
+	require.NoError(t, err)
+	assert.True(t, slow.Allow("clientA", 1))
+	assert.ErrorIs(t, slow.Wait(cancelled, "clientA", 1), context.Canceled)
+}
+
+func TestLimiterMaxKeys(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.AlgorithmFixedWindow, ratelimit.Params{Limit: 1, MaxKeys: 2})
+	require.NoError(t, err)
+
+	assert.True(t, limiter.Allow("10.0.0.1", 1))
+	assert.True(t, limiter.Allow("10.0.0.2", 1))
+	assert.False(t, limiter.Allow("10.0.0.1", 1), "10.0.0.1 is now the most recently used key")
+
+	// Adding a third key forgets the least recently used one, 10.0.0.2.
+	assert.True(t, limiter.Allow("10.0.0.3", 1))
+	assert.True(t, limiter.Allow("10.0.0.2", 1), "Forgotten key should start over")
+	assert.False(t, limiter.Allow("10.0.0.2", 1))
+}
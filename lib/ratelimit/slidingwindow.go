@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SlidingWindowLog is a sliding window log rate limiter. It records the timestamp of every
+// allowed request and allows a new one only if fewer than limit requests were allowed within the
+// last window. Enforcement is exact, and memory is bounded since the log never holds more than
+// limit timestamps.
+type SlidingWindowLog struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	log    []time.Time
+}
+
+// NewSlidingWindowLog creates a sliding window log that allows limit requests per window.
+func NewSlidingWindowLog(limit int, window time.Duration) *SlidingWindowLog {
+	return &SlidingWindowLog{
+		limit:  limit,
+		window: window,
+	}
+}
+
+// AllowAt reports whether an event is allowed at the given time and records it if it is.
+func (s *SlidingWindowLog) AllowAt(now time.Time) bool {
+	return s.ReserveAt(now, 1).Allowed
+}
+
+// ReserveAt reports whether cost events are allowed at the given time and records them if they
+// are.
+func (s *SlidingWindowLog) ReserveAt(now time.Time, cost int) Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Evict the timestamps that fell out of the window. The log is sorted so they are all at the
+	// front.
+	windowStart := now.Add(-s.window)
+	expired := 0
+
+	for expired < len(s.log) && !s.log[expired].After(windowStart) {
+		expired++
+	}
+
+	s.log = s.log[expired:]
+
+	if cost > s.limit {
+		return Reservation{RetryAfter: InfDuration}
+	}
+
+	if excess := len(s.log) + cost - s.limit; excess > 0 {
+		// Wait until enough of the oldest timestamps slide out of the window.
+		return Reservation{RetryAfter: s.log[excess-1].Add(s.window).Sub(now)}
+	}
+
+	if len(s.log)+cost > cap(s.log) {
+		// Reallocate instead of letting append grow the backing array past what the window can
+		// hold.
+		log := make([]time.Time, len(s.log), min(s.limit, 2*len(s.log)+cost))
+		copy(log, s.log)
+		s.log = log
+	}
+
+	for i := 0; i < cost; i++ {
+		s.log = append(s.log, now)
+	}
+
+	return Reservation{Allowed: true}
+}
+
+// CancelAt removes the cost most recent timestamps from the log.
+func (s *SlidingWindowLog) CancelAt(_ time.Time, cost int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.log = s.log[:max(0, len(s.log)-cost)]
+}
+
+// SlidingWindowCounter is a sliding window counter rate limiter. It keeps a counter for the
+// current and the previous fixed window and estimates the number of requests in the sliding
+// window by weighting the previous counter by its overlap with the sliding window. It uses
+// constant memory at the cost of assuming requests were evenly spread in the previous window.
+type SlidingWindowCounter struct {
+	mu            sync.Mutex
+	limit         int
+	window        time.Duration
+	currentStart  time.Time
+	currentCount  int
+	previousCount int
+}
+
+// NewSlidingWindowCounter creates a sliding window counter that allows limit requests per
+// window. The first window starts now.
+func NewSlidingWindowCounter(limit int, window time.Duration) *SlidingWindowCounter {
+	return newSlidingWindowCounter(limit, window, time.Now())
+}
+
+func newSlidingWindowCounter(limit int, window time.Duration, now time.Time) *SlidingWindowCounter {
+	return &SlidingWindowCounter{
+		limit:        limit,
+		window:       window,
+		currentStart: now,
+	}
+}
+
+// AllowAt reports whether an event is allowed at the given time and counts it if it is.
+func (s *SlidingWindowCounter) AllowAt(now time.Time) bool {
+	return s.ReserveAt(now, 1).Allowed
+}
+
+// ReserveAt reports whether cost events are allowed at the given time and counts them if they
+// are. The RetryAfter of a rejected reservation is an estimate.
+func (s *SlidingWindowCounter) ReserveAt(now time.Time, cost int) Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elapsed := now.Sub(s.currentStart); elapsed >= s.window {
+		windows := elapsed / s.window
+		if windows == 1 {
+			s.previousCount = s.currentCount
+		} else {
+			s.previousCount = 0
+		}
+
+		s.currentCount = 0
+		s.currentStart = s.currentStart.Add(windows * s.window)
+	}
+
+	if cost > s.limit {
+		return Reservation{RetryAfter: InfDuration}
+	}
+
+	previousWeight := max(0, min(1, 1-float64(now.Sub(s.currentStart))/float64(s.window)))
+	estimated := float64(s.previousCount)*previousWeight + float64(s.currentCount)
+
+	if estimated+float64(cost) > float64(s.limit) {
+		return Reservation{RetryAfter: s.retryAfter(now, cost)}
+	}
+
+	s.currentCount += cost
+
+	return Reservation{Allowed: true}
+}
+
+// CancelAt gives back cost events counted in the current window.
+func (s *SlidingWindowCounter) CancelAt(now time.Time, cost int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.currentStart) < s.window {
+		s.currentCount = max(0, s.currentCount-cost)
+	}
+}
+
+// retryAfter estimates when cost events fit in the window, assuming no other events happen.
+func (s *SlidingWindowCounter) retryAfter(now time.Time, cost int) time.Duration {
+	windowEnd := s.currentStart.Add(s.window)
+
+	// Room left once the previous window has fully slid out. If there is enough, the events fit
+	// as soon as the weight of the previous window dropped far enough.
+	if room := s.limit - s.currentCount - cost; room >= 0 && s.previousCount > 0 {
+		fraction := 1 - float64(room)/float64(s.previousCount)
+
+		return max(0, s.currentStart.Add(time.Duration(fraction*float64(s.window))).Sub(now))
+	}
+
+	// Otherwise they fit in the next window once the current one weighs little enough.
+	if s.currentCount == 0 {
+		return windowEnd.Sub(now)
+	}
+
+	fraction := 1 - float64(s.limit-cost)/float64(s.currentCount)
+
+	return windowEnd.Add(time.Duration(max(0, fraction) * float64(s.window))).Sub(now)
+}
@@ -0,0 +1,68 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlidingWindowLogNoEdgeBurst(t *testing.T) {
+	s := ratelimit.NewSlidingWindowLog(2, time.Second)
+	start := time.Now()
+
+	// Two requests at the end of one fixed window...
+	assert.True(t, s.AllowAt(start.Add(900*time.Millisecond)))
+	assert.True(t, s.AllowAt(start.Add(950*time.Millisecond)))
+
+	// ...can not be followed by more at the start of the next one.
+	assert.False(t, s.AllowAt(start.Add(1100*time.Millisecond)))
+
+	// Once the first request slides out of the window there is room for one more.
+	reservation := s.ReserveAt(start.Add(1100*time.Millisecond), 1)
+	assert.False(t, reservation.Allowed)
+	assert.Equal(t, 800*time.Millisecond, reservation.RetryAfter)
+
+	assert.True(t, s.AllowAt(start.Add(1901*time.Millisecond)))
+	assert.False(t, s.AllowAt(start.Add(1920*time.Millisecond)))
+}
+
+func TestSlidingWindowLogRejectedRequestsAreNotLogged(t *testing.T) {
+	s := ratelimit.NewSlidingWindowLog(1, time.Second)
+	start := time.Now()
+
+	assert.True(t, s.AllowAt(start))
+
+	for i := 1; i < 100; i++ {
+		assert.False(t, s.AllowAt(start.Add(time.Duration(i)*time.Millisecond)))
+	}
+
+	assert.True(t, s.AllowAt(start.Add(time.Second)), "Rejected requests should not extend the window")
+}
+
+func TestSlidingWindowCounterWeightsPreviousWindow(t *testing.T) {
+	start := time.Now()
+	s := ratelimit.NewSlidingWindowCounter(10, time.Second)
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, s.AllowAt(start.Add(500*time.Millisecond)))
+	}
+
+	assert.False(t, s.AllowAt(start.Add(600*time.Millisecond)))
+
+	// A quarter into the next window the previous window still weighs 0.75 * 10, leaving room
+	// for 2 requests.
+	next := start.Add(1250 * time.Millisecond)
+	assert.True(t, s.AllowAt(next))
+	assert.True(t, s.AllowAt(next))
+	assert.False(t, s.AllowAt(next))
+
+	// After two full windows without requests the counters are reset.
+	later := start.Add(3100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.True(t, s.AllowAt(later))
+	}
+
+	assert.False(t, s.AllowAt(later))
+}
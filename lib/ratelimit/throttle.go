@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+)
+
+// ThrottledReader is an io.Reader that limits the rate bytes are read at. Every byte read costs
+// one event of the limiter, so the rate is shared by all readers using the same limiter and key.
+type ThrottledReader struct {
+	ctx      context.Context //nolint:containedctx
+	reader   io.Reader
+	limiter  Limiter
+	key      string
+	maxChunk int
+}
+
+// NewThrottledReader wraps reader so that reads wait on limiter for key. maxChunk caps the size of
+// a single read and must not be larger than the limiter's burst, otherwise reads can never be
+// allowed. Waiting is aborted when ctx is done.
+func NewThrottledReader(
+	ctx context.Context,
+	reader io.Reader,
+	limiter Limiter,
+	key string,
+	maxChunk int,
+) *ThrottledReader {
+	return &ThrottledReader{
+		ctx:      ctx,
+		reader:   reader,
+		limiter:  limiter,
+		key:      key,
+		maxChunk: maxChunk,
+	}
+}
+
+// Read reads up to maxChunk bytes and then waits until the limiter allows them.
+func (t *ThrottledReader) Read(p []byte) (int, error) {
+	if len(p) > t.maxChunk {
+		p = p[:t.maxChunk]
+	}
+
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.Wait(t.ctx, t.key, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,63 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottledReaderLimitsRate(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	limiter, err := ratelimit.New(ratelimit.AlgorithmTokenBucket, ratelimit.Params{
+		Limit: 1000,
+		Burst: 100,
+		Clock: fakeClock,
+	})
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("a"), 300)
+	reader := ratelimit.NewThrottledReader(context.Background(), bytes.NewReader(data), limiter, "clientA", 100)
+
+	start := fakeClock.Now()
+	done := make(chan []byte)
+
+	go func() {
+		read, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		done <- read
+	}()
+
+	// The first 100 bytes are covered by the burst, the remaining 200 take 200ms at 1000 B/s.
+	for i := 0; i < 2; i++ {
+		fakeClock.BlockUntil(1)
+		fakeClock.Advance(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, data, <-done)
+	assert.Equal(t, 200*time.Millisecond, fakeClock.Since(start))
+}
+
+func TestThrottledReaderSharesLimitAcrossReaders(t *testing.T) {
+	limiter, err := ratelimit.New(ratelimit.AlgorithmTokenBucket, ratelimit.Params{Limit: 1000, Burst: 100})
+	require.NoError(t, err)
+
+	first := ratelimit.NewThrottledReader(
+		context.Background(), bytes.NewReader(make([]byte, 100)), limiter, "clientA", 100)
+	_, err = io.ReadAll(first)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// The first reader used up the burst so the second one has to wait for it to refill.
+	second := ratelimit.NewThrottledReader(ctx, bytes.NewReader(make([]byte, 100)), limiter, "clientA", 100)
+	_, err = io.ReadAll(second)
+	assert.ErrorIs(t, err, ratelimit.ErrWaitExceedsDeadline)
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket rate limiter. The bucket holds at most burst tokens and is
+// refilled at rate tokens per second. Each event consumes one token, so up to burst events can
+// happen at once and rate events per second on average.
+type TokenBucket struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewTokenBucket creates a full token bucket. A burst smaller than 1 defaults to the rate.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return newTokenBucket(rate, burst, time.Now())
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+	if burst < 1 {
+		burst = int(rate)
+	}
+
+	return &TokenBucket{
+		rate:       rate,
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: now,
+	}
+}
+
+// AllowAt reports whether an event is allowed at the given time and consumes a token if it is.
+func (tb *TokenBucket) AllowAt(now time.Time) bool {
+	return tb.ReserveAt(now, 1).Allowed
+}
+
+// ReserveAt reports whether cost events are allowed at the given time and consumes cost tokens
+// if they are.
+func (tb *TokenBucket) ReserveAt(now time.Time, cost int) Reservation {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if elapsed := now.Sub(tb.lastRefill); elapsed > 0 {
+		tb.tokens = min(tb.burst, tb.tokens+elapsed.Seconds()*tb.rate)
+		tb.lastRefill = now
+	}
+
+	if float64(cost) > tb.burst || (tb.rate <= 0 && tb.tokens < float64(cost)) {
+		return Reservation{RetryAfter: InfDuration}
+	}
+
+	if missing := float64(cost) - tb.tokens; missing > 0 {
+		return Reservation{RetryAfter: time.Duration(missing / tb.rate * float64(time.Second))}
+	}
+
+	tb.tokens -= float64(cost)
+
+	return Reservation{Allowed: true}
+}
+
+// CancelAt puts cost tokens back in the bucket.
+func (tb *TokenBucket) CancelAt(_ time.Time, cost int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.tokens = min(tb.burst, tb.tokens+float64(cost))
+}
@@ -0,0 +1,62 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	tb := ratelimit.NewTokenBucket(1, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, tb.AllowAt(now), "Requests within the burst should be allowed")
+	}
+
+	assert.False(t, tb.AllowAt(now), "Request over the burst should be rejected")
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	tb := ratelimit.NewTokenBucket(2, 2)
+	now := time.Now()
+
+	assert.True(t, tb.AllowAt(now))
+	assert.True(t, tb.AllowAt(now))
+	assert.False(t, tb.AllowAt(now))
+
+	// Half a second at 2 tokens per second refills a single token.
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, tb.AllowAt(now))
+	assert.False(t, tb.AllowAt(now))
+
+	// Refill never exceeds the burst.
+	now = now.Add(10 * time.Second)
+	assert.True(t, tb.AllowAt(now))
+	assert.True(t, tb.AllowAt(now))
+	assert.False(t, tb.AllowAt(now))
+}
+
+func TestTokenBucketDefaultBurst(t *testing.T) {
+	tb := ratelimit.NewTokenBucket(2, 0)
+	now := time.Now()
+
+	assert.True(t, tb.AllowAt(now))
+	assert.True(t, tb.AllowAt(now))
+	assert.False(t, tb.AllowAt(now), "Burst should default to the rate")
+}
+
+func TestTokenBucketReserveCost(t *testing.T) {
+	tb := ratelimit.NewTokenBucket(2, 4)
+	now := time.Now()
+
+	assert.True(t, tb.ReserveAt(now, 3).Allowed)
+
+	reservation := tb.ReserveAt(now, 2)
+	assert.False(t, reservation.Allowed)
+	assert.Equal(t, 500*time.Millisecond, reservation.RetryAfter, "One token is missing at 2 tokens per second")
+
+	assert.Equal(t, ratelimit.InfDuration, tb.ReserveAt(now, 5).RetryAfter, "Cost over the burst is never allowed")
+}
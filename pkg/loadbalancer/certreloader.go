@@ -0,0 +1,191 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+)
+
+const defaultTLSReloadInterval = 10 * time.Second
+
+// CertReloader keeps the TLS material of the listener, i.e. its certificate, private key and the
+// CA pool client certificates are verified with, and reloads it when the files change. New
+// handshakes use the material loaded last, established sessions are not affected.
+type CertReloader struct {
+	params TLSConfigParams
+	clock  clock.Clock
+	// current is the *tls.Config built from the material loaded last.
+	current atomic.Pointer[tls.Config]
+
+	mu sync.Mutex
+	// attempted is the digest of the files the last reload was attempted with, so that a failed
+	// reload is only retried once the files change again.
+	attempted  []byte
+	lastReload time.Time
+	lastErr    error
+	// verifyPeerCertificate is an additional check of client certificates.
+	verifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+// NewCertReloader loads the TLS material configured in params. Reloads are timestamped with clk,
+// which defaults to the time package if nil.
+func NewCertReloader(params *TLSConfigParams, clk clock.Clock) (*CertReloader, error) {
+	r := &CertReloader{params: *params, clock: clock.OrDefault(clk)}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// TLSConfig returns the config of the listener. It picks the material loaded last on every
+// handshake, so it has no certificates or client CAs of its own, see Current.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}
+}
+
+// Current returns the config built from the material loaded last, which the handshakes use.
+func (r *CertReloader) Current() *tls.Config {
+	return r.current.Load()
+}
+
+// SetVerifyPeerCertificate sets an additional check of client certificates, run after they were
+// verified against the CA pool, see tls.Config.VerifyPeerCertificate.
+func (r *CertReloader) SetVerifyPeerCertificate(verify func([][]byte, [][]*x509.Certificate) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.verifyPeerCertificate = verify
+	r.current.Store(r.withVerifyPeerCertificate(r.current.Load().Clone()))
+}
+
+// withVerifyPeerCertificate adds the additional check of client certificates to config.
+func (r *CertReloader) withVerifyPeerCertificate(config *tls.Config) *tls.Config {
+	if r.verifyPeerCertificate != nil {
+		config.VerifyPeerCertificate = r.verifyPeerCertificate
+		// Resumed sessions skip VerifyPeerCertificate, so they must not outlive a revocation.
+		config.SessionTicketsDisabled = true
+	}
+
+	return config
+}
+
+// Reload loads the TLS material from the files. If that fails, the material loaded before is kept
+// and the error is returned.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reload()
+}
+
+// reloadIfChanged reloads the TLS material if the files changed since the last attempt. It
+// reports whether a reload was attempted.
+func (r *CertReloader) reloadIfChanged() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest, err := r.filesDigest()
+	if err != nil {
+		// The files may be in the middle of being replaced, try again on the next check.
+		return false, nil //nolint:nilerr
+	}
+
+	if bytes.Equal(digest, r.attempted) {
+		return false, nil
+	}
+
+	return true, r.reload()
+}
+
+func (r *CertReloader) reload() error {
+	r.lastErr = nil
+
+	if err := r.load(); err != nil {
+		r.lastErr = ErrReloadingTLSMaterial(err)
+	}
+
+	return r.lastErr
+}
+
+// load builds a tls.Config from the files and makes it the current one. It must be called with mu
+// held, except on creation.
+func (r *CertReloader) load() error {
+	// Record the attempt first, so that files that fail to load are not retried until they change.
+	r.attempted, _ = r.filesDigest()
+
+	config, err := NewTLSConfig(&r.params)
+	if err != nil {
+		return err
+	}
+
+	r.current.Store(r.withVerifyPeerCertificate(config))
+	r.lastReload = r.clock.Now()
+
+	return nil
+}
+
+// filesDigest hashes the contents of the certificate, private key and CA files.
+func (r *CertReloader) filesDigest() ([]byte, error) {
+	hash := sha256.New()
+
+	for _, path := range []string{r.params.Certificate, r.params.PrivateKey, r.params.CACertificate} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		hash.Write(data)
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// Status returns when the TLS material in use was loaded and the error of the last reload, if it
+// failed.
+func (r *CertReloader) Status() (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lastReload, r.lastErr
+}
+
+// Run checks the files for changes every interval and reloads the TLS material when they change,
+// until ctx is done. onReload is called with the outcome of every reload.
+func (r *CertReloader) Run(ctx context.Context, interval time.Duration, onReload func(error)) {
+	if interval == 0 {
+		interval = defaultTLSReloadInterval
+	}
+
+	if interval < 0 {
+		return
+	}
+
+	ticker := r.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if reloaded, err := r.reloadIfChanged(); reloaded {
+				onReload(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certFiles are the TLS files of a load balancer under test.
+type certFiles struct {
+	dir    string
+	params loadbalancer.TLSConfigParams
+}
+
+func newCertFiles(t *testing.T, ca *testCA, commonName string) *certFiles {
+	t.Helper()
+
+	files := &certFiles{dir: t.TempDir()}
+	files.params.CACertificate = writeTestFile(t, files.dir, "ca.pem", ca.pem)
+	files.write(t, ca, commonName)
+
+	return files
+}
+
+func (f *certFiles) write(t *testing.T, ca *testCA, commonName string) {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: []string{"loadbalancer.test"},
+	})
+
+	f.params.Certificate = writeTestFile(t, f.dir, "lb.crt", certPEM)
+	f.params.PrivateKey = writeTestFile(t, f.dir, "lb.key", keyPEM)
+}
+
+// serverCommonName makes a handshake with the listener config and returns the common name of the
+// certificate the server presented.
+func serverCommonName(t *testing.T, serverConfig *tls.Config, ca *testCA) string {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	clientCert := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}})
+
+	state, err := handshake(t, serverConfig, &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "loadbalancer.test",
+		Certificates: []tls.Certificate{clientCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	ca := newTestCA(t)
+	files := newCertFiles(t, ca, "lb-1")
+	fakeClock := clock.NewFake(time.Now())
+
+	reloader, err := loadbalancer.NewCertReloader(&files.params, fakeClock)
+	require.NoError(t, err)
+
+	serverConfig := reloader.TLSConfig()
+	assert.Equal(t, "lb-1", serverCommonName(t, serverConfig, ca))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan error)
+
+	go reloader.Run(ctx, time.Second, func(err error) { reloads <- err })
+
+	files.write(t, ca, "lb-2")
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(time.Second)
+	require.NoError(t, <-reloads)
+
+	assert.Equal(t, "lb-2", serverCommonName(t, serverConfig, ca))
+
+	loadedAt, err := reloader.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, fakeClock.Now(), loadedAt)
+}
+
+func TestCertReloaderKeepsMaterialOnFailure(t *testing.T) {
+	ca := newTestCA(t)
+	files := newCertFiles(t, ca, "lb-1")
+
+	reloader, err := loadbalancer.NewCertReloader(&files.params, nil)
+	require.NoError(t, err)
+
+	serverConfig := reloader.TLSConfig()
+
+	// A certificate that does not match the key, as seen while the files are being replaced.
+	certPEM, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "lb-2"}})
+	writeTestFile(t, files.dir, "lb.crt", certPEM)
+
+	err = reloader.Reload()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "keeping the current one")
+
+	_, err = reloader.Status()
+	assert.Error(t, err)
+	assert.Equal(t, "lb-1", serverCommonName(t, serverConfig, ca))
+
+	// A CA file without certificates would reject every client.
+	files.write(t, ca, "lb-2")
+	writeTestFile(t, files.dir, "ca.pem", []byte("not a certificate"))
+	assert.ErrorIs(t, reloader.Reload(), loadbalancer.ErrNoCACertificates)
+	assert.Equal(t, "lb-1", serverCommonName(t, serverConfig, ca))
+
+	writeTestFile(t, files.dir, "ca.pem", ca.pem)
+	files.write(t, ca, "lb-3")
+	require.NoError(t, reloader.Reload())
+	assert.Equal(t, "lb-3", serverCommonName(t, serverConfig, ca))
+}
+
+func TestNewCertReloaderFailsOnMissingFiles(t *testing.T) {
+	_, err := loadbalancer.NewCertReloader(&loadbalancer.TLSConfigParams{}, nil)
+	assert.ErrorIs(t, err, loadbalancer.ErrMTLSParamsMissing)
+}
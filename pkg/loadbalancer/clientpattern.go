@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// clientPattern is a client whose ClientId is a pattern matching several identities. Each
+// identity it matches becomes a client of its own, with its own rate limits, connection limit and
+// quotas.
+type clientPattern struct {
+	identityType string
+	match        func(value string) bool
+	config       ClientConfig
+}
+
+// IsClientIDPattern reports whether a ClientId is a pattern rather than an exact identity. A
+// ClientId starting with "^" is a regular expression, and one containing any of "*?[" is a glob.
+func IsClientIDPattern(clientID string) bool {
+	return strings.HasPrefix(clientID, "^") || strings.ContainsAny(clientID, "*?[")
+}
+
+func newClientPattern(config *ClientConfig, identityType string) (*clientPattern, error) {
+	pattern := &clientPattern{identityType: identityType, config: *config}
+
+	if strings.HasPrefix(config.ClientId, "^") {
+		re, err := regexp.Compile(config.ClientId)
+		if err != nil {
+			return nil, ErrInvalidClientIDPattern(config.ClientId, err)
+		}
+
+		pattern.match = re.MatchString
+
+		return pattern, nil
+	}
+
+	// Glob syntax is that of path.Match: "*" does not match "/", which keeps a wildcard within
+	// one segment of a URI.
+	if _, err := path.Match(config.ClientId, ""); err != nil {
+		return nil, ErrInvalidClientIDPattern(config.ClientId, err)
+	}
+
+	pattern.match = func(value string) bool {
+		matched, _ := path.Match(pattern.config.ClientId, value)
+
+		return matched
+	}
+
+	return pattern, nil
+}
+
+// matches reports whether the pattern matches a certificate identity.
+func (p *clientPattern) matches(identity ClientIdentity) bool {
+	return identity.Type == p.identityType && p.match(identity.Value)
+}
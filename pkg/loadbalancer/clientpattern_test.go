@@ -0,0 +1,168 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetClientByCertificatePatterns(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "*.bardomain.com", AllowedTargetGroup: "glob"},
+		{ClientId: `^batch-[0-9]+\.corp$`, AllowedTargetGroup: "regex"},
+		{ClientId: "^.*$", AllowedTargetGroup: "catchAll"},
+		{ClientId: "clientA.bardomain.com", AllowedTargetGroup: "exact"},
+		{ClientId: "spiffe://corp/ns/*/sa/exporter", IdentityType: "uri", AllowedTargetGroup: "uri"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		expected string
+	}{
+		{"exact wins over patterns", &x509.Certificate{Subject: pkix.Name{CommonName: "clientA.bardomain.com"}}, "exact"},
+		{"glob", &x509.Certificate{Subject: pkix.Name{CommonName: "clientB.bardomain.com"}}, "glob"},
+		{"regex", &x509.Certificate{Subject: pkix.Name{CommonName: "batch-42.corp"}}, "regex"},
+		{"first pattern wins", &x509.Certificate{Subject: pkix.Name{CommonName: "other.corp"}}, "catchAll"},
+		{
+			"exact on a lower precedence identity wins",
+			&x509.Certificate{
+				Subject: pkix.Name{CommonName: "clientA.bardomain.com"},
+				URIs:    []*url.URL{spiffeID(t, "spiffe://corp/ns/reports/sa/exporter")},
+			},
+			"exact",
+		},
+		{
+			"identity precedence among patterns",
+			&x509.Certificate{
+				Subject: pkix.Name{CommonName: "batch-1.corp"},
+				URIs:    []*url.URL{spiffeID(t, "spiffe://corp/ns/reports/sa/exporter")},
+			},
+			"uri",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientInfo, _, ok := store.GetClientByCertificate(test.cert)
+			require.True(t, ok)
+			assert.Equal(t, []string{test.expected}, clientInfo.GetAllowedTargetGroups())
+		})
+	}
+
+	// The glob does not cross URI segments.
+	_, _, ok := store.GetClientByCertificate(&x509.Certificate{
+		URIs: []*url.URL{spiffeID(t, "spiffe://corp/ns/a/b/sa/exporter")},
+	})
+	assert.False(t, ok)
+}
+
+func TestPatternClientsAreLimitedPerIdentity(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "*.bardomain.com", AllowedTargetGroup: "group1", RequestsPerSecond: 1, MaxConnections: 1},
+	})
+	require.NoError(t, err)
+
+	rateLimits, err := loadbalancer.NewRateLimitsStore(nil, nil, nil)
+	require.NoError(t, err)
+
+	clientA, identity, ok := store.GetClientByCertificate(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "clientA.bardomain.com"},
+	})
+	require.True(t, ok)
+	assert.Equal(t, "cn:clientA.bardomain.com", identity.String())
+	assert.Equal(t, "clientA.bardomain.com", clientA.GetClientID())
+	assert.Equal(t, "*.bardomain.com", clientA.GetPattern())
+
+	clientB, _, ok := store.GetClientByCertificate(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "clientB.bardomain.com"},
+	})
+	require.True(t, ok)
+
+	// Each identity has its own rate limit and connection limit.
+	assert.NoError(t, rateLimits.Admit(context.Background(), clientA, "group1"))
+	assert.ErrorIs(t, rateLimits.Admit(context.Background(), clientA, "group1"), loadbalancer.ErrRateLimitExceeded)
+	assert.NoError(t, rateLimits.Admit(context.Background(), clientB, "group1"))
+
+	assert.True(t, clientA.AcquireConnection())
+	assert.True(t, clientB.AcquireConnection())
+
+	// The same identity gets the same client, and its state, again.
+	again, _, ok := store.GetClientByCertificate(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "clientA.bardomain.com"},
+	})
+	require.True(t, ok)
+	assert.Same(t, clientA, again)
+	assert.False(t, again.AcquireConnection())
+}
+
+func TestPatternClientsAreBounded(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+
+	store := loadbalancer.NewClientStore()
+	store.SetClock(fakeClock)
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "*.bardomain.com", AllowedTargetGroup: "group1", MaxConnections: 1},
+	}))
+
+	getClient := func(i int) *loadbalancer.ClientInfo {
+		clientInfo, _, ok := store.GetClientByCertificate(&x509.Certificate{
+			Subject: pkix.Name{CommonName: fmt.Sprintf("client%d.bardomain.com", i)},
+		})
+		require.True(t, ok)
+
+		return clientInfo
+	}
+
+	// client0 is the least recently used identity, but it has an open connection.
+	busy := getClient(0)
+	require.True(t, busy.AcquireConnection())
+
+	fakeClock.Advance(time.Second)
+
+	idle := getClient(1)
+
+	for i := 2; i < loadbalancer.MaxPatternClients; i++ {
+		fakeClock.Advance(time.Millisecond)
+		getClient(i)
+	}
+
+	// A new identity makes the store forget the least recently used one without connections.
+	getClient(loadbalancer.MaxPatternClients)
+
+	assert.Same(t, busy, getClient(0))
+	assert.NotSame(t, idle, getClient(1))
+
+	// Identities unused for long are all forgotten at once.
+	fakeClock.Advance(time.Hour)
+
+	recent := getClient(loadbalancer.MaxPatternClients + 1)
+	for i := 2; i < 10; i++ {
+		getClient(loadbalancer.MaxPatternClients + i)
+	}
+
+	assert.Same(t, recent, getClient(loadbalancer.MaxPatternClients+1))
+	assert.Same(t, busy, getClient(0))
+}
+
+func TestAddClientsFromClientConfigListInvalidPattern(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{{ClientId: "^batch-[0-9+$"}})
+	assert.Error(t, err)
+
+	err = store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{{ClientId: "[a-.bardomain.com"}})
+	assert.Error(t, err)
+}
@@ -1,29 +1,124 @@
 package loadbalancer
 
 import (
+	"context"
+	"crypto/x509"
+	"io"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ari23/loadbalancer/lib/clock"
 	"github.com/ari23/loadbalancer/lib/ratelimit"
 )
 
+const (
+	// RateLimitModeDrop closes connections over the client's rate limit.
+	RateLimitModeDrop = "drop"
+	// RateLimitModeShape queues connections over the client's rate limit and releases them at the
+	// configured rate.
+	RateLimitModeShape = "shape"
+
+	defaultMaxQueueDelay = time.Second
+
+	// MaxPatternClients is how many identities matched by ClientId patterns are tracked at once.
+	// Once reached, the identity used least recently without open connections is forgotten.
+	MaxPatternClients = 10000
+	// patternClientIdleTTL is how long an identity matched by a pattern is tracked without being
+	// used. Its rate limits are per second, so it is forgotten long after they could still apply.
+	patternClientIdleTTL = 10 * time.Minute
+)
+
+// ClientInfo is the identity and authorization of a client. The client's rate limiting state is
+// kept by its limiter, keyed by client ID.
 type ClientInfo struct {
-	mu                   sync.Mutex
-	clientID             string
-	allowedTargetGroup   string
-	maxConnections       int
-	connections          int
-	maxRequestsPerWindow int
-	lastWindow           time.Time
-	requestCount         int
+	mu                  sync.Mutex
+	clientID            string
+	identityType        string
+	pattern             string
+	allowedTargetGroups []string
+	pins                []certificatePin
+	maxConnections      int
+	connections         int
+	rateLimitAlgorithm  ratelimit.Algorithm
+	limiter             ratelimit.Limiter
+	rateLimitMode       string
+	rateLimitDryRun     bool
+	maxQueueDelay       time.Duration
+	rejectAction        *RejectAction
+	upload              *bandwidthLimit
+	download            *bandwidthLimit
+	quotas              []clientQuota
+}
+
+// bandwidthLimit is a bytes per second limit shared by all of a client's connections.
+type bandwidthLimit struct {
+	limiter ratelimit.Limiter
+	burst   int
+}
+
+func newBandwidthLimit(bytesPerSecond, burst int, clk clock.Clock) (*bandwidthLimit, error) {
+	if bytesPerSecond <= 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+
+	limiter, err := ratelimit.New(ratelimit.AlgorithmTokenBucket, ratelimit.Params{
+		Limit: bytesPerSecond,
+		Burst: burst,
+		Clock: clk,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &bandwidthLimit{limiter: limiter, burst: burst}, nil
 }
 
 func (c *ClientInfo) GetClientID() string {
 	return c.clientID
 }
 
-func (c *ClientInfo) GetAllowedTargetGroup() string {
-	return c.allowedTargetGroup
+// GetIdentity returns the certificate identity the client is matched on.
+func (c *ClientInfo) GetIdentity() ClientIdentity {
+	return ClientIdentity{Type: c.identityType, Value: c.clientID}
+}
+
+// GetPattern returns the ClientId pattern the client was matched by, or "" if the client is
+// configured with its exact identity.
+func (c *ClientInfo) GetPattern() string {
+	return c.pattern
+}
+
+// GetAllowedTargetGroups returns the target groups the client is allowed to access.
+func (c *ClientInfo) GetAllowedTargetGroups() []string {
+	return c.allowedTargetGroups
+}
+
+// IsTargetGroupAllowed reports whether the client is allowed to access the target group.
+func (c *ClientInfo) IsTargetGroupAllowed(targetGroup string) bool {
+	return slices.Contains(c.allowedTargetGroups, targetGroup)
+}
+
+// VerifyPins checks the client's certificate against its pins. Any one of the pins must match, so
+// a pin can be rotated by listing the old and the new one together. A client without pins accepts
+// any certificate.
+func (c *ClientInfo) VerifyPins(cert *x509.Certificate) error {
+	if len(c.pins) == 0 {
+		return nil
+	}
+
+	for _, pin := range c.pins {
+		if pin.matches(cert) {
+			return nil
+		}
+	}
+
+	return ErrCertificatePinMismatch(c.clientID)
 }
 
 func (c *ClientInfo) GetMaxConnections() int {
@@ -31,72 +126,323 @@ func (c *ClientInfo) GetMaxConnections() int {
 }
 
 func (c *ClientInfo) GetConnections() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	return c.connections
 }
 
-func (c *ClientInfo) GetMaxRequestsPerWindow() int {
-	return c.maxRequestsPerWindow
+// GetRateLimitMode returns what happens to the client's connections over its rate limit.
+func (c *ClientInfo) GetRateLimitMode() string {
+	return c.rateLimitMode
+}
+
+// GetRateLimitDryRun returns whether the client's rate limit is only recorded, not enforced.
+func (c *ClientInfo) GetRateLimitDryRun() bool {
+	return c.rateLimitDryRun
+}
+
+// GetMaxQueueDelay returns how long a connection may be queued in shape mode.
+func (c *ClientInfo) GetMaxQueueDelay() time.Duration {
+	return c.maxQueueDelay
 }
 
-func (c *ClientInfo) GetLastWindow() time.Time {
-	return c.lastWindow
+// GetRejectAction returns what to do with the client's connections rejected by a rate limit.
+func (c *ClientInfo) GetRejectAction() *RejectAction {
+	return c.rejectAction
 }
 
-func (c *ClientInfo) GetRequestCount() int {
-	return c.requestCount
+func (c *ClientInfo) getQuotas() []clientQuota {
+	return c.quotas
 }
 
-func (c *ClientInfo) SetLastWindow(now time.Time) {
+// AcquireConnection takes one of the client's connection slots. It returns false if the client is
+// already at its connection limit. A limit of 0 means unlimited.
+func (c *ClientInfo) AcquireConnection() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.lastWindow = now
-	c.requestCount = 0
+	if c.maxConnections > 0 && c.connections >= c.maxConnections {
+		return false
+	}
+
+	c.connections++
+
+	return true
 }
 
-func (c *ClientInfo) IncrementRequestCount() {
+// ReleaseConnection gives back a slot taken with AcquireConnection.
+func (c *ClientInfo) ReleaseConnection() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.requestCount++
+	c.connections--
+}
+
+// withLimiter returns a client like c, rate limited by limiter instead. It only stands in for c
+// in rate limiting, its connections and quotas are not tracked.
+func (c *ClientInfo) withLimiter(algorithm ratelimit.Algorithm, limiter ratelimit.Limiter) *ClientInfo {
+	return &ClientInfo{
+		clientID:            c.clientID,
+		identityType:        c.identityType,
+		pattern:             c.pattern,
+		allowedTargetGroups: c.allowedTargetGroups,
+		rateLimitAlgorithm:  algorithm,
+		limiter:             limiter,
+		rateLimitMode:       c.rateLimitMode,
+		rateLimitDryRun:     c.rateLimitDryRun,
+		maxQueueDelay:       c.maxQueueDelay,
+		rejectAction:        c.rejectAction,
+	}
+}
+
+func (c *ClientInfo) GetRateLimitAlgorithm() ratelimit.Algorithm {
+	return c.rateLimitAlgorithm
+}
+
+// GetLimiter returns the limiter enforcing the client's request rate.
+func (c *ClientInfo) GetLimiter() ratelimit.Limiter {
+	return c.limiter
+}
+
+// ThrottleUpload wraps a reader of the client's upload stream with the client's upload bandwidth
+// limit. The reader is returned unchanged if the client has no upload limit.
+func (c *ClientInfo) ThrottleUpload(ctx context.Context, reader io.Reader) io.Reader {
+	return c.throttle(ctx, reader, c.upload)
+}
+
+// ThrottleDownload wraps a reader of the client's download stream with the client's download
+// bandwidth limit. The reader is returned unchanged if the client has no download limit.
+func (c *ClientInfo) ThrottleDownload(ctx context.Context, reader io.Reader) io.Reader {
+	return c.throttle(ctx, reader, c.download)
+}
+
+func (c *ClientInfo) throttle(ctx context.Context, reader io.Reader, limit *bandwidthLimit) io.Reader {
+	if limit == nil {
+		return reader
+	}
+
+	return ratelimit.NewThrottledReader(ctx, reader, limit.limiter, c.clientID, limit.burst)
 }
 
 // NewClientInfo initializes a ClientInfo with specified limits.
-func NewClientInfo(clientID, allowedTargetGroup string, maxRequestsPerWindow, maxConnections int) *ClientInfo {
+func NewClientInfo(
+	clientID string,
+	allowedTargetGroups []string,
+	maxConnections int,
+	rateLimitAlgorithm ratelimit.Algorithm,
+	limiter ratelimit.Limiter,
+) *ClientInfo {
 	return &ClientInfo{
-		clientID:             clientID,
-		maxRequestsPerWindow: maxRequestsPerWindow,
-		maxConnections:       maxConnections,
-		allowedTargetGroup:   allowedTargetGroup,
-		lastWindow:           time.Now(),
+		clientID:            clientID,
+		identityType:        IdentityTypeCommonName,
+		maxConnections:      maxConnections,
+		allowedTargetGroups: allowedTargetGroups,
+		rateLimitAlgorithm:  rateLimitAlgorithm,
+		limiter:             limiter,
+		rateLimitMode:       RateLimitModeDrop,
+		rejectAction:        defaultRejectAction,
+	}
+}
+
+// allowedTargetGroups returns the target groups of the client config, including the deprecated
+// single one.
+func (c *ClientConfig) allowedTargetGroups() []string {
+	targetGroups := append([]string(nil), c.AllowedTargetGroups...)
+
+	if c.AllowedTargetGroup != "" && !slices.Contains(targetGroups, c.AllowedTargetGroup) {
+		targetGroups = append(targetGroups, c.AllowedTargetGroup)
 	}
+
+	return targetGroups
+}
+
+// newClientInfoFromConfig initializes a ClientInfo with the rate limiting algorithm and
+// parameters selected in the client config.
+func newClientInfoFromConfig(c *ClientConfig, shared *SharedRateLimit, clk clock.Clock) (*ClientInfo, error) {
+	algorithm, err := ratelimit.ParseAlgorithm(c.RateLimitAlgorithm)
+	if err != nil {
+		return nil, ErrInvalidClientConfig(c.ClientId, err)
+	}
+
+	limiter, err := ratelimit.New(algorithm, ratelimit.Params{
+		Limit: c.RequestsPerSecond,
+		Burst: c.Burst,
+		Clock: clk,
+	})
+	if err != nil {
+		return nil, ErrInvalidClientConfig(c.ClientId, err)
+	}
+
+	// Shaping queues connections locally, so shaped clients are limited by each instance on its
+	// own.
+	if shared != nil && c.RateLimitMode != RateLimitModeShape {
+		limiter = shared.wrap(c.RequestsPerSecond, c.Burst, limiter, clk)
+	}
+
+	clientInfo := NewClientInfo(c.ClientId, c.allowedTargetGroups(), c.MaxConnections, algorithm, limiter)
+
+	clientInfo.identityType, err = parseIdentityType(c.IdentityType)
+	if err != nil {
+		return nil, ErrInvalidClientConfig(c.ClientId, err)
+	}
+
+	clientInfo.pins, err = parseCertificatePins(c.Pins)
+	if err != nil {
+		return nil, ErrInvalidClientConfig(c.ClientId, err)
+	}
+
+	switch c.RateLimitMode {
+	case "", RateLimitModeDrop:
+	case RateLimitModeShape:
+		clientInfo.rateLimitMode = RateLimitModeShape
+
+		clientInfo.maxQueueDelay = c.MaxQueueDelay
+		if clientInfo.maxQueueDelay <= 0 {
+			clientInfo.maxQueueDelay = defaultMaxQueueDelay
+		}
+	default:
+		return nil, ErrInvalidClientConfig(c.ClientId, ErrUnknownRateLimitMode(c.RateLimitMode))
+	}
+
+	clientInfo.rateLimitDryRun = c.RateLimitDryRun
+
+	if c.RateLimitRejection != nil {
+		clientInfo.rejectAction, err = newRejectAction(c.RateLimitRejection, clk)
+		if err != nil {
+			return nil, ErrInvalidClientConfig(c.ClientId, err)
+		}
+	}
+
+	clientInfo.upload, err = newBandwidthLimit(c.Bandwidth.UploadBytesPerSecond, c.Bandwidth.UploadBurst, clk)
+	if err != nil {
+		return nil, ErrInvalidClientConfig(c.ClientId, err)
+	}
+
+	clientInfo.download, err = newBandwidthLimit(c.Bandwidth.DownloadBytesPerSecond, c.Bandwidth.DownloadBurst, clk)
+	if err != nil {
+		return nil, ErrInvalidClientConfig(c.ClientId, err)
+	}
+
+	for _, quotaConfig := range c.Quotas {
+		quota, err := newClientQuota(quotaConfig)
+		if err != nil {
+			return nil, ErrInvalidClientConfig(c.ClientId, err)
+		}
+
+		clientInfo.quotas = append(clientInfo.quotas, quota)
+	}
+
+	return clientInfo, nil
 }
 
 type ClientsStore struct {
 	// authorizedClients is a map of client name to client config.
-	authorizedClients map[string]ratelimit.ClientInfoInterface
-	mu                sync.RWMutex
+	authorizedClients map[string]*ClientInfo
+	// identities is a map of the certificate identity each client is matched on to the client.
+	identities map[ClientIdentity]*ClientInfo
+	// patterns are the clients whose ClientId is a pattern, in the order they were added.
+	patterns []*clientPattern
+	// patternClients is a map of the identities matched by patterns to their clients. It holds at
+	// most MaxPatternClients identities.
+	patternClients map[ClientIdentity]*patternClient
+	// identityPrecedence is the order the identity types of a certificate are matched in.
+	identityPrecedence []string
+	// identifyUnknownClients makes certificates that match no client clients of their own.
+	identifyUnknownClients bool
+	mu                     sync.RWMutex
+	// sharedRateLimit, if set, shares the client rate limits with other load balancer instances.
+	sharedRateLimit *SharedRateLimit
+	// clock is the clock of the rate limiters of the clients.
+	clock clock.Clock
 }
 
 func NewClientStore() *ClientsStore {
 	return &ClientsStore{
-		authorizedClients: make(map[string]ratelimit.ClientInfoInterface),
+		authorizedClients:  make(map[string]*ClientInfo),
+		identities:         make(map[ClientIdentity]*ClientInfo),
+		patternClients:     make(map[ClientIdentity]*patternClient),
+		identityPrecedence: defaultIdentityPrecedence,
 	}
 }
 
-func (cs *ClientsStore) AddClientsFromClientConfigList(clients []ClientConfig) {
+// SetIdentityPrecedence sets the order the identity types of client certificates are matched in,
+// see ParseIdentityPrecedence.
+func (cs *ClientsStore) SetIdentityPrecedence(precedence []string) error {
+	precedence, err := ParseIdentityPrecedence(precedence)
+	if err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.identityPrecedence = precedence
+
+	return nil
+}
+
+// SetIdentifyUnknownClients makes certificates that match no client identify as a client of their
+// own, named after their first identity in precedence order, with no limits and no allowed target
+// groups. It is meant for authorization policies, which decide what such clients may access.
+func (cs *ClientsStore) SetIdentifyUnknownClients(enabled bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.identifyUnknownClients = enabled
+}
+
+// SetSharedRateLimit makes the clients added afterwards share their rate limits with other load
+// balancer instances.
+func (cs *ClientsStore) SetSharedRateLimit(shared *SharedRateLimit) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.sharedRateLimit = shared
+}
+
+// SetClock sets the clock of the rate limiters of the clients added afterwards.
+func (cs *ClientsStore) SetClock(clk clock.Clock) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
-	for _, c := range clients {
-		clientInfo := NewClientInfo(
-			c.ClientId, c.AllowedTargetGroup, c.RequestsPerSecond, 5)
+	cs.clock = clk
+}
+
+func (cs *ClientsStore) AddClientsFromClientConfigList(clients []ClientConfig) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for i := range clients {
+		clientInfo, err := newClientInfoFromConfig(&clients[i], cs.sharedRateLimit, cs.clock)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := cs.authorizedClients[clients[i].ClientId]; ok {
+			return ErrDuplicateClientID(clients[i].ClientId)
+		}
+
+		cs.authorizedClients[clients[i].ClientId] = clientInfo
+
+		if IsClientIDPattern(clients[i].ClientId) {
+			pattern, err := newClientPattern(&clients[i], clientInfo.identityType)
+			if err != nil {
+				return ErrInvalidClientConfig(clients[i].ClientId, err)
+			}
 
-		cs.authorizedClients[c.ClientId] = clientInfo
+			cs.patterns = append(cs.patterns, pattern)
+
+			continue
+		}
+
+		cs.identities[clientInfo.GetIdentity()] = clientInfo
 	}
+
+	return nil
 }
 
-func (cs *ClientsStore) GetClient(clientId string) (ratelimit.ClientInfoInterface, bool) {
+func (cs *ClientsStore) GetClient(clientId string) (*ClientInfo, bool) {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
 
@@ -105,7 +451,172 @@ func (cs *ClientsStore) GetClient(clientId string) (ratelimit.ClientInfoInterfac
 	return clientInfo, ok
 }
 
-func (cs *ClientsStore) GetClients() map[string]ratelimit.ClientInfoInterface {
+// GetClientByCertificate returns the client matching an identity of cert. A client configured with
+// the exact identity wins over ClientId patterns. Identities are tried in the order of
+// GetCertificateIdentities and patterns in the order they were added, so a certificate matching
+// several clients always resolves to the same one. The matched identity is returned along with the
+// client.
+//
+// Each identity matched by a pattern is a client of its own, with its own limits.
+func (cs *ClientsStore) GetClientByCertificate(cert *x509.Certificate) (*ClientInfo, ClientIdentity, bool) {
+	clientInfo, pattern, identity := cs.lookupCertificate(cert)
+	if clientInfo != nil {
+		return clientInfo, identity, true
+	}
+
+	if pattern == nil {
+		return cs.newUnknownClient(cert)
+	}
+
+	clientInfo = cs.addPatternClient(pattern, identity)
+
+	return clientInfo, identity, clientInfo != nil
+}
+
+// lookupCertificate returns the client matching an identity of cert, or the first pattern
+// matching one if that identity has no client yet.
+func (cs *ClientsStore) lookupCertificate(cert *x509.Certificate) (*ClientInfo, *clientPattern, ClientIdentity) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	now := clock.OrDefault(cs.clock).Now()
+
+	identities := GetCertificateIdentities(cert, cs.identityPrecedence)
+
+	for _, identity := range identities {
+		if clientInfo, ok := cs.identities[identity]; ok {
+			return clientInfo, nil, identity
+		}
+	}
+
+	for _, identity := range identities {
+		for _, pattern := range cs.patterns {
+			if !pattern.matches(identity) {
+				continue
+			}
+
+			if client, ok := cs.patternClients[identity]; ok {
+				client.lastUsed.Store(now.UnixNano())
+
+				return client.clientInfo, pattern, identity
+			}
+
+			return nil, pattern, identity
+		}
+	}
+
+	return nil, nil, ClientIdentity{}
+}
+
+// addPatternClient creates the client of an identity matched by pattern, unless it was created in
+// the meantime. It returns nil if MaxPatternClients identities are tracked and all of them have
+// open connections.
+func (cs *ClientsStore) addPatternClient(pattern *clientPattern, identity ClientIdentity) *ClientInfo {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if client, ok := cs.patternClients[identity]; ok {
+		return client.clientInfo
+	}
+
+	now := clock.OrDefault(cs.clock).Now()
+	if !cs.makeRoomForPatternClient(now) {
+		return nil
+	}
+
+	config := pattern.config
+	config.ClientId = identity.Value
+
+	// The pattern's config was validated when it was added.
+	clientInfo, err := newClientInfoFromConfig(&config, cs.sharedRateLimit, cs.clock)
+	if err != nil {
+		return nil
+	}
+
+	clientInfo.pattern = pattern.config.ClientId
+	client := &patternClient{clientInfo: clientInfo}
+	client.lastUsed.Store(now.UnixNano())
+	cs.patternClients[identity] = client
+
+	return clientInfo
+}
+
+// patternClient is the client of an identity matched by a pattern.
+type patternClient struct {
+	clientInfo *ClientInfo
+	// lastUsed is when the identity was last looked up, in Unix nanoseconds.
+	lastUsed atomic.Int64
+}
+
+// makeRoomForPatternClient makes sure another identity can be added to patternClients. When it is
+// full, the identities unused for patternClientIdleTTL are forgotten, and if there are none, the
+// one used least recently. Identities with open connections are kept, so that their connection
+// limits hold. cs.mu must be held.
+func (cs *ClientsStore) makeRoomForPatternClient(now time.Time) bool {
+	if len(cs.patternClients) < MaxPatternClients {
+		return true
+	}
+
+	var (
+		oldest         ClientIdentity
+		oldestLastUsed int64
+		found          bool
+	)
+
+	for identity, client := range cs.patternClients {
+		if client.clientInfo.GetConnections() > 0 {
+			continue
+		}
+
+		lastUsed := client.lastUsed.Load()
+		if now.Sub(time.Unix(0, lastUsed)) >= patternClientIdleTTL {
+			delete(cs.patternClients, identity)
+
+			continue
+		}
+
+		if !found || lastUsed < oldestLastUsed {
+			oldest, oldestLastUsed, found = identity, lastUsed, true
+		}
+	}
+
+	if len(cs.patternClients) < MaxPatternClients {
+		return true
+	}
+
+	if !found {
+		return false
+	}
+
+	delete(cs.patternClients, oldest)
+
+	return true
+}
+
+// newUnknownClient creates the client of a certificate that matches no client, if unknown clients
+// are identified. Such clients have no limits, so nothing is kept about them across connections.
+func (cs *ClientsStore) newUnknownClient(cert *x509.Certificate) (*ClientInfo, ClientIdentity, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	if !cs.identifyUnknownClients {
+		return nil, ClientIdentity{}, false
+	}
+
+	identities := GetCertificateIdentities(cert, cs.identityPrecedence)
+	if len(identities) == 0 {
+		return nil, ClientIdentity{}, false
+	}
+
+	identity := identities[0]
+
+	clientInfo := NewClientInfo(identity.Value, nil, 0, ratelimit.AlgorithmFixedWindow, nil)
+	clientInfo.identityType = identity.Type
+
+	return clientInfo, identity, true
+}
+
+func (cs *ClientsStore) GetClients() map[string]*ClientInfo {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
 
@@ -0,0 +1,138 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddClientsFromClientConfigListAlgorithm(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1", RequestsPerSecond: 5},
+		{
+			ClientId:           "clientB",
+			AllowedTargetGroup: "group1",
+			RequestsPerSecond:  5,
+			RateLimitAlgorithm: "tokenBucket",
+			Burst:              10,
+		},
+	})
+	require.NoError(t, err)
+
+	clientA, ok := store.GetClient("clientA")
+	require.True(t, ok)
+	assert.Equal(t, ratelimit.AlgorithmFixedWindow, clientA.GetRateLimitAlgorithm())
+
+	clientB, ok := store.GetClient("clientB")
+	require.True(t, ok)
+	assert.Equal(t, ratelimit.AlgorithmTokenBucket, clientB.GetRateLimitAlgorithm())
+	assert.NotNil(t, clientB.GetLimiter())
+}
+
+func TestAddClientsFromClientConfigListUnknownAlgorithm(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", RateLimitAlgorithm: "unknown"},
+	})
+
+	assert.ErrorIs(t, err, ratelimit.ErrUnknownAlgorithm)
+}
+
+func TestSlidingWindowConcurrentRequests(t *testing.T) {
+	const (
+		limit      = 50
+		goroutines = 20
+		requests   = 10
+	)
+
+	for _, algorithm := range []string{"slidingWindowLog", "slidingWindowCounter"} {
+		t.Run(algorithm, func(t *testing.T) {
+			store := loadbalancer.NewClientStore()
+			err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+				{ClientId: "clientA", RequestsPerSecond: limit, RateLimitAlgorithm: algorithm},
+			})
+			require.NoError(t, err)
+
+			clientInfo, ok := store.GetClient("clientA")
+			require.True(t, ok)
+
+			var (
+				wg      sync.WaitGroup
+				allowed atomic.Int64
+			)
+
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					for j := 0; j < requests; j++ {
+						if clientInfo.GetLimiter().Allow(clientInfo.GetClientID(), 1) {
+							allowed.Add(1)
+						}
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			assert.Equal(t, int64(limit), allowed.Load())
+		})
+	}
+}
+
+func TestClientConnectionLimit(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", RequestsPerSecond: 5, MaxConnections: 2},
+		{ClientId: "clientB", RequestsPerSecond: 5},
+	})
+	require.NoError(t, err)
+
+	clientA, ok := store.GetClient("clientA")
+	require.True(t, ok)
+
+	assert.True(t, clientA.AcquireConnection())
+	assert.True(t, clientA.AcquireConnection())
+	assert.False(t, clientA.AcquireConnection(), "Third connection should be rejected")
+	assert.Equal(t, 2, clientA.GetConnections())
+
+	clientA.ReleaseConnection()
+	assert.True(t, clientA.AcquireConnection(), "Released slot should be reusable")
+
+	clientB, ok := store.GetClient("clientB")
+	require.True(t, ok)
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, clientB.AcquireConnection(), "No limit should mean unlimited connections")
+	}
+}
+
+func TestClientBandwidthThrottle(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{
+			ClientId:          "clientA",
+			RequestsPerSecond: 5,
+			Bandwidth:         loadbalancer.BandwidthConfig{UploadBytesPerSecond: 1024},
+		},
+	})
+	require.NoError(t, err)
+
+	clientA, ok := store.GetClient("clientA")
+	require.True(t, ok)
+
+	reader := strings.NewReader("payload")
+	assert.IsType(t, &ratelimit.ThrottledReader{}, clientA.ThrottleUpload(context.Background(), reader))
+	assert.Same(t, reader, clientA.ThrottleDownload(context.Background(), reader),
+		"Download without a limit should not be throttled")
+}
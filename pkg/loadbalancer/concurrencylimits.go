@@ -0,0 +1,184 @@
+package loadbalancer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+)
+
+// defaultConcurrencyStatsInterval is how often the concurrency limit stats are reported.
+const defaultConcurrencyStatsInterval = time.Minute
+
+// ConcurrencyLimitsStore holds the adaptive concurrency limiters of the target groups.
+type ConcurrencyLimitsStore struct {
+	limiters map[string]*targetGroupConcurrency
+	clock    clock.Clock
+}
+
+// targetGroupConcurrency is the concurrency limiter of a target group.
+type targetGroupConcurrency struct {
+	algorithm ratelimit.ConcurrencyAlgorithm
+	limiter   *ratelimit.ConcurrencyLimiter
+	mu        sync.Mutex
+	rejected  uint64
+}
+
+// ConcurrencyLimitStats are the stats of the concurrency limit of a target group.
+type ConcurrencyLimitStats struct {
+	Algorithm string
+	Limit     int
+	InFlight  int
+	// Rejected is the number of connections shed because the limit was reached.
+	Rejected uint64
+	// History is the last changes of the limit, oldest first.
+	History []ratelimit.LimitChange
+}
+
+// NewConcurrencyLimitsStore creates the concurrency limiters of the target groups that have a
+// concurrency limit configured. Their history is timestamped with clk, which defaults to the time
+// package if nil.
+func NewConcurrencyLimitsStore(targetGroups []TargetGroupConfig, clk clock.Clock) (*ConcurrencyLimitsStore, error) {
+	store := &ConcurrencyLimitsStore{
+		limiters: make(map[string]*targetGroupConcurrency),
+		clock:    clock.OrDefault(clk),
+	}
+
+	for _, tg := range targetGroups {
+		if tg.ConcurrencyLimit == nil {
+			continue
+		}
+
+		concurrency, err := newTargetGroupConcurrency(tg.ConcurrencyLimit, clk)
+		if err != nil {
+			return nil, ErrInvalidTargetGroupConfig(tg.Name, err)
+		}
+
+		store.limiters[tg.Name] = concurrency
+	}
+
+	return store, nil
+}
+
+func newTargetGroupConcurrency(config *ConcurrencyLimitConfig, clk clock.Clock) (*targetGroupConcurrency, error) {
+	algorithm, err := ratelimit.ParseConcurrencyAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := ratelimit.NewConcurrencyLimiter(algorithm, ratelimit.ConcurrencyParams{
+		InitialLimit:     config.InitialLimit,
+		MinLimit:         config.MinLimit,
+		MaxLimit:         config.MaxLimit,
+		BackoffRatio:     config.BackoffRatio,
+		LatencyThreshold: config.LatencyThreshold,
+		Tolerance:        config.Tolerance,
+		Clock:            clk,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &targetGroupConcurrency{algorithm: algorithm, limiter: limiter}, nil
+}
+
+// Acquire takes one of the target group's connection slots. It fails if the limit is reached, in
+// which case the connection should be shed. A taken slot must be given back with Release.
+func (c *ConcurrencyLimitsStore) Acquire(targetGroup string) error {
+	concurrency, ok := c.limiters[targetGroup]
+	if !ok {
+		return nil
+	}
+
+	if concurrency.limiter.TryAcquire() {
+		return nil
+	}
+
+	concurrency.mu.Lock()
+	concurrency.rejected++
+	concurrency.mu.Unlock()
+
+	return ErrConcurrencyLimitReached(targetGroup, concurrency.limiter.Limit())
+}
+
+// Observe adapts the target group's limit to the latency of an upstream connect, or to its
+// failure.
+func (c *ConcurrencyLimitsStore) Observe(targetGroup string, latency time.Duration, failed bool) {
+	if concurrency, ok := c.limiters[targetGroup]; ok {
+		concurrency.limiter.Observe(latency, failed)
+	}
+}
+
+// Release gives back a slot taken by Acquire.
+func (c *ConcurrencyLimitsStore) Release(targetGroup string) {
+	if concurrency, ok := c.limiters[targetGroup]; ok {
+		concurrency.limiter.Release()
+	}
+}
+
+// GetStats returns the concurrency limit stats of each target group that has one.
+func (c *ConcurrencyLimitsStore) GetStats() map[string]ConcurrencyLimitStats {
+	stats := make(map[string]ConcurrencyLimitStats, len(c.limiters))
+
+	for targetGroup, concurrency := range c.limiters {
+		concurrency.mu.Lock()
+		rejected := concurrency.rejected
+		concurrency.mu.Unlock()
+
+		stats[targetGroup] = ConcurrencyLimitStats{
+			Algorithm: string(concurrency.algorithm),
+			Limit:     concurrency.limiter.Limit(),
+			InFlight:  concurrency.limiter.InFlight(),
+			Rejected:  rejected,
+			History:   concurrency.limiter.History(),
+		}
+	}
+
+	return stats
+}
+
+// Run reports the stats of each target group with a concurrency limit every interval, 1m by
+// default, until ctx is done. The History of the reported stats only holds the limit changes since
+// the previous report.
+func (c *ConcurrencyLimitsStore) Run(
+	ctx context.Context,
+	interval time.Duration,
+	report func(targetGroup string, stats ConcurrencyLimitStats),
+) {
+	if len(c.limiters) == 0 {
+		return
+	}
+
+	if interval <= 0 {
+		interval = defaultConcurrencyStatsInterval
+	}
+
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	// lastChange is the time of the last limit change reported for each target group.
+	lastChange := make(map[string]time.Time, len(c.limiters))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			for targetGroup, stats := range c.GetStats() {
+				var changes []ratelimit.LimitChange
+
+				for _, change := range stats.History {
+					if change.Time.After(lastChange[targetGroup]) {
+						changes = append(changes, change)
+						lastChange[targetGroup] = change.Time
+					}
+				}
+
+				stats.History = changes
+				report(targetGroup, stats)
+			}
+		}
+	}
+}
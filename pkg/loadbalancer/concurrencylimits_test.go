@@ -0,0 +1,94 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimitsStore(t *testing.T) {
+	store, err := loadbalancer.NewConcurrencyLimitsStore([]loadbalancer.TargetGroupConfig{
+		{Name: "group1", ConcurrencyLimit: &loadbalancer.ConcurrencyLimitConfig{InitialLimit: 2}},
+		{Name: "group2"},
+	}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Acquire("group1"))
+	require.NoError(t, store.Acquire("group1"))
+	assert.Error(t, store.Acquire("group1"), "Connections over the limit should be shed")
+
+	// Target groups without a concurrency limit are not limited.
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, store.Acquire("group2"))
+	}
+
+	// Failed connects back the limit off.
+	store.Observe("group1", 10*time.Millisecond, true)
+	store.Release("group1")
+	store.Release("group1")
+
+	stats := store.GetStats()
+	require.Contains(t, stats, "group1")
+	assert.NotContains(t, stats, "group2")
+	assert.Equal(t, "aimd", stats["group1"].Algorithm)
+	assert.Equal(t, 1, stats["group1"].Limit)
+	assert.Equal(t, 0, stats["group1"].InFlight)
+	assert.Equal(t, uint64(1), stats["group1"].Rejected)
+	require.Len(t, stats["group1"].History, 2)
+	assert.Equal(t, 2, stats["group1"].History[0].Limit)
+	assert.Equal(t, 1, stats["group1"].History[1].Limit)
+}
+
+func TestConcurrencyLimitsStoreRun(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+
+	store, err := loadbalancer.NewConcurrencyLimitsStore([]loadbalancer.TargetGroupConfig{
+		{Name: "group1", ConcurrencyLimit: &loadbalancer.ConcurrencyLimitConfig{InitialLimit: 2}},
+	}, fakeClock)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reports := make(chan loadbalancer.ConcurrencyLimitStats)
+
+	go store.Run(ctx, time.Minute, func(targetGroup string, stats loadbalancer.ConcurrencyLimitStats) {
+		assert.Equal(t, "group1", targetGroup)
+		reports <- stats
+	})
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(time.Minute)
+
+	stats := <-reports
+	assert.Equal(t, 2, stats.Limit)
+	require.Len(t, stats.History, 1)
+
+	require.NoError(t, store.Acquire("group1"))
+	store.Observe("group1", 10*time.Millisecond, true)
+	store.Release("group1")
+
+	// Only the limit changes since the previous report are reported.
+	fakeClock.Advance(time.Minute)
+
+	stats = <-reports
+	assert.Equal(t, 1, stats.Limit)
+	require.Len(t, stats.History, 1)
+	assert.Equal(t, 1, stats.History[0].Limit)
+
+	fakeClock.Advance(time.Minute)
+	assert.Empty(t, (<-reports).History)
+}
+
+func TestConcurrencyLimitsStoreUnknownAlgorithm(t *testing.T) {
+	_, err := loadbalancer.NewConcurrencyLimitsStore([]loadbalancer.TargetGroupConfig{
+		{Name: "group1", ConcurrencyLimit: &loadbalancer.ConcurrencyLimitConfig{Algorithm: "vegas"}},
+	}, nil)
+	assert.ErrorIs(t, err, ratelimit.ErrUnknownAlgorithm)
+}
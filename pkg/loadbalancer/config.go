@@ -2,19 +2,50 @@ package loadbalancer
 
 import (
 	"io"
+	"time"
 
+	"github.com/ari23/loadbalancer/lib/clock"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 // LoadBalancerConfig is the configuration for the load balancer.
 type LoadBalancerConfig struct {
-	ListenAddress string              `yaml:"listenAddress"`
-	TLSParams     TLSConfigParams     `yaml:"tlsParams"`
-	LogLevel      string              `yaml:"logLevel"`
-	TargetGroups  []TargetGroupConfig `yaml:"targetGroups"`
-	Clients       []ClientConfig      `yaml:"clients"`
-	Logger        *logrus.Logger
+	ListenAddress string          `yaml:"listenAddress"`
+	TLSParams     TLSConfigParams `yaml:"tlsParams"`
+	Dialer        DialerConfig    `yaml:"dialer"`
+	// RateLimit is the connection rate limit of the whole listener. Optional.
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+	// SourceRateLimit is the connection rate limit per source IP, checked before the TLS
+	// handshake. Optional.
+	SourceRateLimit *SourceRateLimitConfig `yaml:"sourceRateLimit"`
+	// SharedRateLimit shares the client rate limits with other load balancer instances, so that
+	// together they enforce each client's requestsPerSecond once. Optional.
+	SharedRateLimit *SharedRateLimitConfig `yaml:"sharedRateLimit"`
+	// Quotas configures where long horizon client quota usage is persisted.
+	Quotas       QuotasConfig        `yaml:"quotas"`
+	LogLevel     string              `yaml:"logLevel"`
+	TargetGroups []TargetGroupConfig `yaml:"targetGroups"`
+	Clients      []ClientConfig      `yaml:"clients"`
+	// ClientIdentityPrecedence is the order in which the identity types of a client certificate
+	// are matched against the clients, e.g. ["uri", "dns", "email", "cn"], which is the default.
+	// Identities of the same type are matched in the order they appear in the certificate, the
+	// first match wins. Identity types left out are not matched.
+	ClientIdentityPrecedence []string `yaml:"clientIdentityPrecedence"`
+	// Policies are ordered authorization rules. When set, they decide which target groups a
+	// connection may access instead of the clients' allowedTargetGroups, and certificates that
+	// match no client are let through to them, with no per-client limits. Optional.
+	Policies []PolicyRuleConfig `yaml:"policies"`
+	// ExternalAuthz asks an external service whether each connection is allowed, instead of the
+	// policies and the clients' allowedTargetGroups. Optional.
+	ExternalAuthz *ExternalAuthzConfig `yaml:"externalAuthz"`
+	// Passthrough is a second listener that does not terminate TLS, for the target groups whose
+	// upstream servers authenticate the clients themselves. Optional.
+	Passthrough *PassthroughConfig `yaml:"passthrough"`
+	Logger      *logrus.Logger
+	// Clock is the clock of the rate limiters, quotas and health checks. Defaults to the time
+	// package.
+	Clock clock.Clock `yaml:"-"`
 }
 
 // TLSConfigParams is the configuration for the TLS.
@@ -25,6 +56,55 @@ type TLSConfigParams struct {
 	PrivateKey string `yaml:"privateKey"`
 	// Root CA's certificate. Needed for self-signed certificate support.
 	CACertificate string `yaml:"caCert"`
+	// ReloadInterval is how often the files above are checked for changes. Changed files are
+	// loaded for new handshakes without restarting. Defaults to 10s, a negative value disables
+	// the checks. The files are also reloaded on SIGHUP.
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+	// Revocation checks client certificates against CRLs and OCSP responders. Optional.
+	Revocation *RevocationConfig `yaml:"revocation"`
+}
+
+// RevocationConfig is the configuration for the revocation checking of client certificates. A
+// certificate is checked against the CRLs first, and against its OCSP responder if no CRL covers
+// it.
+type RevocationConfig struct {
+	// CRLFiles are CRL files, PEM or DER encoded, issued by the CAs of the clients.
+	CRLFiles []string `yaml:"crlFiles"`
+	// CRLReloadInterval is how often CRLFiles are reloaded. Defaults to 1m, a negative value
+	// disables reloads. CRLs are also reloaded on SIGHUP.
+	CRLReloadInterval time.Duration `yaml:"crlReloadInterval"`
+	// OCSP enables checking client certificates with their OCSP responder.
+	OCSP bool `yaml:"ocsp"`
+	// OCSPResponder overrides the responder URL named in the certificates. Optional.
+	OCSPResponder string `yaml:"ocspResponder"`
+	// OCSPTimeout bounds every OCSP request. Defaults to 2s. The handshake of a certificate without
+	// a cached response waits for its OCSP request.
+	OCSPTimeout time.Duration `yaml:"ocspTimeout"`
+	// OCSPCacheTTL is how long OCSP responses are cached, at most until their next update.
+	// Defaults to 1h.
+	OCSPCacheTTL time.Duration `yaml:"ocspCacheTTL"`
+	// Mode is what happens to certificates whose revocation status cannot be determined:
+	// "softFail" (default) accepts them, "hardFail" rejects them. Revoked certificates are always
+	// rejected. The mode applies to every client certificate, it cannot be set per listener.
+	Mode string `yaml:"mode"`
+}
+
+// DialerConfig is the configuration for the connections opened towards upstream servers.
+type DialerConfig struct {
+	// SourceAddresses is an optional pool of local IPs to bind upstream connections to. When more
+	// than one address is given they are used in round-robin order, which spreads the ephemeral
+	// ports used towards a single upstream across several source IPs.
+	SourceAddresses []string `yaml:"sourceAddresses"`
+	// KeepAlive is the TCP keepalive period. Zero uses the Go default and a negative value disables
+	// keepalives.
+	KeepAlive time.Duration `yaml:"keepAlive"`
+	// NoDelay sets TCP_NODELAY on upstream connections. Defaults to true when unset.
+	NoDelay *bool `yaml:"noDelay"`
+	// ReadBufferSize and WriteBufferSize set SO_RCVBUF and SO_SNDBUF. Zero keeps the OS default.
+	ReadBufferSize  int `yaml:"readBufferSize"`
+	WriteBufferSize int `yaml:"writeBufferSize"`
+	// UserTimeout sets TCP_USER_TIMEOUT (Linux only). Zero keeps the OS default.
+	UserTimeout time.Duration `yaml:"userTimeout"`
 }
 
 // TargetGroupConfig is the configuration for the target group.
@@ -33,16 +113,305 @@ type TLSConfigParams struct {
 type TargetGroupConfig struct {
 	Name            string   `yaml:"name"`
 	UpstreamServers []string `yaml:"upstreamServers"`
+	// ServerNames are the TLS server names (SNI) that route connections to the target group,
+	// e.g. "db.lb.internal". Optional.
+	ServerNames []string `yaml:"serverNames"`
+	// RateLimit is the combined connection rate limit of all clients of the target group.
+	// Optional.
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+	// ConcurrencyLimit adapts the number of connections in flight towards the target group to
+	// the upstream connect latency and failures. Optional.
+	ConcurrencyLimit *ConcurrencyLimitConfig `yaml:"concurrencyLimit"`
+	// UpstreamTLS re-encrypts the connections towards the upstream servers with TLS. Without it
+	// they are plain TCP. Optional.
+	UpstreamTLS *UpstreamTLSConfig `yaml:"upstreamTLS"`
+	// Passthrough makes the target group only reachable through the passthrough listener, by one
+	// of its ServerNames. Its upstream servers terminate the clients' TLS connections.
+	Passthrough bool `yaml:"passthrough"`
+}
+
+// PassthroughConfig is the configuration for the passthrough listener. It reads the server name
+// (SNI) of the TLS ClientHello of each connection, routes the connection to the passthrough
+// target group mapped to it, and relays the raw bytes, leaving the TLS handshake and the client
+// authentication to the upstream server. No client certificate is visible to the load balancer,
+// so connections are only authorized by the policy rules without client conditions, and are not
+// subject to per-client limits. They all share the global and target group limits, and the only
+// limit per peer is SourceRateLimit.
+type PassthroughConfig struct {
+	ListenAddress string `yaml:"listenAddress"`
+	// ClientHelloTimeout bounds the wait for the ClientHello of a new connection. Defaults to 5s.
+	ClientHelloTimeout time.Duration `yaml:"clientHelloTimeout"`
+}
+
+// UpstreamTLSConfig is the configuration for the TLS connections towards the upstream servers of
+// a target group. Health checks complete the TLS handshake too, unless PlainHealthChecks is set.
+type UpstreamTLSConfig struct {
+	// CACertificate is the CA bundle the upstream certificates are verified with. Defaults to the
+	// system roots.
+	CACertificate string `yaml:"caCert"`
+	// Certificate and PrivateKey are the client certificate presented to the upstream servers,
+	// for mTLS. Optional.
+	Certificate string `yaml:"certificate"`
+	PrivateKey  string `yaml:"privateKey"`
+	// ServerName is the server name sent to, and verified against, the upstream servers. Defaults
+	// to the host of each upstream server address.
+	ServerName string `yaml:"serverName"`
+	// ALPN are the application protocols offered to the upstream servers, e.g. ["h2"]. Optional.
+	ALPN []string `yaml:"alpn"`
+	// MinVersion is the minimum TLS version, "1.2" (default) or "1.3".
+	MinVersion string `yaml:"minVersion"`
+	// InsecureSkipVerify accepts any upstream certificate. Only meant for labs.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	// PlainHealthChecks makes the health checks only open TCP connections, without the TLS
+	// handshake.
+	PlainHealthChecks bool `yaml:"plainHealthChecks"`
+}
+
+// ConcurrencyLimitConfig is the configuration for an adaptive concurrency limit. New connections
+// are shed while the limit is reached.
+type ConcurrencyLimitConfig struct {
+	// Algorithm is "aimd" (default) or "gradient".
+	Algorithm string `yaml:"algorithm"`
+	// InitialLimit is the limit on startup. Defaults to 20.
+	InitialLimit int `yaml:"initialLimit"`
+	// MinLimit and MaxLimit bound the limit. Default to 1 and 1000.
+	MinLimit int `yaml:"minLimit"`
+	MaxLimit int `yaml:"maxLimit"`
+	// BackoffRatio is what "aimd" multiplies the limit by when a connect fails or is slower than
+	// LatencyThreshold. Defaults to 0.9.
+	BackoffRatio     float64       `yaml:"backoffRatio"`
+	LatencyThreshold time.Duration `yaml:"latencyThreshold"`
+	// Tolerance is how many times its usual connect latency "gradient" tolerates before shrinking
+	// the limit. Defaults to 2.
+	Tolerance float64 `yaml:"tolerance"`
+}
+
+// RateLimitConfig is the configuration for a connection rate limit shared by several clients.
+type RateLimitConfig struct {
+	// Algorithm is the rate limiting algorithm, see ClientConfig.RateLimitAlgorithm.
+	Algorithm         string `yaml:"algorithm"`
+	RequestsPerSecond int    `yaml:"requestsPerSecond"`
+	// Burst is the token bucket size. Defaults to RequestsPerSecond.
+	Burst int `yaml:"burst"`
+	// Rejection is what happens to connections rejected by this rate limit. Defaults to the
+	// rejected client's own rejection config.
+	Rejection *RejectionConfig `yaml:"rejection"`
+	// DryRun only records the connections this rate limit would reject, without rejecting them.
+	DryRun bool `yaml:"dryRun"`
+}
+
+// SourceRateLimitConfig is the configuration for the connection rate limit per source IP. It is
+// enforced as soon as a connection is accepted, so that floods of handshakes from unauthenticated
+// sources are cheap to reject.
+type SourceRateLimitConfig struct {
+	// Algorithm is the rate limiting algorithm, see ClientConfig.RateLimitAlgorithm.
+	Algorithm         string `yaml:"algorithm"`
+	RequestsPerSecond int    `yaml:"requestsPerSecond"`
+	// Burst is the token bucket size. Defaults to RequestsPerSecond.
+	Burst int `yaml:"burst"`
+	// IPv4PrefixLength and IPv6PrefixLength group source IPs in CIDRs that share a limit.
+	// Default to 32 and 64.
+	IPv4PrefixLength int `yaml:"ipv4PrefixLength"`
+	IPv6PrefixLength int `yaml:"ipv6PrefixLength"`
+	// AllowList is a list of CIDRs that bypass the limit, e.g. health checkers or NAT gateways.
+	AllowList []string `yaml:"allowList"`
+	// MaxSources bounds the number of sources whose state is kept. When exceeded, the least
+	// recently seen source is forgotten. Defaults to 100000.
+	MaxSources int `yaml:"maxSources"`
+}
+
+// SharedRateLimitConfig is the configuration for the backend holding rate limiting state shared by
+// several load balancer instances.
+type SharedRateLimitConfig struct {
+	// Backend is the shared state backend. Only "redis" is supported.
+	Backend string      `yaml:"backend"`
+	Redis   RedisConfig `yaml:"redis"`
+	// Timeout bounds every call to the backend. Defaults to 50ms.
+	Timeout time.Duration `yaml:"timeout"`
+	// RetryInterval is how long an instance limits clients on its own after the backend failed,
+	// before trying it again. Defaults to 1s.
+	RetryInterval time.Duration `yaml:"retryInterval"`
+}
+
+// RedisConfig is the configuration for a Redis connection.
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// KeyPrefix is prepended to all keys. Defaults to "loadbalancer:ratelimit:".
+	KeyPrefix string `yaml:"keyPrefix"`
+}
+
+// RejectionConfig is the configuration for what the load balancer does with connections that are
+// rejected by a rate limit.
+type RejectionConfig struct {
+	// Action is "close" (default) to close the connection gracefully, "reset" to abort it with a
+	// TCP RST, or "tarpit" to hold it open for TarpitDelay before closing it.
+	Action string `yaml:"action"`
+	// Payload is written to the client before closing the connection, so that clients can tell a
+	// rate limit rejection apart from other failures. "{retryAfter}" is replaced with the number of
+	// seconds after which the client can expect to be allowed again, or with nothing if it never
+	// will. Not used by "reset".
+	Payload string `yaml:"payload"`
+	// TarpitDelay is how long "tarpit" holds the connection open. Defaults to 5s. Connections are
+	// closed right away while MaxTarpittedConnections are already held.
+	TarpitDelay time.Duration `yaml:"tarpitDelay"`
 }
 
 // ClientConfig is the configuration for the client access.
 type ClientConfig struct {
-	// ClientId is the unique identifier for the client. This should match the CN in the client's
-	// certificate.
+	// ClientId is the unique identifier for the client. This should match the identity of type
+	// IdentityType in the client's certificate. It may also be a pattern matching several
+	// identities: a regular expression if it starts with "^", or a glob if it contains any of
+	// "*?[".
 	ClientId string `yaml:"clientId"`
-	// AllowedTargetGroup is the target group that the client is allowed to access.
+	// IdentityType is the certificate field ClientId is matched on: "cn" (default) for the
+	// Subject CommonName, or "dns", "uri" or "email" for a SAN of that type. SPIFFE IDs are URI
+	// SANs, e.g. "spiffe://corp/ns/x/sa/y".
+	IdentityType string `yaml:"identityType"`
+	// AllowedTargetGroups are the target groups that the client is allowed to access. Each
+	// connection goes to the target group its TLS server name (SNI) is mapped to, see
+	// TargetGroupConfig.ServerNames. Connections whose server name is not mapped go to the
+	// client's target group if it is allowed exactly one, and are rejected otherwise.
+	AllowedTargetGroups []string `yaml:"allowedTargetGroups"`
+	// AllowedTargetGroup is a single allowed target group.
+	//
+	// Deprecated: use AllowedTargetGroups. It is added to AllowedTargetGroups if set.
 	AllowedTargetGroup string `yaml:"allowedTargetGroup"`
-	RequestsPerSecond  int    `yaml:"requestsPerSecond"`
+	// Pins are SHA-256 fingerprints the client's certificate is checked against after chain
+	// verification, in the form "cert:<fingerprint>" for the whole certificate or
+	// "spki:<fingerprint>" for its public key, in hex or base64. The certificate must match one of
+	// them, so listing two pins lets a client rotate its certificate. No pins means any certificate
+	// issued by the CA with the client's identity is accepted.
+	Pins              []string `yaml:"pins"`
+	RequestsPerSecond int      `yaml:"requestsPerSecond"`
+	// RateLimitAlgorithm selects the rate limiting algorithm for the client: "fixedWindow"
+	// (default), "tokenBucket", "slidingWindowLog", "slidingWindowCounter" or "leakyBucket".
+	RateLimitAlgorithm string `yaml:"rateLimitAlgorithm"`
+	// RateLimitMode is what happens to connections over the client's rate limit: "drop" (default)
+	// closes them, "shape" queues them and releases them at the configured rate.
+	RateLimitMode string `yaml:"rateLimitMode"`
+	// RateLimitDryRun only records the connections the client's rate limit would reject, without
+	// rejecting them. Shaping is not applied in dry run.
+	RateLimitDryRun bool `yaml:"rateLimitDryRun"`
+	// MaxQueueDelay is how long a connection may be queued in "shape" mode before it is dropped.
+	// Defaults to 1s.
+	MaxQueueDelay time.Duration `yaml:"maxQueueDelay"`
+	// MaxConnections is the maximum number of concurrent connections the client may have open
+	// through the load balancer. 0 means unlimited.
+	MaxConnections int `yaml:"maxConnections"`
+	// RateLimitRejection is what happens to the client's connections rejected by a rate limit.
+	RateLimitRejection *RejectionConfig `yaml:"rateLimitRejection"`
+	// Burst is the token bucket size, i.e. the number of requests the client may send at once, or
+	// the leaky bucket queue size. Defaults to RequestsPerSecond.
+	Burst int `yaml:"burst"`
+	// Bandwidth limits the throughput of the client's proxied streams.
+	Bandwidth BandwidthConfig `yaml:"bandwidth"`
+	// Quotas are long horizon limits, e.g. connections per day or bytes per month.
+	Quotas []QuotaConfig `yaml:"quotas"`
+}
+
+// ExternalAuthzConfig is the configuration for the external authorization service. The service is
+// posted a JSON description of each connection, with the client's certificate details, source
+// address and TLS server name, and answers with a JSON decision:
+//
+//	{"allow": true, "targetGroup": "DBService", "rateLimit": {"requestsPerSecond": 10}, "reason": "..."}
+//
+// An allowed connection goes to targetGroup if set, and to the target group its server name is
+// mapped to otherwise. Without a mapped server name, it goes where the policies or the client's
+// allowedTargetGroups would send it. rateLimit, if set, replaces the client's requestsPerSecond,
+// burst and rateLimitAlgorithm, and is enforced by each instance on its own.
+type ExternalAuthzConfig struct {
+	// URL is the HTTP endpoint of the service, e.g. "http://127.0.0.1:9001/authorize".
+	URL string `yaml:"url"`
+	// UnixSocket is the path of a Unix socket the service listens on with HTTP. URL then defaults
+	// to "http://localhost/authorize", and only its path matters.
+	UnixSocket string `yaml:"unixSocket"`
+	// Timeout bounds every request to the service. Defaults to 1s.
+	Timeout time.Duration `yaml:"timeout"`
+	// CacheTTL is how long decisions are cached, per client certificate, source IP and server
+	// name. Defaults to 30s, a negative value disables the cache.
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	// FailureMode is what happens when the service cannot be reached or answers with an error:
+	// "closed" (default) rejects the connection, "open" falls back to the policies or the
+	// clients' allowedTargetGroups.
+	FailureMode string `yaml:"failureMode"`
+}
+
+// PolicyRuleConfig is an authorization rule. A rule matches a connection if all of its conditions
+// match, and a condition matches if any of its values does. Conditions left empty match any
+// connection. Name patterns are globs, see path.Match.
+type PolicyRuleConfig struct {
+	// Name identifies the rule in logs. Defaults to its position, e.g. "#1".
+	Name string `yaml:"name"`
+	// Effect is "allow" or "deny".
+	Effect string `yaml:"effect"`
+	// TargetGroups are the target groups the rule decides on. Empty means all of them.
+	TargetGroups []string `yaml:"targetGroups"`
+	// ClientIDs match the ID of the client the certificate identifies as.
+	ClientIDs []string `yaml:"clientIds"`
+	// CommonNames, Organizations and OrganizationalUnits match the certificate's Subject.
+	CommonNames         []string `yaml:"commonNames"`
+	Organizations       []string `yaml:"organizations"`
+	OrganizationalUnits []string `yaml:"organizationalUnits"`
+	// SANs match the certificate's SANs, as "dns:<glob>", "uri:<glob>" or "email:<glob>".
+	SANs []string `yaml:"sans"`
+	// SourceCIDRs match the IP the connection comes from.
+	SourceCIDRs []string `yaml:"sourceCIDRs"`
+	// ServerNames match the TLS server name (SNI) the client asked for.
+	ServerNames []string `yaml:"serverNames"`
+	// TimeWindows match the time of the connection.
+	TimeWindows []TimeWindowConfig `yaml:"timeWindows"`
+}
+
+// TimeWindowConfig is a daily window of time, e.g. business hours.
+type TimeWindowConfig struct {
+	// Days are the days of the week the window applies to: "mon", "tue", "wed", "thu", "fri",
+	// "sat" or "sun". Empty means every day.
+	Days []string `yaml:"days"`
+	// Start and End are times of day, "15:04". The window includes Start and excludes End. An End
+	// before Start spans midnight, and Days are then the days the window starts on. "24:00" is the
+	// end of the day.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// TimeZone is the IANA time zone of the window, e.g. "Europe/Berlin". Defaults to UTC.
+	TimeZone string `yaml:"timeZone"`
+}
+
+// QuotasConfig is the configuration for the persistence of client quota usage.
+type QuotasConfig struct {
+	// StorePath is the file quota usage is persisted to. If empty, usage is only kept in memory
+	// and resets on restart.
+	StorePath string `yaml:"storePath"`
+	// FlushInterval is how often usage is written to StorePath. Defaults to 10s. Usage is also
+	// written on shutdown.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+}
+
+// QuotaConfig is the configuration for a long horizon client quota. New connections are rejected
+// once the quota is used up. Connections in flight are not cut.
+type QuotaConfig struct {
+	// Resource is what the quota counts: "connections" or "bytes" (in both directions).
+	Resource string `yaml:"resource"`
+	// Period is "hour", "day" or "month", aligned to the calendar in UTC.
+	Period string `yaml:"period"`
+	Limit  int64  `yaml:"limit"`
+}
+
+// BandwidthConfig is the configuration for per-client bandwidth throttling. Limits are shared by
+// all of the client's concurrent connections. A rate of 0 means unlimited.
+type BandwidthConfig struct {
+	// UploadBytesPerSecond limits the bytes sent from the client to the upstream.
+	UploadBytesPerSecond int `yaml:"uploadBytesPerSecond"`
+	// UploadBurst is the number of bytes that can be sent at once. Defaults to
+	// UploadBytesPerSecond.
+	UploadBurst int `yaml:"uploadBurst"`
+	// DownloadBytesPerSecond limits the bytes sent from the upstream to the client.
+	DownloadBytesPerSecond int `yaml:"downloadBytesPerSecond"`
+	// DownloadBurst is the number of bytes that can be received at once. Defaults to
+	// DownloadBytesPerSecond.
+	DownloadBurst int `yaml:"downloadBurst"`
 }
 
 // ParseConfig parses the load balancer configuration from the given file.
@@ -1,33 +1,113 @@
 package loadbalancer
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ari23/loadbalancer/lib/loadbalance"
 )
 
-// NetDialer uses the standard library's net.Dial function to dial network addresses.
+// NetDialer uses the standard library's net.Dialer to dial network addresses. Outgoing
+// connections can be bound to a pool of local source addresses and tuned with socket options.
 type NetDialer struct {
-	timeout    time.Duration
-	retryLimit int
+	timeout         time.Duration
+	retryLimit      int
+	sourceAddresses []*net.TCPAddr
+	nextSource      atomic.Uint64
+	keepAlive       time.Duration
+	noDelay         bool
+	readBufferSize  int
+	writeBufferSize int
+	control         func(network, address string, c syscall.RawConn) error
 }
 
-// NewNetDialer creates a new NetDialer.
-func NewNetDialer(timeout time.Duration, retryLimit int) loadbalance.NetDialerInterface {
-	return &NetDialer{
+// NewNetDialer creates a new NetDialer. dialerConfig may be nil, in which case the OS defaults
+// are used for every socket option.
+func NewNetDialer(
+	timeout time.Duration,
+	retryLimit int,
+	dialerConfig *DialerConfig,
+) (loadbalance.NetDialerInterface, error) {
+	dialer := &NetDialer{
 		timeout:    timeout,
 		retryLimit: retryLimit,
+		noDelay:    true,
 	}
+
+	if dialerConfig == nil {
+		return dialer, nil
+	}
+
+	for _, address := range dialerConfig.SourceAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, ErrInvalidSourceAddress(address)
+		}
+
+		dialer.sourceAddresses = append(dialer.sourceAddresses, &net.TCPAddr{IP: ip})
+	}
+
+	if dialerConfig.NoDelay != nil {
+		dialer.noDelay = *dialerConfig.NoDelay
+	}
+
+	dialer.keepAlive = dialerConfig.KeepAlive
+	dialer.readBufferSize = dialerConfig.ReadBufferSize
+	dialer.writeBufferSize = dialerConfig.WriteBufferSize
+
+	if dialerConfig.UserTimeout > 0 {
+		control, err := newUserTimeoutControl(dialerConfig.UserTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		dialer.control = control
+	}
+
+	return dialer, nil
 }
 
 // Dial makes a network connection to the specified address.
 func (d *NetDialer) Dial(network, address string) (net.Conn, error) {
-	return net.Dial(network, address)
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext makes a network connection to the specified address. The dial is aborted as soon
+// as ctx is done.
+func (d *NetDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		KeepAlive: d.keepAlive,
+		Control:   d.control,
+	}
+
+	if localAddr := d.nextSourceAddress(); localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := d.setSocketOptions(tcpConn); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+	}
+
+	return conn, nil
 }
 
 func (d *NetDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
-	return net.DialTimeout(network, address, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, address)
 }
 
 func (d *NetDialer) GetTimeout() time.Duration {
@@ -37,3 +117,35 @@ func (d *NetDialer) GetTimeout() time.Duration {
 func (d *NetDialer) GetRetryLimit() int {
 	return d.retryLimit
 }
+
+// nextSourceAddress returns the next local address from the pool in round-robin order, or nil
+// when no pool is configured.
+func (d *NetDialer) nextSourceAddress() *net.TCPAddr {
+	if len(d.sourceAddresses) == 0 {
+		return nil
+	}
+
+	next := d.nextSource.Add(1) - 1
+
+	return d.sourceAddresses[next%uint64(len(d.sourceAddresses))]
+}
+
+func (d *NetDialer) setSocketOptions(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(d.noDelay); err != nil {
+		return err
+	}
+
+	if d.readBufferSize > 0 {
+		if err := conn.SetReadBuffer(d.readBufferSize); err != nil {
+			return err
+		}
+	}
+
+	if d.writeBufferSize > 0 {
+		if err := conn.SetWriteBuffer(d.writeBufferSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package loadbalancer
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newUserTimeoutControl returns a dialer control function that sets TCP_USER_TIMEOUT on the
+// socket before it connects.
+func newUserTimeoutControl(timeout time.Duration) (func(network, address string, c syscall.RawConn) error, error) {
+	timeoutMillis := int(timeout.Milliseconds())
+
+	return func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, timeoutMillis)
+		}); err != nil {
+			return err
+		}
+
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package loadbalancer
+
+import (
+	"syscall"
+	"time"
+)
+
+// newUserTimeoutControl always fails since TCP_USER_TIMEOUT is only available on Linux.
+func newUserTimeoutControl(_ time.Duration) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, ErrTCPUserTimeoutUnsupported
+}
@@ -0,0 +1,58 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetDialerInvalidSourceAddress(t *testing.T) {
+	_, err := loadbalancer.NewNetDialer(time.Second, 1, &loadbalancer.DialerConfig{
+		SourceAddresses: []string{"not-an-ip"},
+	})
+
+	assert.Error(t, err, "Expected error for an invalid source address")
+}
+
+func TestNetDialerSourceAddressRoundRobin(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	dialer, err := loadbalancer.NewNetDialer(time.Second, 1, &loadbalancer.DialerConfig{
+		SourceAddresses: []string{"127.0.0.1", "127.0.0.2"},
+	})
+	require.NoError(t, err)
+
+	for _, expectedIP := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+		require.NoError(t, err)
+
+		serverConn, err := listener.Accept()
+		require.NoError(t, err)
+
+		remoteAddr, ok := serverConn.RemoteAddr().(*net.TCPAddr)
+		require.True(t, ok)
+		assert.Equal(t, expectedIP, remoteAddr.IP.String())
+
+		serverConn.Close()
+		conn.Close()
+	}
+}
+
+func TestNetDialerDialContextCancelled(t *testing.T) {
+	dialer, err := loadbalancer.NewNetDialer(time.Second, 1, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = dialer.DialContext(ctx, "tcp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.Canceled)
+}
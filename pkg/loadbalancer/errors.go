@@ -3,6 +3,7 @@ package loadbalancer
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 var (
@@ -10,6 +11,32 @@ var (
 
 	ErrNotTLSConnection = errors.New("not a TLS connection")
 
+	ErrNoCACertificates = errors.New("no CA certificates found")
+
+	ErrRevoked = errors.New("certificate revoked")
+
+	ErrRevocationUnknown = errors.New("revocation status unknown")
+
+	ErrNoRevocationSource = errors.New("revocation checking needs CRL files or OCSP")
+
+	ErrNoCRLs = errors.New("no CRLs found")
+
+	ErrNoOCSPResponder = errors.New("certificate names no OCSP responder")
+
+	ErrStaleOCSPResponse = errors.New("OCSP response is out of date")
+
+	ErrOCSPStatusUnknown = errors.New("OCSP responder does not know the certificate")
+
+	ErrCertificateNotPinned = errors.New("certificate matches none of the pins")
+
+	ErrDeniedByPolicy = errors.New("denied by policy")
+
+	ErrNoExternalAuthzEndpoint = errors.New("external authorization needs a URL or a Unix socket")
+
+	ErrDeniedByExternalAuthz = errors.New("denied by external authorization")
+
+	ErrPassthroughUpstreamTLS = errors.New("passthrough target groups cannot re-encrypt towards their upstream servers")
+
 	ErrClientNameNotFound = errors.New("client name not found")
 
 	ErrNoAuthorizedClients = errors.New("no authorized clients")
@@ -19,6 +46,12 @@ var (
 	ErrNilClientConfig = errors.New("nil client config")
 
 	ErrNilTargetGroupsStore = errors.New("nil target groups store")
+
+	ErrRateLimitExceeded = errors.New("rate limit exceeded")
+
+	ErrQuotaUsedUp = errors.New("quota used up")
+
+	ErrTCPUserTimeoutUnsupported = errors.New("TCP user timeout is not supported on this platform")
 )
 
 func ErrLoadingKeyPair(err error) error {
@@ -26,13 +59,53 @@ func ErrLoadingKeyPair(err error) error {
 }
 
 func ErrLoadingCACert(err error) error {
-	return fmt.Errorf("failed to load CA Cert: %v", err)
+	return fmt.Errorf("failed to load CA Cert: %w", err)
+}
+
+func ErrReloadingTLSMaterial(err error) error {
+	return fmt.Errorf("failed to reload TLS material, keeping the current one: %w", err)
+}
+
+func ErrLoadingCRL(path string, err error) error {
+	return fmt.Errorf("failed to load CRL %s: %w", path, err)
+}
+
+func ErrUnknownRevocationMode(mode string) error {
+	return fmt.Errorf("unknown revocation mode %s", mode)
+}
+
+func ErrOCSPResponder(status string) error {
+	return fmt.Errorf("OCSP responder returned %s", status)
+}
+
+func ErrCertificateRevoked(serial, source string) error {
+	return fmt.Errorf("%w: certificate %s, according to %s", ErrRevoked, serial, source)
+}
+
+func ErrRevocationStatusUnknown(serial string, err error) error {
+	if err == nil {
+		return fmt.Errorf("%w: certificate %s", ErrRevocationUnknown, serial)
+	}
+
+	return fmt.Errorf("%w: certificate %s: %v", ErrRevocationUnknown, serial, err)
 }
 
 func ErrTLSHandshakeFailed(err error) error {
 	return fmt.Errorf("TLS handshake failed: %v", err)
 }
 
+func ErrReadingClientHello(err error) error {
+	return fmt.Errorf("failed to read TLS ClientHello: %v", err)
+}
+
+func ErrUpstreamTLSHandshakeFailed(address string, err error) error {
+	return fmt.Errorf("TLS handshake with upstream server %s failed: %w", address, err)
+}
+
+func ErrUnknownTLSVersion(version string) error {
+	return fmt.Errorf("unknown TLS version %s, expected 1.2 or 1.3", version)
+}
+
 func ErrClientNotAuthorized(clientName string) error {
 	return fmt.Errorf("client %s is not authorized", clientName)
 }
@@ -40,3 +113,167 @@ func ErrClientNotAuthorized(clientName string) error {
 func ErrTargetGroupNotFound(targetGroupName string) error {
 	return fmt.Errorf("target group %s not found", targetGroupName)
 }
+
+func ErrTargetGroupNotAllowed(clientName, targetGroupName string) error {
+	return fmt.Errorf("client %s is not authorized for target group %s", clientName, targetGroupName)
+}
+
+func ErrNoTargetGroupForServerName(clientName, serverName string) error {
+	return fmt.Errorf("no target group of client %s is mapped to server name %q", clientName, serverName)
+}
+
+func ErrNoPassthroughTargetGroup(serverName string) error {
+	return fmt.Errorf("no passthrough target group is mapped to server name %q", serverName)
+}
+
+func ErrPassthroughTargetGroup(clientName, targetGroupName string) error {
+	return fmt.Errorf("client %s cannot access target group %s, which only accepts passthrough connections",
+		clientName, targetGroupName)
+}
+
+func ErrDuplicateServerName(serverName, targetGroupName string) error {
+	return fmt.Errorf("server name %s already routes to target group %s", serverName, targetGroupName)
+}
+
+func ErrInvalidSourceAddress(address string) error {
+	return fmt.Errorf("invalid source address %s", address)
+}
+
+func ErrInvalidClientConfig(clientName string, err error) error {
+	return fmt.Errorf("invalid config for client %s: %w", clientName, err)
+}
+
+func ErrUnknownIdentityType(identityType string) error {
+	return fmt.Errorf("unknown identity type %s", identityType)
+}
+
+func ErrDuplicateIdentityType(identityType string) error {
+	return fmt.Errorf("identity type %s is listed more than once", identityType)
+}
+
+func ErrInvalidClientIDPattern(pattern string, err error) error {
+	return fmt.Errorf("invalid client ID pattern %s: %w", pattern, err)
+}
+
+func ErrInvalidCertificatePin(pin string) error {
+	return fmt.Errorf("invalid certificate pin %s, expected cert:<sha256> or spki:<sha256>", pin)
+}
+
+func ErrCertificatePinMismatch(clientName string) error {
+	return fmt.Errorf("%w: client %s", ErrCertificateNotPinned, clientName)
+}
+
+func ErrDuplicateClientID(clientName string) error {
+	return fmt.Errorf("client %s is configured more than once", clientName)
+}
+
+func ErrMaxConnectionsReached(clientName string) error {
+	return fmt.Errorf("client %s reached its maximum number of connections", clientName)
+}
+
+func ErrInvalidTargetGroupConfig(targetGroupName string, err error) error {
+	return fmt.Errorf("invalid config for target group %s: %w", targetGroupName, err)
+}
+
+func ErrUnknownRejectAction(action string) error {
+	return fmt.Errorf("unknown reject action %s", action)
+}
+
+func ErrInvalidPolicyRule(ruleName string, err error) error {
+	return fmt.Errorf("invalid policy rule %s: %w", ruleName, err)
+}
+
+func ErrUnknownPolicyEffect(effect string) error {
+	return fmt.Errorf("unknown policy effect %q, expected allow or deny", effect)
+}
+
+func ErrInvalidPolicySAN(san string) error {
+	return fmt.Errorf("invalid SAN %s, expected dns:, uri: or email: followed by a glob", san)
+}
+
+func ErrInvalidTimeWindow(err error) error {
+	return fmt.Errorf("invalid time window: %w", err)
+}
+
+func ErrUnknownWeekday(day string) error {
+	return fmt.Errorf("unknown day %s, expected one of mon, tue, wed, thu, fri, sat, sun", day)
+}
+
+func ErrInvalidGlob(pattern string, err error) error {
+	return fmt.Errorf("invalid glob %s: %w", pattern, err)
+}
+
+func ErrPolicyDenied(clientName, targetGroupName, ruleName string) error {
+	if ruleName == "" {
+		return fmt.Errorf("%w: client %s for target group %s, no rule matched", ErrDeniedByPolicy, clientName,
+			targetGroupName)
+	}
+
+	return fmt.Errorf("%w: client %s for target group %s, by rule %s", ErrDeniedByPolicy, clientName,
+		targetGroupName, ruleName)
+}
+
+func ErrUnknownExternalAuthzFailureMode(mode string) error {
+	return fmt.Errorf("unknown external authorization failure mode %q, expected open or closed", mode)
+}
+
+func ErrExternalAuthz(err error) error {
+	return fmt.Errorf("external authorization failed: %w", err)
+}
+
+func ErrExternalAuthzStatus(status string) error {
+	return fmt.Errorf("external authorization service returned %s", status)
+}
+
+func ErrExternalAuthzDenied(clientName, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("%w: client %s", ErrDeniedByExternalAuthz, clientName)
+	}
+
+	return fmt.Errorf("%w: client %s: %s", ErrDeniedByExternalAuthz, clientName, reason)
+}
+
+func ErrInvalidCIDR(cidr string, err error) error {
+	return fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+}
+
+func ErrUnknownQuotaResource(resource string) error {
+	return fmt.Errorf("unknown quota resource %s", resource)
+}
+
+func ErrQuotaExceeded(clientName, resource, period string) error {
+	return fmt.Errorf("%w: client %s, %s per %s", ErrQuotaUsedUp, clientName, resource, period)
+}
+
+func ErrConcurrencyLimitReached(targetGroupName string, limit int) error {
+	return fmt.Errorf("target group %s reached its concurrency limit of %d", targetGroupName, limit)
+}
+
+func ErrUnknownSharedRateLimitBackend(backend string) error {
+	return fmt.Errorf("unknown shared rate limit backend %s", backend)
+}
+
+// RateLimitError is returned when a connection is rejected by a rate limit. It matches
+// ErrRateLimitExceeded.
+type RateLimitError struct {
+	// Level is the rate limit level that rejected the connection.
+	Level string
+	// Key is the key of the rejected connection at that level, e.g. the client or target group.
+	Key string
+	// RetryAfter is how long until the level expects to allow a connection again.
+	RetryAfter time.Duration
+	// Action is what to do with the rejected connection.
+	Action *RejectAction
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s at %s level for %s", ErrRateLimitExceeded, e.Level, e.Key)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimitExceeded
+}
+
+func ErrUnknownRateLimitMode(mode string) error {
+	return fmt.Errorf("unknown rate limit mode %s", mode)
+}
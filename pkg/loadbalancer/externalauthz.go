@@ -0,0 +1,338 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+)
+
+const (
+	// ExternalAuthzFailClosed rejects connections when the external authorization service cannot
+	// be reached or answers with an error.
+	ExternalAuthzFailClosed = "closed"
+	// ExternalAuthzFailOpen falls back to the load balancer's own authorization, i.e. the
+	// policies or the clients' allowed target groups, when the external authorization service
+	// cannot be reached or answers with an error.
+	ExternalAuthzFailOpen = "open"
+
+	defaultExternalAuthzTimeout   = time.Second
+	defaultExternalAuthzCacheTTL  = 30 * time.Second
+	defaultExternalAuthzSocketURL = "http://localhost/authorize"
+	// maxExternalAuthzCacheSize bounds the decisions cached before the expired ones are dropped.
+	maxExternalAuthzCacheSize = 10000
+	// maxExternalAuthzResponseSize bounds the responses read from the service.
+	maxExternalAuthzResponseSize = 1 << 20
+)
+
+// ExternalAuthzDecision is the decision of the external authorization service on a connection.
+type ExternalAuthzDecision struct {
+	Allowed bool
+	// TargetGroup, if set, is where the connection goes, regardless of its TLS server name.
+	TargetGroup string
+	// RateLimit, if set, replaces the client's own rate limit for the connection.
+	RateLimit *RateLimitOverride
+	// Reason explains the decision in logs.
+	Reason string
+}
+
+// RateLimitOverride is a client rate limit set by the external authorization service.
+type RateLimitOverride struct {
+	RequestsPerSecond int    `json:"requestsPerSecond"`
+	Burst             int    `json:"burst,omitempty"`
+	Algorithm         string `json:"algorithm,omitempty"`
+}
+
+// externalAuthzRequest is the JSON body posted to the external authorization service.
+type externalAuthzRequest struct {
+	ClientID            string   `json:"clientId"`
+	CommonName          string   `json:"commonName,omitempty"`
+	Organizations       []string `json:"organizations,omitempty"`
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty"`
+	DNSNames            []string `json:"dnsNames,omitempty"`
+	URIs                []string `json:"uris,omitempty"`
+	EmailAddresses      []string `json:"emailAddresses,omitempty"`
+	Issuer              string   `json:"issuer,omitempty"`
+	SerialNumber        string   `json:"serialNumber,omitempty"`
+	Fingerprint         string   `json:"fingerprint,omitempty"`
+	SourceIP            string   `json:"sourceIP,omitempty"`
+	ServerName          string   `json:"serverName,omitempty"`
+}
+
+// externalAuthzResponse is the JSON body the external authorization service answers with.
+type externalAuthzResponse struct {
+	Allow       bool               `json:"allow"`
+	TargetGroup string             `json:"targetGroup"`
+	RateLimit   *RateLimitOverride `json:"rateLimit"`
+	Reason      string             `json:"reason"`
+}
+
+type externalAuthzCacheEntry struct {
+	decision ExternalAuthzDecision
+	expires  time.Time
+}
+
+// rateLimitOverrideKey identifies a rate limit override of a client.
+type rateLimitOverrideKey struct {
+	clientID string
+	override RateLimitOverride
+}
+
+// ExternalAuthorizer asks an external authorization service, over HTTP or HTTP on a Unix socket,
+// whether a client connection is allowed. Decisions are cached by client certificate, source IP
+// and TLS server name.
+type ExternalAuthorizer struct {
+	config     ExternalAuthzConfig
+	clock      clock.Clock
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	cache map[string]externalAuthzCacheEntry
+	// overrides are the clients standing in for the clients whose rate limit is overridden. They
+	// are kept across decisions so that a client's rate limiting state survives its cached
+	// decision.
+	overrides map[rateLimitOverrideKey]*ClientInfo
+}
+
+// NewExternalAuthorizer creates an ExternalAuthorizer. Decisions are cached by the time of clk,
+// which defaults to the time package if nil. It returns nil if config is nil.
+func NewExternalAuthorizer(config *ExternalAuthzConfig, clk clock.Clock) (*ExternalAuthorizer, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	e := &ExternalAuthorizer{
+		config:    *config,
+		clock:     clock.OrDefault(clk),
+		cache:     make(map[string]externalAuthzCacheEntry),
+		overrides: make(map[rateLimitOverrideKey]*ClientInfo),
+	}
+
+	switch e.config.FailureMode {
+	case "":
+		e.config.FailureMode = ExternalAuthzFailClosed
+	case ExternalAuthzFailClosed, ExternalAuthzFailOpen:
+	default:
+		return nil, ErrUnknownExternalAuthzFailureMode(e.config.FailureMode)
+	}
+
+	if e.config.Timeout <= 0 {
+		e.config.Timeout = defaultExternalAuthzTimeout
+	}
+
+	if e.config.CacheTTL == 0 {
+		e.config.CacheTTL = defaultExternalAuthzCacheTTL
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch {
+	case e.config.UnixSocket != "":
+		if e.config.URL == "" {
+			e.config.URL = defaultExternalAuthzSocketURL
+		}
+
+		socket := e.config.UnixSocket
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	case e.config.URL == "":
+		return nil, ErrNoExternalAuthzEndpoint
+	}
+
+	e.httpClient = &http.Client{Timeout: e.config.Timeout, Transport: transport}
+
+	return e, nil
+}
+
+// FailOpen reports whether connections fall back to the load balancer's own authorization when
+// the service fails.
+func (e *ExternalAuthorizer) FailOpen() bool {
+	return e.config.FailureMode == ExternalAuthzFailOpen
+}
+
+// Authorize returns the decision of the service on a connection, from the cache if the same
+// certificate connected from the same IP to the same server name within the cache TTL. Failures
+// to get a decision are not cached.
+func (e *ExternalAuthorizer) Authorize(ctx context.Context, request *AuthzRequest) (ExternalAuthzDecision, error) {
+	body := newExternalAuthzRequest(request)
+	key := body.Fingerprint + "|" + request.ClientID + "|" + request.SourceIP.String() + "|" +
+		normalizeServerName(request.ServerName)
+	now := e.clock.Now()
+
+	e.mu.Lock()
+	entry, ok := e.cache[key]
+	e.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.decision, nil
+	}
+
+	decision, err := e.query(ctx, body)
+	if err != nil {
+		return ExternalAuthzDecision{}, ErrExternalAuthz(err)
+	}
+
+	if e.config.CacheTTL > 0 {
+		e.mu.Lock()
+		e.cacheDecision(key, externalAuthzCacheEntry{decision: decision, expires: now.Add(e.config.CacheTTL)}, now)
+		e.mu.Unlock()
+	}
+
+	return decision, nil
+}
+
+// cacheDecision adds a decision to the cache, dropping the expired ones first if it is full. It
+// must be called with mu held.
+func (e *ExternalAuthorizer) cacheDecision(key string, entry externalAuthzCacheEntry, now time.Time) {
+	if len(e.cache) >= maxExternalAuthzCacheSize {
+		for k, cached := range e.cache {
+			if !now.Before(cached.expires) {
+				delete(e.cache, k)
+			}
+		}
+	}
+
+	if len(e.cache) < maxExternalAuthzCacheSize {
+		e.cache[key] = entry
+	}
+}
+
+func newExternalAuthzRequest(request *AuthzRequest) *externalAuthzRequest {
+	body := &externalAuthzRequest{
+		ClientID:   request.ClientID,
+		ServerName: request.ServerName,
+	}
+
+	if request.SourceIP.IsValid() {
+		body.SourceIP = request.SourceIP.String()
+	}
+
+	cert := request.Certificate
+	if cert == nil {
+		return body
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	body.CommonName = cert.Subject.CommonName
+	body.Organizations = cert.Subject.Organization
+	body.OrganizationalUnits = cert.Subject.OrganizationalUnit
+	body.DNSNames = cert.DNSNames
+	body.EmailAddresses = cert.EmailAddresses
+	body.Issuer = cert.Issuer.String()
+	body.Fingerprint = hex.EncodeToString(fingerprint[:])
+
+	if cert.SerialNumber != nil {
+		body.SerialNumber = cert.SerialNumber.String()
+	}
+
+	for _, uri := range cert.URIs {
+		body.URIs = append(body.URIs, uri.String())
+	}
+
+	return body
+}
+
+func (e *ExternalAuthorizer) query(ctx context.Context, body *externalAuthzRequest) (ExternalAuthzDecision, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return ExternalAuthzDecision{}, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return ExternalAuthzDecision{}, err
+	}
+
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := e.httpClient.Do(httpRequest)
+	if err != nil {
+		return ExternalAuthzDecision{}, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return ExternalAuthzDecision{}, ErrExternalAuthzStatus(httpResponse.Status)
+	}
+
+	var response externalAuthzResponse
+
+	decoder := json.NewDecoder(io.LimitReader(httpResponse.Body, maxExternalAuthzResponseSize))
+	if err := decoder.Decode(&response); err != nil {
+		return ExternalAuthzDecision{}, err
+	}
+
+	if response.RateLimit != nil {
+		if _, err := ratelimit.ParseAlgorithm(response.RateLimit.Algorithm); err != nil {
+			return ExternalAuthzDecision{}, err
+		}
+	}
+
+	return ExternalAuthzDecision{
+		Allowed:     response.Allow,
+		TargetGroup: strings.TrimSpace(response.TargetGroup),
+		RateLimit:   response.RateLimit,
+		Reason:      response.Reason,
+	}, nil
+}
+
+// RateLimitedClient returns the client to rate limit a connection of clientInfo with. That is
+// clientInfo itself, unless the decision overrides its rate limit. The limiter of an override is
+// kept for as long as the service keeps returning the same override for the client.
+func (e *ExternalAuthorizer) RateLimitedClient(
+	clientInfo *ClientInfo,
+	decision ExternalAuthzDecision,
+) (*ClientInfo, error) {
+	if decision.RateLimit == nil {
+		return clientInfo, nil
+	}
+
+	key := rateLimitOverrideKey{clientID: clientInfo.GetClientID(), override: *decision.RateLimit}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if overridden, ok := e.overrides[key]; ok {
+		return overridden, nil
+	}
+
+	algorithm, err := ratelimit.ParseAlgorithm(key.override.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := ratelimit.New(algorithm, ratelimit.Params{
+		Limit: key.override.RequestsPerSecond,
+		Burst: key.override.Burst,
+		Clock: e.clock,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A new override replaces the previous ones of the client.
+	for other := range e.overrides {
+		if other.clientID == key.clientID {
+			delete(e.overrides, other)
+		}
+	}
+
+	overridden := clientInfo.withLimiter(algorithm, limiter)
+	e.overrides[key] = overridden
+
+	return overridden, nil
+}
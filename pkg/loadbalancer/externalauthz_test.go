@@ -0,0 +1,214 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authzStub is a stub of an external authorization service that answers with the response set
+// for each client ID, and denies other clients.
+type authzStub struct {
+	mu        sync.Mutex
+	responses map[string]map[string]any
+	requests  []map[string]any
+}
+
+func (a *authzStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.requests = append(a.requests, request)
+
+	response, ok := a.responses[request["clientId"].(string)]
+	if !ok {
+		response = map[string]any{"allow": false, "reason": "no entitlement"}
+	}
+
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func (a *authzStub) requestCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.requests)
+}
+
+func authzRequest(clientID string) *loadbalancer.AuthzRequest {
+	return &loadbalancer.AuthzRequest{
+		ClientID: clientID,
+		Certificate: &x509.Certificate{
+			Raw:      []byte(clientID),
+			Subject:  pkix.Name{CommonName: clientID, Organization: []string{"BarOrg"}},
+			DNSNames: []string{clientID + ".bardomain.com"},
+		},
+		SourceIP:   netip.MustParseAddr("10.1.2.3"),
+		ServerName: "db.loadbalancer.foodomain.com",
+	}
+}
+
+func TestExternalAuthorizer(t *testing.T) {
+	stub := &authzStub{responses: map[string]map[string]any{
+		"clientA": {"allow": true},
+		"clientB": {
+			"allow":       true,
+			"targetGroup": "FrontEndService",
+			"rateLimit":   map[string]any{"requestsPerSecond": 1},
+		},
+	}}
+	server := httptest.NewServer(stub)
+
+	defer server.Close()
+
+	fakeClock := clock.NewFake(time.Now())
+
+	authorizer, err := loadbalancer.NewExternalAuthorizer(&loadbalancer.ExternalAuthzConfig{
+		URL:      server.URL,
+		CacheTTL: time.Minute,
+	}, fakeClock)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	decision, err := authorizer.Authorize(ctx, authzRequest("clientA"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Empty(t, decision.TargetGroup)
+	assert.Nil(t, decision.RateLimit)
+
+	// The service is told about the certificate and the connection.
+	require.Equal(t, 1, stub.requestCount())
+	assert.Equal(t, "clientA", stub.requests[0]["commonName"])
+	assert.Equal(t, []any{"BarOrg"}, stub.requests[0]["organizations"])
+	assert.Equal(t, []any{"clientA.bardomain.com"}, stub.requests[0]["dnsNames"])
+	assert.Equal(t, "10.1.2.3", stub.requests[0]["sourceIP"])
+	assert.Equal(t, "db.loadbalancer.foodomain.com", stub.requests[0]["serverName"])
+
+	decision, err = authorizer.Authorize(ctx, authzRequest("clientB"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "FrontEndService", decision.TargetGroup)
+	assert.Equal(t, &loadbalancer.RateLimitOverride{RequestsPerSecond: 1}, decision.RateLimit)
+
+	decision, err = authorizer.Authorize(ctx, authzRequest("clientC"))
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "no entitlement", decision.Reason)
+
+	// Decisions are cached for the cache TTL.
+	_, err = authorizer.Authorize(ctx, authzRequest("clientA"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, stub.requestCount())
+
+	fakeClock.Advance(2 * time.Minute)
+
+	_, err = authorizer.Authorize(ctx, authzRequest("clientA"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, stub.requestCount())
+}
+
+func TestExternalAuthorizerRateLimitOverride(t *testing.T) {
+	authorizer, err := loadbalancer.NewExternalAuthorizer(
+		&loadbalancer.ExternalAuthzConfig{URL: "http://127.0.0.1:1"}, nil)
+	require.NoError(t, err)
+
+	store := loadbalancer.NewClientStore()
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1", RequestsPerSecond: 100},
+	}))
+
+	clientInfo, _ := store.GetClient("clientA")
+
+	rateLimitsStore, err := loadbalancer.NewRateLimitsStore(nil, nil, nil)
+	require.NoError(t, err)
+
+	// Without an override, the client's own limit applies.
+	rateLimited, err := authorizer.RateLimitedClient(clientInfo, loadbalancer.ExternalAuthzDecision{Allowed: true})
+	require.NoError(t, err)
+	assert.Same(t, clientInfo, rateLimited)
+
+	decision := loadbalancer.ExternalAuthzDecision{
+		Allowed:   true,
+		RateLimit: &loadbalancer.RateLimitOverride{RequestsPerSecond: 1},
+	}
+
+	rateLimited, err = authorizer.RateLimitedClient(clientInfo, decision)
+	require.NoError(t, err)
+	assert.Equal(t, "clientA", rateLimited.GetClientID())
+
+	assert.NoError(t, rateLimitsStore.Admit(context.Background(), rateLimited, "group1"))
+
+	// The override keeps its state across decisions.
+	rateLimited, err = authorizer.RateLimitedClient(clientInfo, decision)
+	require.NoError(t, err)
+	assert.ErrorIs(t,
+		rateLimitsStore.Admit(context.Background(), rateLimited, "group1"), loadbalancer.ErrRateLimitExceeded)
+}
+
+func TestExternalAuthorizerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "authz.sock")
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	stub := &authzStub{responses: map[string]map[string]any{"clientA": {"allow": true}}}
+	server := &http.Server{Handler: stub, ReadHeaderTimeout: time.Second}
+
+	go func() { _ = server.Serve(listener) }()
+
+	defer server.Close()
+
+	authorizer, err := loadbalancer.NewExternalAuthorizer(&loadbalancer.ExternalAuthzConfig{UnixSocket: socket}, nil)
+	require.NoError(t, err)
+
+	decision, err := authorizer.Authorize(context.Background(), authzRequest("clientA"))
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
+
+func TestExternalAuthorizerFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "entitlements unavailable", http.StatusServiceUnavailable)
+	}))
+
+	defer server.Close()
+
+	authorizer, err := loadbalancer.NewExternalAuthorizer(&loadbalancer.ExternalAuthzConfig{
+		URL:         server.URL,
+		FailureMode: loadbalancer.ExternalAuthzFailOpen,
+	}, nil)
+	require.NoError(t, err)
+	assert.True(t, authorizer.FailOpen())
+
+	_, err = authorizer.Authorize(context.Background(), authzRequest("clientA"))
+	assert.Error(t, err)
+
+	_, err = loadbalancer.NewExternalAuthorizer(
+		&loadbalancer.ExternalAuthzConfig{URL: server.URL, FailureMode: "maybe"}, nil)
+	assert.Error(t, err)
+
+	_, err = loadbalancer.NewExternalAuthorizer(&loadbalancer.ExternalAuthzConfig{}, nil)
+	assert.ErrorIs(t, err, loadbalancer.ErrNoExternalAuthzEndpoint)
+}
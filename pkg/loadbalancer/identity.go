@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"crypto/x509"
+)
+
+const (
+	// IdentityTypeCommonName is the Subject CommonName of a certificate.
+	IdentityTypeCommonName = "cn"
+	// IdentityTypeDNS is a DNS name SAN of a certificate.
+	IdentityTypeDNS = "dns"
+	// IdentityTypeURI is a URI SAN of a certificate, e.g. a SPIFFE ID.
+	IdentityTypeURI = "uri"
+	// IdentityTypeEmail is an email address SAN of a certificate.
+	IdentityTypeEmail = "email"
+)
+
+// defaultIdentityPrecedence prefers SANs over the deprecated CommonName.
+var defaultIdentityPrecedence = []string{
+	IdentityTypeURI,
+	IdentityTypeDNS,
+	IdentityTypeEmail,
+	IdentityTypeCommonName,
+}
+
+// ClientIdentity is an identity a client certificate can be matched on.
+type ClientIdentity struct {
+	Type  string
+	Value string
+}
+
+func (i ClientIdentity) String() string {
+	return i.Type + ":" + i.Value
+}
+
+// parseIdentityType validates an identity type. The empty type is the CommonName.
+func parseIdentityType(identityType string) (string, error) {
+	switch identityType {
+	case "":
+		return IdentityTypeCommonName, nil
+	case IdentityTypeCommonName, IdentityTypeDNS, IdentityTypeURI, IdentityTypeEmail:
+		return identityType, nil
+	default:
+		return "", ErrUnknownIdentityType(identityType)
+	}
+}
+
+// ParseIdentityPrecedence validates the order identity types of a certificate are matched in. An
+// empty precedence is the default one: URI, DNS, email and then CommonName. Identity types that
+// are left out are not matched.
+func ParseIdentityPrecedence(precedence []string) ([]string, error) {
+	if len(precedence) == 0 {
+		return defaultIdentityPrecedence, nil
+	}
+
+	seen := make(map[string]bool, len(precedence))
+
+	for _, identityType := range precedence {
+		switch identityType {
+		case IdentityTypeCommonName, IdentityTypeDNS, IdentityTypeURI, IdentityTypeEmail:
+		default:
+			return nil, ErrUnknownIdentityType(identityType)
+		}
+
+		if seen[identityType] {
+			return nil, ErrDuplicateIdentityType(identityType)
+		}
+
+		seen[identityType] = true
+	}
+
+	return precedence, nil
+}
+
+// GetCertificateIdentities returns the identities of cert in the order they are matched in: by
+// the precedence of their type, and then in the order they appear in the certificate.
+func GetCertificateIdentities(cert *x509.Certificate, precedence []string) []ClientIdentity {
+	var identities []ClientIdentity
+
+	for _, identityType := range precedence {
+		for _, value := range certificateIdentityValues(cert, identityType) {
+			identities = append(identities, ClientIdentity{Type: identityType, Value: value})
+		}
+	}
+
+	return identities
+}
+
+func certificateIdentityValues(cert *x509.Certificate, identityType string) []string {
+	switch identityType {
+	case IdentityTypeCommonName:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+
+		return []string{cert.Subject.CommonName}
+	case IdentityTypeDNS:
+		return cert.DNSNames
+	case IdentityTypeURI:
+		values := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			values = append(values, uri.String())
+		}
+
+		return values
+	case IdentityTypeEmail:
+		return cert.EmailAddresses
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package loadbalancer_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spiffeID(t *testing.T, id string) *url.URL {
+	t.Helper()
+
+	uri, err := url.Parse(id)
+	require.NoError(t, err)
+
+	return uri
+}
+
+func TestGetCertificateIdentities(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "clientA"},
+		DNSNames:       []string{"a.bardomain.com", "b.bardomain.com"},
+		URIs:           []*url.URL{spiffeID(t, "spiffe://corp/ns/x/sa/y")},
+		EmailAddresses: []string{"a@bardomain.com"},
+	}
+
+	precedence, err := loadbalancer.ParseIdentityPrecedence(nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []loadbalancer.ClientIdentity{
+		{Type: loadbalancer.IdentityTypeURI, Value: "spiffe://corp/ns/x/sa/y"},
+		{Type: loadbalancer.IdentityTypeDNS, Value: "a.bardomain.com"},
+		{Type: loadbalancer.IdentityTypeDNS, Value: "b.bardomain.com"},
+		{Type: loadbalancer.IdentityTypeEmail, Value: "a@bardomain.com"},
+		{Type: loadbalancer.IdentityTypeCommonName, Value: "clientA"},
+	}, loadbalancer.GetCertificateIdentities(cert, precedence))
+
+	assert.Equal(t, []loadbalancer.ClientIdentity{
+		{Type: loadbalancer.IdentityTypeCommonName, Value: "clientA"},
+		{Type: loadbalancer.IdentityTypeEmail, Value: "a@bardomain.com"},
+	}, loadbalancer.GetCertificateIdentities(cert, []string{"cn", "email"}))
+}
+
+func TestParseIdentityPrecedenceInvalid(t *testing.T) {
+	_, err := loadbalancer.ParseIdentityPrecedence([]string{"uri", "ip"})
+	assert.Error(t, err)
+
+	_, err = loadbalancer.ParseIdentityPrecedence([]string{"uri", "cn", "uri"})
+	assert.Error(t, err)
+}
+
+func TestGetClientByCertificatePrecedence(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1"},
+		{ClientId: "spiffe://corp/ns/x/sa/y", IdentityType: "uri", AllowedTargetGroup: "group2"},
+		{ClientId: "b.bardomain.com", IdentityType: "dns", AllowedTargetGroup: "group3"},
+	})
+	require.NoError(t, err)
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "clientA"},
+		DNSNames: []string{"a.bardomain.com", "b.bardomain.com"},
+		URIs:     []*url.URL{spiffeID(t, "spiffe://corp/ns/x/sa/y")},
+	}
+
+	// The URI SAN has the highest precedence by default.
+	clientInfo, identity, ok := store.GetClientByCertificate(cert)
+	require.True(t, ok)
+	assert.Equal(t, []string{"group2"}, clientInfo.GetAllowedTargetGroups())
+	assert.Equal(t, "uri:spiffe://corp/ns/x/sa/y", identity.String())
+
+	require.NoError(t, store.SetIdentityPrecedence([]string{"cn", "dns"}))
+
+	clientInfo, _, ok = store.GetClientByCertificate(cert)
+	require.True(t, ok)
+	assert.Equal(t, []string{"group1"}, clientInfo.GetAllowedTargetGroups())
+
+	// A client is only matched on its own identity type.
+	_, _, ok = store.GetClientByCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "b.bardomain.com"}})
+	assert.False(t, ok)
+}
+
+func TestAddClientsFromClientConfigListInvalidIdentity(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", IdentityType: "ip"},
+	})
+	assert.Error(t, err)
+
+	err = store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA"},
+		{ClientId: "clientA", IdentityType: "dns"},
+	})
+	assert.Error(t, err)
+}
+
+func TestGetClientConfigFromConnBySAN(t *testing.T) {
+	ca := newTestCA(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{ca.issueTLS(t, &x509.Certificate{DNSNames: []string{"loadbalancer.test"}})},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	clientCert := ca.issueTLS(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "workload"},
+		URIs:    []*url.URL{spiffeID(t, "spiffe://corp/ns/x/sa/y")},
+	})
+
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "spiffe://corp/ns/x/sa/y", IdentityType: "uri", AllowedTargetGroup: "group1"},
+	})
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+
+		clientInfo, err := loadbalancer.GetClientConfigFromConn(tls.Server(serverConn, serverConfig), store)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"group1"}, clientInfo.GetAllowedTargetGroups())
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := tls.Client(clientConn, &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "loadbalancer.test",
+		Certificates: []tls.Certificate{clientCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, client.Handshake())
+
+	// Wait for the server side to be done.
+	_, _ = client.Read(make([]byte, 1))
+}
@@ -9,9 +9,11 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ari23/loadbalancer/lib/clock"
 	"github.com/ari23/loadbalancer/lib/loadbalance"
 	"github.com/ari23/loadbalancer/lib/ratelimit"
 )
@@ -24,37 +26,136 @@ const (
 // Instance represents an instance of the load balancer.
 type Instance struct {
 	config                 *LoadBalancerConfig
+	certReloader           *CertReloader
+	revocationChecker      *RevocationChecker
 	tlsConfig              *tls.Config
 	authorizedClientsStore *ClientsStore
 	targetGroupsStore      *TargetGroupsStore
+	rateLimitsStore        *RateLimitsStore
+	quotasStore            *QuotasStore
+	concurrencyLimitsStore *ConcurrencyLimitsStore
+	policy                 *Policy
+	externalAuthorizer     *ExternalAuthorizer
 	netDialer              loadbalance.NetDialerInterface
+	clock                  clock.Clock
 	wg                     sync.WaitGroup
+	// passthroughClient stands in for the clients of the passthrough listener, which are unknown
+	// to the load balancer, in rate limiting. It has no limits of its own, so the source rate limit
+	// is the only limit per peer of passthrough connections.
+	passthroughClient *ClientInfo
 }
 
 // NewLoadBalancer creates and initializes a new load balancer instance based on the provided
 // configuration file.
 func NewLoadBalancer(config *LoadBalancerConfig) (*Instance, error) {
-	// Init TLS config.
-	tlsConfig, err := NewTLSConfig(&config.TLSParams)
+	// Initialize the load balancer instance with the parsed configuration.
+	lb := &Instance{
+		config: config,
+		clock:  clock.OrDefault(config.Clock),
+	}
+
+	// Init TLS config. The TLS material is picked from the reloader on every handshake.
+	certReloader, err := NewCertReloader(&config.TLSParams, lb.clock)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load TLS config: %w", err)
 	}
 
-	// Initialize the load balancer instance with the parsed configuration.
-	lb := &Instance{
-		config:    config,
-		tlsConfig: tlsConfig,
+	lb.certReloader = certReloader
+	lb.tlsConfig = certReloader.TLSConfig()
+
+	if config.TLSParams.Revocation != nil {
+		lb.revocationChecker, err = NewRevocationChecker(config.TLSParams.Revocation, lb.clock)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load revocation checking: %w", err)
+		}
+
+		lb.revocationChecker.SetSoftFailHandler(func(err error) {
+			config.Logger.Warnf("[revocation] Accepting client certificate: %s", err.Error())
+		})
+		certReloader.SetVerifyPeerCertificate(lb.revocationChecker.VerifyPeerCertificate)
 	}
 
 	// Initialize the authorized clients store.
 	lb.authorizedClientsStore = NewClientStore()
-	lb.authorizedClientsStore.AddClientsFromClientConfigList(config.Clients)
 
-	lb.netDialer = NewNetDialer(dialTimeout, retryLimit)
+	sharedRateLimit, err := NewSharedRateLimit(config.SharedRateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shared rate limit: %w", err)
+	}
+
+	if sharedRateLimit != nil {
+		sharedRateLimit.SetStateHandler(func(err error) {
+			if err != nil {
+				config.Logger.Warnf("[sharedRateLimit] Falling back to local rate limiting: %s", err.Error())
+
+				return
+			}
+
+			config.Logger.Infof("[sharedRateLimit] Shared rate limiting backend reachable again")
+		})
+	}
+
+	lb.authorizedClientsStore.SetSharedRateLimit(sharedRateLimit)
+	lb.authorizedClientsStore.SetClock(lb.clock)
+
+	if err := lb.authorizedClientsStore.SetIdentityPrecedence(config.ClientIdentityPrecedence); err != nil {
+		return nil, fmt.Errorf("failed to load client identity precedence: %w", err)
+	}
+
+	if err := lb.authorizedClientsStore.AddClientsFromClientConfigList(config.Clients); err != nil {
+		return nil, fmt.Errorf("failed to load clients: %w", err)
+	}
+
+	lb.policy, err = NewPolicy(config.Policies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policies: %w", err)
+	}
+
+	lb.externalAuthorizer, err = NewExternalAuthorizer(config.ExternalAuthz, lb.clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load external authorization: %w", err)
+	}
+
+	// The policy and the external authorization may let certificates through that are not
+	// configured as clients.
+	lb.authorizedClientsStore.SetIdentifyUnknownClients(lb.policy != nil || lb.externalAuthorizer != nil)
+
+	lb.rateLimitsStore, err = NewRateLimitsStore(config.RateLimit, config.TargetGroups, lb.clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rate limits: %w", err)
+	}
+
+	lb.quotasStore, err = NewQuotasStore(config.Quotas.StorePath, lb.clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quotas: %w", err)
+	}
+
+	lb.concurrencyLimitsStore, err = NewConcurrencyLimitsStore(config.TargetGroups, lb.clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load concurrency limits: %w", err)
+	}
+
+	sourceRateLimiter, err := NewSourceRateLimiter(config.SourceRateLimit, lb.clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load source rate limit: %w", err)
+	}
+
+	lb.rateLimitsStore.SetSourceRateLimiter(sourceRateLimiter)
+
+	lb.netDialer, err = NewNetDialer(dialTimeout, retryLimit, &config.Dialer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dialer: %w", err)
+	}
 
 	// Initialize target groups store.
-	lb.targetGroupsStore = NewTargetGroupsStore(lb.netDialer)
-	lb.targetGroupsStore.AddTargetGroups(config.TargetGroups)
+	lb.targetGroupsStore = NewTargetGroupsStore(lb.netDialer, lb.clock)
+	if err := lb.targetGroupsStore.AddTargetGroups(config.TargetGroups); err != nil {
+		return nil, fmt.Errorf("failed to load target groups: %w", err)
+	}
+
+	if config.Passthrough != nil {
+		lb.passthroughClient = NewClientInfo("passthrough", nil, 0, ratelimit.AlgorithmFixedWindow, nil)
+	}
 
 	return lb, nil
 }
@@ -76,7 +177,9 @@ func NewTLSConfig(tlsConfigParams *TLSConfigParams) (*tls.Config, error) {
 	}
 
 	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, ErrLoadingCACert(ErrNoCACertificates)
+	}
 
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
@@ -96,8 +199,24 @@ func (i *Instance) GetConfig() *LoadBalancerConfig {
 	return i.config
 }
 
+// GetTLSConfig returns the TLS config of the listener, with the certificate, private key and
+// client CAs loaded last.
 func (i *Instance) GetTLSConfig() *tls.Config {
-	return i.tlsConfig
+	return i.certReloader.Current()
+}
+
+// ReloadTLS reloads the TLS certificate, private key, CA certificate and CRLs from their files.
+// New handshakes use the reloaded material. The certificates and the CRLs are reloaded
+// independently, so that broken certificate files do not hold back fresh CRLs. Whatever fails to
+// reload keeps its current material, and the errors are joined.
+func (i *Instance) ReloadTLS() error {
+	err := i.certReloader.Reload()
+
+	if i.revocationChecker != nil {
+		err = errors.Join(err, i.revocationChecker.ReloadCRLs())
+	}
+
+	return err
 }
 
 func (i *Instance) GetAuthorizedClientsStore() *ClientsStore {
@@ -108,7 +227,20 @@ func (i *Instance) GetTargetGroupsStore() *TargetGroupsStore {
 	return i.targetGroupsStore
 }
 
-// Start begins listening on the configured port and handling incoming connections.
+func (i *Instance) GetRateLimitsStore() *RateLimitsStore {
+	return i.rateLimitsStore
+}
+
+func (i *Instance) GetQuotasStore() *QuotasStore {
+	return i.quotasStore
+}
+
+func (i *Instance) GetConcurrencyLimitsStore() *ConcurrencyLimitsStore {
+	return i.concurrencyLimitsStore
+}
+
+// Start begins listening on the configured port, and on the passthrough port if configured, and
+// handling incoming connections.
 func (i *Instance) Start(ctx context.Context) error {
 	listenAddr := i.config.ListenAddress
 
@@ -123,24 +255,118 @@ func (i *Instance) Start(ctx context.Context) error {
 
 	i.config.Logger.Infof("Network Load balancer listening on %s", listenAddr)
 
+	var passthroughListener net.Listener
+
+	if i.config.Passthrough != nil {
+		passthroughListener, err = net.Listen("tcp", i.config.Passthrough.ListenAddress)
+		if err != nil {
+			i.config.Logger.Errorf("Failed to listen on %s: %v", i.config.Passthrough.ListenAddress, err)
+
+			return err
+		}
+
+		defer passthroughListener.Close()
+
+		i.config.Logger.Infof("Passthrough listener listening on %s", i.config.Passthrough.ListenAddress)
+	}
+
 	// Start health checks for all target groups.
 	i.targetGroupsStore.StartHealthChecks(ctx, &i.wg)
 
+	// Persist quota usage periodically and on shutdown.
+	i.wg.Add(1)
+
+	go func() {
+		defer i.wg.Done()
+		i.quotasStore.Run(ctx, i.config.Quotas.FlushInterval, func(err error) {
+			i.config.Logger.Errorf("Failed to persist quota usage: %v", err)
+		})
+	}()
+
+	// Report how the adaptive concurrency limits evolve.
+	i.wg.Add(1)
+
+	go func() {
+		defer i.wg.Done()
+		i.concurrencyLimitsStore.Run(ctx, defaultConcurrencyStatsInterval, i.logConcurrencyLimitStats)
+	}()
+
+	// Pick up rotated TLS material.
 	i.wg.Add(1)
-	// Listen for context cancellation to gracefully shut down the listener.
+
+	go func() {
+		defer i.wg.Done()
+		i.certReloader.Run(ctx, i.config.TLSParams.ReloadInterval, func(err error) {
+			if err != nil {
+				i.config.Logger.Errorf("[reloadTLS] Error: %s", err.Error())
+
+				return
+			}
+
+			i.config.Logger.Infof("Reloaded TLS material")
+		})
+	}()
+
+	if i.revocationChecker != nil {
+		i.wg.Add(1)
+
+		go func() {
+			defer i.wg.Done()
+			i.revocationChecker.Run(ctx, func(err error) {
+				i.config.Logger.Errorf("[reloadCRLs] Error: %s", err.Error())
+			})
+		}()
+	}
+
+	i.wg.Add(1)
+	// Listen for context cancellation to gracefully shut down the listeners.
 	go func() {
 		<-ctx.Done()
 		listener.Close()
+
+		if passthroughListener != nil {
+			passthroughListener.Close()
+		}
+
 		i.wg.Done()
 	}()
 
+	if passthroughListener != nil {
+		i.wg.Add(1)
+
+		go func() {
+			defer i.wg.Done()
+
+			if err := i.serve(ctx, passthroughListener, i.handlePassthroughConnection); err != nil {
+				i.config.Logger.Errorf("[passthrough] Error: %s", err.Error())
+			}
+		}()
+	}
+
+	if err := i.serve(ctx, listener, i.handleConnection); err != nil {
+		return err
+	}
+
+	i.wg.Wait()
+
+	return nil
+}
+
+// serve accepts the connections of a listener and handles each of them in a new goroutine with
+// handle, until ctx is done or the listener is closed. It returns nil once ctx is done.
+func (i *Instance) serve(
+	ctx context.Context,
+	listener net.Listener,
+	handle func(ctx context.Context, conn net.Conn),
+) error {
+	listenAddr := listener.Addr().String()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				i.config.Logger.Infof("Shutting down listener on %s", listenAddr)
-				i.wg.Wait()
 
 				return nil
 			default:
@@ -157,12 +383,20 @@ func (i *Instance) Start(ctx context.Context) error {
 			continue
 		}
 
+		// Reject floods from a single source before spending CPU on their TLS handshakes.
+		if err := i.rateLimitsStore.AdmitSource(conn.RemoteAddr()); err != nil {
+			i.config.Logger.Debugf("[Start] Error: %s", err.Error())
+			conn.Close()
+
+			continue
+		}
+
 		// Handle the connection in a new goroutine.
 		i.wg.Add(1)
 
 		go func(conn net.Conn) {
 			defer i.wg.Done()
-			i.handleConnection(ctx, conn)
+			handle(ctx, conn)
 		}(conn)
 	}
 }
@@ -184,24 +418,156 @@ func (i *Instance) handleConnection(ctx context.Context, clientConn net.Conn) {
 
 	i.config.Logger.Infof("ClientInfo: %+v", clientInfo)
 
-	if !ratelimit.RequestAllowed(clientInfo) {
-		i.config.Logger.Errorf("[handleConnection] Rate limit exceeded for client: %s", clientInfo.GetClientID())
+	// Route the connection by the server name the client asked for.
+	targetGroup, rateLimitedClient, err := i.authorize(ctx, clientConn, clientInfo)
+	if err != nil {
+		i.config.Logger.Errorf("[handleConnection] Error: %s", err.Error())
+
+		return
+	}
+
+	// The upstream servers of passthrough target groups expect the clients' TLS connections.
+	if i.targetGroupsStore.IsPassthrough(targetGroup) {
+		i.config.Logger.Errorf("[handleConnection] Error: %s",
+			ErrPassthroughTargetGroup(clientInfo.GetClientID(), targetGroup))
+
+		return
+	}
+
+	if !i.admit(ctx, clientConn, clientInfo, rateLimitedClient, targetGroup) {
+		return
+	}
+
+	if err := i.quotasStore.CheckConnection(clientInfo); err != nil {
+		i.config.Logger.Errorf("[handleConnection] Error: %s", err.Error())
+
+		return
+	}
+
+	// Hold one of the client's connection slots for the lifetime of the proxied session.
+	if !clientInfo.AcquireConnection() {
+		i.config.Logger.Errorf("[handleConnection] Error: %s", ErrMaxConnectionsReached(clientInfo.GetClientID()))
 
 		return
 	}
+	defer clientInfo.ReleaseConnection()
+
+	i.proxy(ctx, clientConn, clientInfo, targetGroup, timeoutDuration)
+}
+
+// handlePassthroughConnection handles a connection of the passthrough listener. It is routed by the
+// server name of its ClientHello and relayed as is, TLS handshake included, to the upstream
+// server.
+func (i *Instance) handlePassthroughConnection(ctx context.Context, clientConn net.Conn) {
+	defer clientConn.Close()
+
+	clientHelloTimeout := i.config.Passthrough.ClientHelloTimeout
+	if clientHelloTimeout <= 0 {
+		clientHelloTimeout = defaultClientHelloTimeout
+	}
+
+	clientConn.SetDeadline(time.Now().Add(clientHelloTimeout))
+
+	serverName, peekedConn, err := PeekServerName(clientConn)
+	if err != nil {
+		i.config.Logger.Errorf("[handlePassthroughConnection] Error: %s", err.Error())
+
+		return
+	}
+
+	// TODO: Make this configurable, like the timeout of handleConnection.
+	timeoutDuration := 30 * time.Second
+	peekedConn.SetDeadline(time.Now().Add(timeoutDuration))
+
+	// Without a client certificate, the connection is only authorized by its server name and IP.
+	request := NewAuthzRequest(peekedConn, nil, i.clock.Now())
+	request.ServerName = serverName
+
+	targetGroup, err := SelectPassthroughTargetGroup(request, i.policy, i.targetGroupsStore)
+	if err != nil {
+		i.config.Logger.Errorf("[handlePassthroughConnection] Error: %s", err.Error())
+
+		return
+	}
+
+	if !i.admit(ctx, peekedConn, i.passthroughClient, i.passthroughClient, targetGroup) {
+		return
+	}
+
+	i.proxy(ctx, peekedConn, i.passthroughClient, targetGroup, timeoutDuration)
+}
+
+// admit checks the rate limits for a connection of clientInfo to the target group, rate limited
+// as rateLimitedClient, and rejects the connection if they do not allow it.
+func (i *Instance) admit(
+	ctx context.Context,
+	clientConn net.Conn,
+	clientInfo, rateLimitedClient *ClientInfo,
+	targetGroup string,
+) bool {
+	shadow, err := i.rateLimitsStore.AdmitWithShadow(ctx, rateLimitedClient, targetGroup)
+	if shadow.Evaluated {
+		// Record what the dry run rate limits decided next to the actual outcome.
+		i.config.Logger.Infof("[handleConnection] Rate limit dry run for client %s: actual=%s shadow=%s",
+			clientInfo.GetClientID(), admissionOutcome(err), shadowOutcome(shadow))
+	}
+
+	if err == nil {
+		return true
+	}
+
+	i.config.Logger.Errorf("[handleConnection] Error: %s", err.Error())
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		if err := rateLimitErr.Action.Reject(ctx, clientConn, rateLimitErr.RetryAfter); err != nil {
+			i.config.Logger.Debugf("[handleConnection] Failed to reject connection: %s", err.Error())
+		}
+	}
 
-	upstreamServer, err := GetNextUpstreamServer(clientInfo, i.targetGroupsStore)
+	return false
+}
+
+// proxy relays an admitted connection of clientInfo to the next upstream server of the target
+// group, until either side closes it.
+func (i *Instance) proxy(
+	ctx context.Context,
+	clientConn net.Conn,
+	clientInfo *ClientInfo,
+	targetGroup string,
+	timeoutDuration time.Duration,
+) {
+	// The client was authorized for the target group when it was selected.
+	upstreamServer, err := i.targetGroupsStore.GetNextUpstreamServer(targetGroup)
 	if err != nil {
 		i.config.Logger.Errorf("[handleConnection] Error: %s", err.Error())
 
 		return
 	}
 
+	// Shed the connection if the target group is already at its concurrency limit.
+	if err := i.concurrencyLimitsStore.Acquire(targetGroup); err != nil {
+		i.config.Logger.Errorf("[handleConnection] Error: %s", err.Error())
+
+		return
+	}
+	defer i.concurrencyLimitsStore.Release(targetGroup)
+
 	upstreamServer.IncrementConnectionCount()
 	defer upstreamServer.DecrementConnectionCount()
 
-	upstreamConn, err := i.netDialer.DialTimeout(
-		"tcp", upstreamServer.GetAddress(), dialTimeout)
+	dialStart := i.clock.Now()
+	dialCtx, cancelDial := context.WithTimeout(ctx, dialTimeout)
+	upstreamConn, err := i.targetGroupsStore.GetDialer(targetGroup).DialContext(dialCtx, "tcp",
+		upstreamServer.GetAddress())
+
+	cancelDial()
+
+	// A dial cut short by shutdown says nothing about the upstream.
+	if ctx.Err() == nil {
+		i.concurrencyLimitsStore.Observe(targetGroup, i.clock.Since(dialStart), err != nil)
+	}
+
 	if err != nil {
 		i.config.Logger.Errorf("Failed to dial upstream server: %v", err)
 
@@ -211,6 +577,13 @@ func (i *Instance) handleConnection(ctx context.Context, clientConn net.Conn) {
 
 	upstreamConn.SetDeadline(time.Now().Add(timeoutDuration))
 
+	// Only connections that reached an upstream server count against the client's quotas.
+	i.quotasStore.CountConnection(clientInfo)
+
+	// Streams are throttled by the client's bandwidth limits and counted against its byte quotas.
+	upload := i.quotasStore.CountBytes(clientInfo, clientInfo.ThrottleUpload(ctx, clientConn))
+	download := i.quotasStore.CountBytes(clientInfo, clientInfo.ThrottleDownload(ctx, upstreamConn))
+
 	i.wg.Add(1)
 
 	// TODO: with current client.go and server.go combo, receiving this error:
@@ -221,14 +594,113 @@ func (i *Instance) handleConnection(ctx context.Context, clientConn net.Conn) {
 	go func() {
 		defer i.wg.Done()
 
-		if _, err := io.Copy(upstreamConn, clientConn); err != nil {
+		if _, err := io.Copy(upstreamConn, upload); err != nil {
 			i.config.Logger.Errorf("[client_to_upstream] Error: %s", err.Error())
 
 			return
 		}
 	}()
 
-	if _, err := io.Copy(clientConn, upstreamConn); err != nil {
+	if _, err := io.Copy(clientConn, download); err != nil {
 		i.config.Logger.Errorf("[upstream_to_client] Error: %s", err.Error())
 	}
 }
+
+// authorize chooses the target group of a client connection and checks the client may access it,
+// by the external authorization service if there is one. It also returns the client to rate limit
+// the connection with, which differs from clientInfo if the service overrides its rate limit.
+func (i *Instance) authorize(ctx context.Context, clientConn net.Conn, clientInfo *ClientInfo) (
+	string, *ClientInfo, error,
+) {
+	if i.externalAuthorizer == nil {
+		targetGroup, err := i.selectTargetGroup(clientConn, clientInfo)
+
+		return targetGroup, clientInfo, err
+	}
+
+	request := NewAuthzRequest(clientConn, clientInfo, i.clock.Now())
+
+	decision, err := i.externalAuthorizer.Authorize(ctx, request)
+	if err != nil {
+		if !i.externalAuthorizer.FailOpen() {
+			return "", nil, err
+		}
+
+		i.config.Logger.Warnf("[externalAuthz] Falling back to the local authorization: %s", err.Error())
+
+		targetGroup, err := i.selectTargetGroup(clientConn, clientInfo)
+
+		return targetGroup, clientInfo, err
+	}
+
+	if !decision.Allowed {
+		return "", nil, ErrExternalAuthzDenied(clientInfo.GetClientID(), decision.Reason)
+	}
+
+	targetGroup := decision.TargetGroup
+	if targetGroup == "" {
+		var ok bool
+
+		// Without a mapped server name, the connection goes to the target group the local
+		// authorization would choose, like it would without the service.
+		targetGroup, ok = i.targetGroupsStore.GetTargetGroupByServerName(request.ServerName)
+		if !ok {
+			if targetGroup, err = i.selectTargetGroup(clientConn, clientInfo); err != nil {
+				return "", nil, err
+			}
+		}
+	} else if _, ok := i.targetGroupsStore.GetTargetGroups()[targetGroup]; !ok {
+		return "", nil, ErrExternalAuthz(ErrTargetGroupNotFound(targetGroup))
+	}
+
+	rateLimitedClient, err := i.externalAuthorizer.RateLimitedClient(clientInfo, decision)
+	if err != nil {
+		return "", nil, ErrExternalAuthz(err)
+	}
+
+	return targetGroup, rateLimitedClient, nil
+}
+
+// selectTargetGroup chooses the target group of a client connection and checks the client may
+// access it, by the policy if there is one and by the client's allowed target groups otherwise.
+func (i *Instance) selectTargetGroup(clientConn net.Conn, clientInfo *ClientInfo) (string, error) {
+	if i.policy == nil {
+		return SelectTargetGroup(clientInfo, GetServerName(clientConn), i.targetGroupsStore)
+	}
+
+	return i.policy.SelectTargetGroup(NewAuthzRequest(clientConn, clientInfo, i.clock.Now()), i.targetGroupsStore)
+}
+
+// logConcurrencyLimitStats logs the concurrency limit stats of a target group.
+func (i *Instance) logConcurrencyLimitStats(targetGroup string, stats ConcurrencyLimitStats) {
+	changes := make([]string, 0, len(stats.History))
+	for _, change := range stats.History {
+		changes = append(changes, fmt.Sprintf("%d at %s", change.Limit, change.Time.Format(time.RFC3339)))
+	}
+
+	i.config.Logger.Infof("[concurrencyLimit] Target group %s: limit %d (%s), %d in flight, %d shed, changes: [%s]",
+		targetGroup, stats.Limit, stats.Algorithm, stats.InFlight, stats.Rejected, strings.Join(changes, ", "))
+}
+
+// admissionOutcome describes the outcome of a rate limit admission for logging.
+func admissionOutcome(err error) string {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return "rejected by " + rateLimitErr.Level
+	}
+
+	if err != nil {
+		return "rejected"
+	}
+
+	return "allowed"
+}
+
+// shadowOutcome describes a shadow decision for logging.
+func shadowOutcome(shadow ShadowDecision) string {
+	if !shadow.Rejected() {
+		return "allowed"
+	}
+
+	return "rejected by " + strings.Join(shadow.RejectedLevels, ",")
+}
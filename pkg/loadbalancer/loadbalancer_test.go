@@ -1,9 +1,20 @@
 package loadbalancer_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/ari23/loadbalancer/pkg/loadbalancer"
 )
@@ -52,7 +63,12 @@ func TestNewLoadBalancer(t *testing.T) {
 	assert.Equal(t, lb.GetConfig(), config, "Load balancer config does not match the input config")
 
 	// Assert that TLS configuration is correctly initialized
-	assert.NotNil(t, lb.GetTLSConfig())
+	tlsConfig := lb.GetTLSConfig()
+	if assert.NotNil(t, tlsConfig) {
+		assert.Len(t, tlsConfig.Certificates, 1)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+		assert.NotNil(t, tlsConfig.ClientCAs)
+	}
 
 	// Assert that the authorized clients store is initialized and contains the expected clients
 	assert.Equal(t, len(lb.GetAuthorizedClientsStore().GetClients()), len(config.Clients))
@@ -60,3 +76,222 @@ func TestNewLoadBalancer(t *testing.T) {
 	// Assert that the target groups store is initialized and contains the expected target groups
 	assert.Equal(t, len(lb.GetTargetGroupsStore().GetTargetGroups()), len(config.TargetGroups))
 }
+
+// freeAddress returns a loopback address with a port that was free a moment ago.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// echoUpstream is an upstream server that echoes what it receives. Its connections are closed by
+// the returned func, so that the load balancer sessions proxied to it end.
+func echoUpstream(t *testing.T) (string, func()) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() { _, _ = io.Copy(conn, conn) }()
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() {
+		close(done)
+		listener.Close()
+	}
+}
+
+// startLoadBalancer starts a load balancer with TLS material issued by ca, and stops it when the
+// test ends.
+func startLoadBalancer(t *testing.T, ca *testCA, config *loadbalancer.LoadBalancerConfig) *loadbalancer.Instance {
+	t.Helper()
+
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{DNSNames: []string{"loadbalancer"}})
+
+	config.ListenAddress = freeAddress(t)
+	config.TLSParams = loadbalancer.TLSConfigParams{
+		Certificate:   writeTestFile(t, dir, "loadbalancer.crt", certPEM),
+		PrivateKey:    writeTestFile(t, dir, "loadbalancer.key", keyPEM),
+		CACertificate: writeTestFile(t, dir, "ca.pem", ca.pem),
+	}
+	config.Logger = logrus.New()
+	config.Logger.SetOutput(io.Discard)
+
+	lb, err := loadbalancer.NewLoadBalancer(config)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() { done <- lb.Start(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", config.ListenAddress)
+		if err == nil {
+			conn.Close()
+		}
+
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	return lb
+}
+
+// dialLoadBalancer opens a connection to the load balancer with a client certificate issued by ca
+// for commonName.
+func dialLoadBalancer(t *testing.T, ca *testCA, address, commonName string) *tls.Conn {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: commonName}})},
+		RootCAs:      roots,
+		ServerName:   "loadbalancer",
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// TestQuotaNotChargedForRefusedConnection checks that a connection refused after the quota check
+// does not use up the client's quota.
+func TestQuotaNotChargedForRefusedConnection(t *testing.T) {
+	ca := newTestCA(t)
+
+	upstream, closeUpstream := echoUpstream(t)
+	defer closeUpstream()
+
+	lb := startLoadBalancer(t, ca, &loadbalancer.LoadBalancerConfig{
+		Clients: []loadbalancer.ClientConfig{{
+			ClientId:            "clientA",
+			AllowedTargetGroups: []string{"group1"},
+			RequestsPerSecond:   100,
+			MaxConnections:      1,
+			Quotas:              []loadbalancer.QuotaConfig{{Resource: "connections", Period: "day", Limit: 10}},
+		}},
+		TargetGroups: []loadbalancer.TargetGroupConfig{
+			{Name: "group1", UpstreamServers: []string{upstream}},
+		},
+	})
+
+	clientInfo, ok := lb.GetAuthorizedClientsStore().GetClient("clientA")
+	require.True(t, ok)
+
+	// The first connection is proxied and counted.
+	first := dialLoadBalancer(t, ca, lb.GetConfig().ListenAddress, "clientA")
+
+	_, err := first.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(first, make([]byte, 4))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(9), lb.GetQuotasStore().GetQuotaStatus(clientInfo)[0].Remaining)
+
+	// The second one is refused at the client's connection limit, and not counted.
+	second := dialLoadBalancer(t, ca, lb.GetConfig().ListenAddress, "clientA")
+
+	_, err = second.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	assert.Equal(t, int64(9), lb.GetQuotasStore().GetQuotaStatus(clientInfo)[0].Remaining)
+}
+
+// TestExternalAuthzWithoutTargetGroupFallsBack checks that a connection the external authorization
+// service allows without a target group, and whose server name is not mapped, goes to the client's
+// only target group like it would without the service.
+func TestExternalAuthzWithoutTargetGroupFallsBack(t *testing.T) {
+	ca := newTestCA(t)
+
+	upstream, closeUpstream := echoUpstream(t)
+	defer closeUpstream()
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"allow": true}`))
+	}))
+	defer service.Close()
+
+	lb := startLoadBalancer(t, ca, &loadbalancer.LoadBalancerConfig{
+		ExternalAuthz: &loadbalancer.ExternalAuthzConfig{URL: service.URL},
+		Clients: []loadbalancer.ClientConfig{{
+			ClientId:            "clientA",
+			AllowedTargetGroups: []string{"group1"},
+			RequestsPerSecond:   100,
+		}},
+		TargetGroups: []loadbalancer.TargetGroupConfig{
+			{Name: "group1", UpstreamServers: []string{upstream}},
+			{Name: "group2", UpstreamServers: []string{freeAddress(t)}},
+		},
+	})
+
+	conn := dialLoadBalancer(t, ca, lb.GetConfig().ListenAddress, "clientA")
+
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+}
+
+// TestReloadTLSReloadsCRLsDespiteBrokenCertificate checks that a failed certificate reload does not
+// hold back the CRLs.
+func TestReloadTLSReloadsCRLsDespiteBrokenCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	files := newCertFiles(t, ca, "lb")
+
+	clientCert := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}})
+	crlFile := writeTestFile(t, files.dir, "ca.crl", ca.crl(t, time.Now()))
+
+	files.params.Revocation = &loadbalancer.RevocationConfig{CRLFiles: []string{crlFile}}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	lb, err := loadbalancer.NewLoadBalancer(&loadbalancer.LoadBalancerConfig{
+		ListenAddress: freeAddress(t),
+		TLSParams:     files.params,
+		Logger:        logger,
+	})
+	require.NoError(t, err)
+
+	verifiedChains := [][]*x509.Certificate{{clientCert.Leaf, ca.cert}}
+	require.NoError(t, lb.GetTLSConfig().VerifyPeerCertificate(nil, verifiedChains))
+
+	writeTestFile(t, files.dir, "lb.key", []byte("not a key"))
+	writeTestFile(t, files.dir, "ca.crl", ca.crl(t, time.Now(), clientCert.Leaf))
+
+	assert.Error(t, lb.ReloadTLS())
+	assert.ErrorIs(t, lb.GetTLSConfig().VerifyPeerCertificate(nil, verifiedChains), loadbalancer.ErrRevoked)
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const defaultClientHelloTimeout = 5 * time.Second
+
+// errClientHelloRead stops the handshake PeekServerName runs as soon as the ClientHello is read.
+var errClientHelloRead = errors.New("ClientHello read")
+
+// PeekServerName reads the TLS ClientHello at the start of conn and returns the server name (SNI)
+// it asks for, "" if none. The returned connection reads the ClientHello again before the rest of
+// conn, so that it can be relayed as is. Nothing is written to conn.
+func PeekServerName(conn net.Conn) (string, net.Conn, error) {
+	var (
+		peeked     bytes.Buffer
+		serverName string
+		helloRead  bool
+	)
+
+	err := tls.Server(&readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			helloRead = true
+
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !helloRead {
+		return "", nil, ErrReadingClientHello(err)
+	}
+
+	return serverName, &peekedConn{Conn: conn, reader: io.MultiReader(&peeked, conn)}, nil
+}
+
+// readOnlyConn is a connection whose reads come from reader and whose writes are dropped.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *readOnlyConn) Write(_ []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekedConn is a connection whose first bytes were peeked at. Its reads replay them first.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// SelectPassthroughTargetGroup chooses the target group of a passthrough connection by the server
+// name of its ClientHello, and checks that the policy, if any, allows it. Only passthrough target
+// groups are reachable, and only by one of their server names. The policy is evaluated without a
+// client, so only its rules without client conditions match.
+func SelectPassthroughTargetGroup(
+	request *AuthzRequest,
+	policy *Policy,
+	targetGroupsStore *TargetGroupsStore,
+) (string, error) {
+	if targetGroupsStore == nil {
+		return "", ErrNilTargetGroupsStore
+	}
+
+	targetGroup, ok := targetGroupsStore.GetTargetGroupByServerName(request.ServerName)
+	if !ok || !targetGroupsStore.IsPassthrough(targetGroup) {
+		return "", ErrNoPassthroughTargetGroup(request.ServerName)
+	}
+
+	if policy == nil {
+		return targetGroup, nil
+	}
+
+	if decision := policy.Evaluate(request, targetGroup); !decision.Allowed {
+		return "", ErrPolicyDenied(request.SourceIP.String(), targetGroup, decision.Rule)
+	}
+
+	return targetGroup, nil
+}
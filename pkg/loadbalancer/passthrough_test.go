@@ -0,0 +1,134 @@
+package loadbalancer_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeekServerName(t *testing.T) {
+	ca := newTestCA(t)
+
+	clientConn, serverConn := net.Pipe()
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	clientErr := make(chan error, 1)
+
+	go func() {
+		clientErr <- tls.Client(clientConn, &tls.Config{
+			ServerName: "vault.loadbalancer.foodomain.com",
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+		}).Handshake()
+	}()
+
+	serverName, peekedConn, err := loadbalancer.PeekServerName(serverConn)
+	require.NoError(t, err)
+	assert.Equal(t, "vault.loadbalancer.foodomain.com", serverName)
+
+	// The ClientHello is replayed, so the handshake can still be completed past the peek.
+	err = tls.Server(peekedConn, &tls.Config{
+		Certificates: []tls.Certificate{
+			ca.issueTLS(t, &x509.Certificate{DNSNames: []string{"vault.loadbalancer.foodomain.com"}}),
+		},
+		MinVersion: tls.VersionTLS12,
+	}).Handshake()
+	require.NoError(t, err)
+	assert.NoError(t, <-clientErr)
+}
+
+func TestPeekServerNameNotTLS(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		_, _ = clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: vault.loadbalancer.foodomain.com\r\n\r\n"))
+	}()
+
+	require.NoError(t, serverConn.SetDeadline(time.Now().Add(time.Second)))
+
+	_, _, err := loadbalancer.PeekServerName(serverConn)
+	assert.Error(t, err)
+}
+
+func TestSelectPassthroughTargetGroup(t *testing.T) {
+	targetGroupsStore := loadbalancer.NewTargetGroupsStore(nil, nil)
+	require.NoError(t, targetGroupsStore.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "Vault", ServerNames: []string{"vault.loadbalancer.foodomain.com"}, Passthrough: true},
+		{Name: "DBService", ServerNames: []string{"db.loadbalancer.foodomain.com"}},
+	}))
+
+	internal := netip.MustParseAddr("10.1.2.3")
+	external := netip.MustParseAddr("192.0.2.1")
+
+	vault := &loadbalancer.AuthzRequest{ServerName: "Vault.LoadBalancer.FooDomain.com", SourceIP: internal}
+
+	targetGroup, err := loadbalancer.SelectPassthroughTargetGroup(vault, nil, targetGroupsStore)
+	require.NoError(t, err)
+	assert.Equal(t, "Vault", targetGroup)
+
+	// Target groups that terminate TLS on the load balancer are not reachable.
+	_, err = loadbalancer.SelectPassthroughTargetGroup(
+		&loadbalancer.AuthzRequest{ServerName: "db.loadbalancer.foodomain.com"}, nil, targetGroupsStore)
+	assert.Error(t, err)
+
+	_, err = loadbalancer.SelectPassthroughTargetGroup(&loadbalancer.AuthzRequest{}, nil, targetGroupsStore)
+	assert.Error(t, err)
+
+	policy, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{
+		{
+			Name:        "deny-all-clients",
+			Effect:      loadbalancer.PolicyEffectDeny,
+			ClientIDs:   []string{"*"},
+			SourceCIDRs: []string{"10.0.0.0/8"},
+		},
+		{
+			Name:         "vault-from-internal",
+			Effect:       loadbalancer.PolicyEffectAllow,
+			TargetGroups: []string{"Vault"},
+			SourceCIDRs:  []string{"10.0.0.0/8"},
+			ServerNames:  []string{"vault.loadbalancer.foodomain.com"},
+		},
+	})
+	require.NoError(t, err)
+
+	// Rules with client conditions never match passthrough connections.
+	targetGroup, err = loadbalancer.SelectPassthroughTargetGroup(vault, policy, targetGroupsStore)
+	require.NoError(t, err)
+	assert.Equal(t, "Vault", targetGroup)
+
+	vault.SourceIP = external
+
+	_, err = loadbalancer.SelectPassthroughTargetGroup(vault, policy, targetGroupsStore)
+	assert.ErrorIs(t, err, loadbalancer.ErrDeniedByPolicy)
+}
+
+func TestTargetGroupsStorePassthrough(t *testing.T) {
+	store := loadbalancer.NewTargetGroupsStore(nil, nil)
+	require.NoError(t, store.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "Vault", Passthrough: true},
+		{Name: "DBService"},
+	}))
+
+	assert.True(t, store.IsPassthrough("Vault"))
+	assert.False(t, store.IsPassthrough("DBService"))
+
+	err := store.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "Broken", Passthrough: true, UpstreamTLS: &loadbalancer.UpstreamTLSConfig{}},
+	})
+	assert.ErrorIs(t, err, loadbalancer.ErrPassthroughUpstreamTLS)
+}
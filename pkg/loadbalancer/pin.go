@@ -0,0 +1,79 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// PinTypeCertificate pins the SHA-256 fingerprint of the whole DER certificate, as printed by
+	// `openssl x509 -noout -fingerprint -sha256`. It changes with every certificate issued.
+	PinTypeCertificate = "cert"
+	// PinTypeSPKI pins the SHA-256 fingerprint of the certificate's SubjectPublicKeyInfo, like
+	// the pin-sha256 of HPKP. It survives reissuing a certificate for the same key.
+	PinTypeSPKI = "spki"
+)
+
+// certificatePin is a SHA-256 fingerprint a client certificate must match.
+type certificatePin struct {
+	pinType     string
+	fingerprint []byte
+}
+
+// parseCertificatePin parses a pin of the form "<type>:<fingerprint>", where type is "cert" or
+// "spki" and the fingerprint is the SHA-256 digest in hex, optionally separated by colons, or in
+// base64.
+func parseCertificatePin(pin string) (certificatePin, error) {
+	pinType, fingerprint, ok := strings.Cut(pin, ":")
+	if !ok {
+		return certificatePin{}, ErrInvalidCertificatePin(pin)
+	}
+
+	switch pinType {
+	case PinTypeCertificate, PinTypeSPKI:
+	default:
+		return certificatePin{}, ErrInvalidCertificatePin(pin)
+	}
+
+	digest, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(digest) != sha256.Size {
+		digest, err = base64.StdEncoding.DecodeString(fingerprint)
+		if err != nil || len(digest) != sha256.Size {
+			return certificatePin{}, ErrInvalidCertificatePin(pin)
+		}
+	}
+
+	return certificatePin{pinType: pinType, fingerprint: digest}, nil
+}
+
+func parseCertificatePins(pins []string) ([]certificatePin, error) {
+	parsed := make([]certificatePin, 0, len(pins))
+
+	for _, pin := range pins {
+		certPin, err := parseCertificatePin(pin)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, certPin)
+	}
+
+	return parsed, nil
+}
+
+// matches reports whether cert has the pinned fingerprint.
+func (p certificatePin) matches(cert *x509.Certificate) bool {
+	var digest [sha256.Size]byte
+
+	if p.pinType == PinTypeSPKI {
+		digest = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	} else {
+		digest = sha256.Sum256(cert.Raw)
+	}
+
+	return subtle.ConstantTimeCompare(digest[:], p.fingerprint) == 1
+}
@@ -0,0 +1,97 @@
+package loadbalancer_test
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func certPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.Raw)
+
+	return "cert:" + hex.EncodeToString(digest[:])
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return "spki:" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// opensslFingerprint formats the fingerprint of cert like `openssl x509 -fingerprint -sha256`.
+func opensslFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.Raw)
+	parts := make([]string, 0, len(digest))
+
+	for _, b := range digest {
+		parts = append(parts, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func pinnedClient(t *testing.T, pins ...string) *loadbalancer.ClientInfo {
+	t.Helper()
+
+	store := loadbalancer.NewClientStore()
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1", Pins: pins},
+	}))
+
+	clientInfo, ok := store.GetClient("clientA")
+	require.True(t, ok)
+
+	return clientInfo
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca := newTestCA(t)
+	oldCert := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}})
+	newCert := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}})
+
+	// Same name and CA, but not pinned.
+	impostor := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}}).Leaf
+
+	tests := []struct {
+		name string
+		pins []string
+	}{
+		{"certificate", []string{certPin(oldCert.Leaf)}},
+		{"certificate in openssl format", []string{"cert:" + opensslFingerprint(oldCert.Leaf)}},
+		{"public key", []string{spkiPin(oldCert.Leaf)}},
+		{"rotation", []string{certPin(newCert.Leaf), certPin(oldCert.Leaf)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientInfo := pinnedClient(t, test.pins...)
+
+			assert.NoError(t, clientInfo.VerifyPins(oldCert.Leaf))
+			assert.ErrorIs(t, clientInfo.VerifyPins(impostor), loadbalancer.ErrCertificateNotPinned)
+		})
+	}
+
+	// A client without pins accepts any certificate.
+	assert.NoError(t, pinnedClient(t).VerifyPins(impostor))
+}
+
+func TestAddClientsFromClientConfigListInvalidPin(t *testing.T) {
+	for _, pin := range []string{
+		"a1b2",
+		"sha1:" + strings.Repeat("ab", sha256.Size),
+		"cert:" + strings.Repeat("ab", sha256.Size-1),
+		"spki:not base64",
+	} {
+		store := loadbalancer.NewClientStore()
+		err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{{ClientId: "clientA", Pins: []string{pin}}})
+		assert.Error(t, err, pin)
+	}
+}
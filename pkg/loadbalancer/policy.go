@@ -0,0 +1,403 @@
+package loadbalancer
+
+import (
+	"crypto/x509"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PolicyEffectAllow grants access to the target groups of a policy rule.
+	PolicyEffectAllow = "allow"
+	// PolicyEffectDeny refuses access to the target groups of a policy rule.
+	PolicyEffectDeny = "deny"
+
+	minutesPerDay = 24 * 60
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// AuthzRequest is what a connection is authorized on.
+type AuthzRequest struct {
+	// ClientID is the ID of the client the certificate identifies as. It is empty for the
+	// connections of the passthrough listener.
+	ClientID string
+	// Certificate is the client's leaf certificate, nil for the connections of the passthrough
+	// listener.
+	Certificate *x509.Certificate
+	// SourceIP is the IP the connection comes from. It is invalid if unknown.
+	SourceIP netip.Addr
+	// ServerName is the TLS server name (SNI) the client asked for.
+	ServerName string
+	// Time is when the connection is made.
+	Time time.Time
+}
+
+// PolicyDecision is the outcome of a policy evaluation.
+type PolicyDecision struct {
+	Allowed bool
+	// Rule is the name of the rule that decided, or "" if no rule matched.
+	Rule string
+}
+
+// Policy is an ordered list of authorization rules. For each target group, the first rule that
+// matches a request decides whether it is allowed. Requests no rule matches are denied.
+type Policy struct {
+	rules []*policyRule
+}
+
+// policyRule is a compiled PolicyRuleConfig.
+type policyRule struct {
+	name                string
+	allow               bool
+	targetGroups        []string
+	clientIDs           []string
+	commonNames         []string
+	organizations       []string
+	organizationalUnits []string
+	sans                []ClientIdentity
+	sourceCIDRs         []netip.Prefix
+	serverNames         []string
+	timeWindows         []timeWindow
+}
+
+// timeWindow is a daily window of time, in minutes since midnight of its location.
+type timeWindow struct {
+	days     []time.Weekday
+	start    int
+	end      int
+	location *time.Location
+}
+
+// NewPolicy compiles the rules of a policy. It returns nil if there are no rules.
+func NewPolicy(configs []PolicyRuleConfig) (*Policy, error) {
+	if len(configs) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	policy := &Policy{}
+
+	for i := range configs {
+		rule, err := newPolicyRule(&configs[i])
+		if err != nil {
+			return nil, ErrInvalidPolicyRule(configs[i].Name, err)
+		}
+
+		if rule.name == "" {
+			rule.name = "#" + strconv.Itoa(i+1)
+		}
+
+		policy.rules = append(policy.rules, rule)
+	}
+
+	return policy, nil
+}
+
+func newPolicyRule(config *PolicyRuleConfig) (*policyRule, error) {
+	rule := &policyRule{
+		name:                config.Name,
+		targetGroups:        config.TargetGroups,
+		clientIDs:           config.ClientIDs,
+		commonNames:         config.CommonNames,
+		organizations:       config.Organizations,
+		organizationalUnits: config.OrganizationalUnits,
+	}
+
+	switch config.Effect {
+	case PolicyEffectAllow:
+		rule.allow = true
+	case PolicyEffectDeny:
+	default:
+		return nil, ErrUnknownPolicyEffect(config.Effect)
+	}
+
+	for _, patterns := range [][]string{config.ClientIDs, config.CommonNames, config.Organizations,
+		config.OrganizationalUnits, config.ServerNames} {
+		if err := validateGlobs(patterns); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serverName := range config.ServerNames {
+		rule.serverNames = append(rule.serverNames, normalizeServerName(serverName))
+	}
+
+	for _, san := range config.SANs {
+		identityType, value, ok := strings.Cut(san, ":")
+		if !ok || identityType == IdentityTypeCommonName {
+			return nil, ErrInvalidPolicySAN(san)
+		}
+
+		if _, err := parseIdentityType(identityType); err != nil {
+			return nil, err
+		}
+
+		if err := validateGlobs([]string{value}); err != nil {
+			return nil, err
+		}
+
+		rule.sans = append(rule.sans, ClientIdentity{Type: identityType, Value: value})
+	}
+
+	for _, cidr := range config.SourceCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, ErrInvalidCIDR(cidr, err)
+		}
+
+		rule.sourceCIDRs = append(rule.sourceCIDRs, prefix.Masked())
+	}
+
+	for i := range config.TimeWindows {
+		window, err := newTimeWindow(&config.TimeWindows[i])
+		if err != nil {
+			return nil, err
+		}
+
+		rule.timeWindows = append(rule.timeWindows, window)
+	}
+
+	return rule, nil
+}
+
+func newTimeWindow(config *TimeWindowConfig) (timeWindow, error) {
+	window := timeWindow{location: time.UTC}
+
+	for _, day := range config.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return timeWindow{}, ErrInvalidTimeWindow(ErrUnknownWeekday(day))
+		}
+
+		window.days = append(window.days, weekday)
+	}
+
+	var err error
+
+	if window.start, err = parseTimeOfDay(config.Start); err != nil {
+		return timeWindow{}, ErrInvalidTimeWindow(err)
+	}
+
+	if window.end, err = parseTimeOfDay(config.End); err != nil {
+		return timeWindow{}, ErrInvalidTimeWindow(err)
+	}
+
+	if config.TimeZone != "" {
+		if window.location, err = time.LoadLocation(config.TimeZone); err != nil {
+			return timeWindow{}, ErrInvalidTimeWindow(err)
+		}
+	}
+
+	return window, nil
+}
+
+// parseTimeOfDay parses "15:04" into minutes since midnight. "24:00" is the end of the day.
+func parseTimeOfDay(value string) (int, error) {
+	if value == "24:00" {
+		return minutesPerDay, nil
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validateGlobs checks the syntax of glob patterns.
+func validateGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return ErrInvalidGlob(pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Evaluate decides whether a request may access a target group.
+func (p *Policy) Evaluate(request *AuthzRequest, targetGroup string) PolicyDecision {
+	for _, rule := range p.rules {
+		if len(rule.targetGroups) > 0 && !slices.Contains(rule.targetGroups, targetGroup) {
+			continue
+		}
+
+		if rule.matches(request) {
+			return PolicyDecision{Allowed: rule.allow, Rule: rule.name}
+		}
+	}
+
+	return PolicyDecision{}
+}
+
+// SelectTargetGroup chooses the target group of a request by its TLS server name and checks that
+// the policy allows it, like the package level SelectTargetGroup does with the client's allowed
+// target groups. If the server name is not mapped, the request goes to the only target group the
+// policy allows it, and is rejected if there are several. Passthrough target groups are not
+// candidates, as they are only reachable through the passthrough listener.
+func (p *Policy) SelectTargetGroup(request *AuthzRequest, targetGroupsStore *TargetGroupsStore) (string, error) {
+	if targetGroupsStore == nil {
+		return "", ErrNilTargetGroupsStore
+	}
+
+	if targetGroup, ok := targetGroupsStore.GetTargetGroupByServerName(request.ServerName); ok {
+		if decision := p.Evaluate(request, targetGroup); !decision.Allowed {
+			return "", ErrPolicyDenied(request.ClientID, targetGroup, decision.Rule)
+		}
+
+		return targetGroup, nil
+	}
+
+	var allowed []string
+
+	for targetGroup := range targetGroupsStore.GetTargetGroups() {
+		if targetGroupsStore.IsPassthrough(targetGroup) {
+			continue
+		}
+
+		if p.Evaluate(request, targetGroup).Allowed {
+			allowed = append(allowed, targetGroup)
+		}
+	}
+
+	if len(allowed) == 1 {
+		return allowed[0], nil
+	}
+
+	return "", ErrNoTargetGroupForServerName(request.ClientID, request.ServerName)
+}
+
+// matches reports whether a request satisfies all the conditions of the rule. A condition matches
+// if any of its values does, and a condition without values always matches. A request without a
+// client, like those of the passthrough listener, matches no rule with client conditions.
+func (r *policyRule) matches(request *AuthzRequest) bool {
+	cert := request.Certificate
+	if cert == nil {
+		if request.ClientID == "" && r.hasClientConditions() {
+			return false
+		}
+
+		cert = &x509.Certificate{}
+	}
+
+	return matchesAnyGlob(r.clientIDs, request.ClientID) &&
+		matchesAnyGlob(r.commonNames, cert.Subject.CommonName) &&
+		matchesAnyGlob(r.organizations, cert.Subject.Organization...) &&
+		matchesAnyGlob(r.organizationalUnits, cert.Subject.OrganizationalUnit...) &&
+		r.matchesSANs(cert) &&
+		r.matchesSourceIP(request.SourceIP) &&
+		matchesAnyGlob(r.serverNames, normalizeServerName(request.ServerName)) &&
+		r.matchesTime(request.Time)
+}
+
+// hasClientConditions reports whether the rule has conditions on the client or its certificate.
+func (r *policyRule) hasClientConditions() bool {
+	return len(r.clientIDs) > 0 || len(r.commonNames) > 0 || len(r.organizations) > 0 ||
+		len(r.organizationalUnits) > 0 || len(r.sans) > 0
+}
+
+func (r *policyRule) matchesSANs(cert *x509.Certificate) bool {
+	if len(r.sans) == 0 {
+		return true
+	}
+
+	identities := GetCertificateIdentities(cert, []string{IdentityTypeURI, IdentityTypeDNS, IdentityTypeEmail})
+
+	for _, san := range r.sans {
+		for _, identity := range identities {
+			if identity.Type != san.Type {
+				continue
+			}
+
+			if matched, _ := path.Match(san.Value, identity.Value); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *policyRule) matchesSourceIP(ip netip.Addr) bool {
+	if len(r.sourceCIDRs) == 0 {
+		return true
+	}
+
+	for _, prefix := range r.sourceCIDRs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *policyRule) matchesTime(t time.Time) bool {
+	if len(r.timeWindows) == 0 {
+		return true
+	}
+
+	for _, window := range r.timeWindows {
+		if window.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains reports whether t is in the window. A window whose end is before its start spans
+// midnight, and its days are those it starts on: the part after midnight belongs to the day before.
+func (w timeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if w.start <= w.end {
+		if minute < w.start || minute >= w.end {
+			return false
+		}
+	} else {
+		if minute < w.start && minute >= w.end {
+			return false
+		}
+
+		if minute < w.end {
+			day = (day + 6) % 7
+		}
+	}
+
+	return len(w.days) == 0 || slices.Contains(w.days, day)
+}
+
+// matchesAnyGlob reports whether any of the values matches any of the patterns. No patterns match
+// anything.
+func matchesAnyGlob(patterns []string, values ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
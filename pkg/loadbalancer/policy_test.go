@@ -0,0 +1,248 @@
+package loadbalancer_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{
+		{
+			Name:                "no-contractors",
+			Effect:              loadbalancer.PolicyEffectDeny,
+			TargetGroups:        []string{"DBService"},
+			OrganizationalUnits: []string{"Contractors"},
+		},
+		{
+			Name:          "bar-org-db-business-hours",
+			Effect:        loadbalancer.PolicyEffectAllow,
+			TargetGroups:  []string{"DBService"},
+			Organizations: []string{"BarOrg"},
+			SourceCIDRs:   []string{"10.0.0.0/8"},
+			TimeWindows: []loadbalancer.TimeWindowConfig{
+				{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"},
+			},
+		},
+		{
+			Name:   "exporters",
+			Effect: loadbalancer.PolicyEffectAllow,
+			SANs:   []string{"uri:spiffe://corp/ns/*/sa/exporter"},
+		},
+		{
+			Name:         "frontend-by-sni",
+			Effect:       loadbalancer.PolicyEffectAllow,
+			TargetGroups: []string{"FrontEndService"},
+			CommonNames:  []string{"*.bardomain.com"},
+			ServerNames:  []string{"frontend.loadbalancer.foodomain.com"},
+		},
+	})
+	require.NoError(t, err)
+
+	// A Wednesday, in and out of business hours.
+	businessHours := time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC)
+	evening := time.Date(2024, time.May, 15, 18, 0, 0, 0, time.UTC)
+	saturday := time.Date(2024, time.May, 18, 10, 30, 0, 0, time.UTC)
+
+	barOrg := &x509.Certificate{Subject: pkix.Name{CommonName: "clientA.bardomain.com", Organization: []string{"BarOrg"}}}
+	contractor := &x509.Certificate{Subject: pkix.Name{
+		Organization:       []string{"BarOrg"},
+		OrganizationalUnit: []string{"Contractors"},
+	}}
+	exporter := &x509.Certificate{URIs: []*url.URL{spiffeID(t, "spiffe://corp/ns/reports/sa/exporter")}}
+
+	internal := netip.MustParseAddr("10.1.2.3")
+	external := netip.MustParseAddr("192.0.2.1")
+
+	tests := []struct {
+		name        string
+		request     loadbalancer.AuthzRequest
+		targetGroup string
+		allowed     bool
+		rule        string
+	}{
+		{
+			"all conditions match",
+			loadbalancer.AuthzRequest{Certificate: barOrg, SourceIP: internal, Time: businessHours},
+			"DBService", true, "bar-org-db-business-hours",
+		},
+		{
+			"outside business hours",
+			loadbalancer.AuthzRequest{Certificate: barOrg, SourceIP: internal, Time: evening},
+			"DBService", false, "",
+		},
+		{
+			"on the weekend",
+			loadbalancer.AuthzRequest{Certificate: barOrg, SourceIP: internal, Time: saturday},
+			"DBService", false, "",
+		},
+		{
+			"from outside the CIDR",
+			loadbalancer.AuthzRequest{Certificate: barOrg, SourceIP: external, Time: businessHours},
+			"DBService", false, "",
+		},
+		{
+			"first matching rule wins",
+			loadbalancer.AuthzRequest{Certificate: contractor, SourceIP: internal, Time: businessHours},
+			"DBService", false, "no-contractors",
+		},
+		{
+			"rule for all target groups",
+			loadbalancer.AuthzRequest{Certificate: exporter, Time: evening},
+			"DBService", true, "exporters",
+		},
+		{
+			"server name",
+			loadbalancer.AuthzRequest{Certificate: barOrg, ServerName: "Frontend.LoadBalancer.FooDomain.com."},
+			"FrontEndService", true, "frontend-by-sni",
+		},
+		{
+			"other server name",
+			loadbalancer.AuthzRequest{Certificate: barOrg, ServerName: "db.loadbalancer.foodomain.com"},
+			"FrontEndService", false, "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := policy.Evaluate(&test.request, test.targetGroup)
+			assert.Equal(t, test.allowed, decision.Allowed)
+			assert.Equal(t, test.rule, decision.Rule)
+		})
+	}
+}
+
+func TestPolicyTimeWindowAcrossMidnight(t *testing.T) {
+	policy, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{{
+		Effect:      loadbalancer.PolicyEffectAllow,
+		TimeWindows: []loadbalancer.TimeWindowConfig{{Start: "22:00", End: "02:00", TimeZone: "UTC"}},
+	}})
+	require.NoError(t, err)
+
+	for hour, allowed := range map[int]bool{21: false, 22: true, 1: true, 2: false} {
+		request := &loadbalancer.AuthzRequest{Time: time.Date(2024, time.May, 15, hour, 0, 0, 0, time.UTC)}
+		assert.Equal(t, allowed, policy.Evaluate(request, "DBService").Allowed, hour)
+	}
+}
+
+func TestPolicyTimeWindowAcrossMidnightDays(t *testing.T) {
+	policy, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{{
+		Effect: loadbalancer.PolicyEffectAllow,
+		TimeWindows: []loadbalancer.TimeWindowConfig{
+			{Days: []string{"fri"}, Start: "22:00", End: "02:00", TimeZone: "UTC"},
+		},
+	}})
+	require.NoError(t, err)
+
+	// The window starts on Friday, May 17 2024, and ends on Saturday.
+	for _, tc := range []struct {
+		time    time.Time
+		allowed bool
+	}{
+		{time.Date(2024, time.May, 17, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, time.May, 17, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, time.May, 18, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, time.May, 18, 23, 0, 0, 0, time.UTC), false},
+	} {
+		request := &loadbalancer.AuthzRequest{Time: tc.time}
+		assert.Equal(t, tc.allowed, policy.Evaluate(request, "DBService").Allowed, tc.time)
+	}
+}
+
+func TestPolicySelectTargetGroup(t *testing.T) {
+	targetGroupsStore := loadbalancer.NewTargetGroupsStore(nil, nil)
+	require.NoError(t, targetGroupsStore.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "FrontEndService", ServerNames: []string{"frontend.loadbalancer.foodomain.com"}},
+		{Name: "DBService", ServerNames: []string{"db.loadbalancer.foodomain.com"}},
+	}))
+
+	policy, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{
+		{Effect: loadbalancer.PolicyEffectAllow, TargetGroups: []string{"DBService"}, ClientIDs: []string{"client*"}},
+	})
+	require.NoError(t, err)
+
+	targetGroup, err := policy.SelectTargetGroup(
+		&loadbalancer.AuthzRequest{ClientID: "clientA", ServerName: "db.loadbalancer.foodomain.com"}, targetGroupsStore)
+	require.NoError(t, err)
+	assert.Equal(t, "DBService", targetGroup)
+
+	_, err = policy.SelectTargetGroup(
+		&loadbalancer.AuthzRequest{ClientID: "clientA", ServerName: "frontend.loadbalancer.foodomain.com"},
+		targetGroupsStore)
+	assert.ErrorIs(t, err, loadbalancer.ErrDeniedByPolicy)
+
+	// Without a mapped server name, the only allowed target group is used.
+	targetGroup, err = policy.SelectTargetGroup(&loadbalancer.AuthzRequest{ClientID: "clientA"}, targetGroupsStore)
+	require.NoError(t, err)
+	assert.Equal(t, "DBService", targetGroup)
+}
+
+func TestPolicySelectTargetGroupSkipsPassthrough(t *testing.T) {
+	targetGroupsStore := loadbalancer.NewTargetGroupsStore(nil, nil)
+	require.NoError(t, targetGroupsStore.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "DBService", ServerNames: []string{"db.loadbalancer.foodomain.com"}},
+		{Name: "Vault", ServerNames: []string{"vault.loadbalancer.foodomain.com"}, Passthrough: true},
+	}))
+
+	// The rule allows both target groups, but only DBService is reachable with TLS terminated.
+	policy, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{
+		{Effect: loadbalancer.PolicyEffectAllow, ClientIDs: []string{"client*"}},
+	})
+	require.NoError(t, err)
+
+	targetGroup, err := policy.SelectTargetGroup(&loadbalancer.AuthzRequest{ClientID: "clientA"}, targetGroupsStore)
+	require.NoError(t, err)
+	assert.Equal(t, "DBService", targetGroup)
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	for name, rule := range map[string]loadbalancer.PolicyRuleConfig{
+		"effect": {Effect: "permit"},
+		"cidr":   {Effect: "allow", SourceCIDRs: []string{"10.0.0.0/33"}},
+		"san":    {Effect: "allow", SANs: []string{"ip:10.0.0.1"}},
+		"glob":   {Effect: "allow", CommonNames: []string{"[a-"}},
+		"day":    {Effect: "allow", TimeWindows: []loadbalancer.TimeWindowConfig{{Days: []string{"monday"}}}},
+		"time":   {Effect: "allow", TimeWindows: []loadbalancer.TimeWindowConfig{{Start: "9am", End: "17:00"}}},
+		"time zone": {Effect: "allow", TimeWindows: []loadbalancer.TimeWindowConfig{
+			{Start: "09:00", End: "17:00", TimeZone: "Mars/Olympus"},
+		}},
+	} {
+		_, err := loadbalancer.NewPolicy([]loadbalancer.PolicyRuleConfig{rule})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestGetClientByCertificateUnknownClients(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1"},
+	}))
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "clientB", Organization: []string{"BarOrg"}},
+		DNSNames: []string{"clientB.bardomain.com"},
+	}
+
+	_, _, ok := store.GetClientByCertificate(cert)
+	assert.False(t, ok)
+
+	store.SetIdentifyUnknownClients(true)
+
+	clientInfo, identity, ok := store.GetClientByCertificate(cert)
+	require.True(t, ok)
+	assert.Equal(t, "dns:clientB.bardomain.com", identity.String())
+	assert.Empty(t, clientInfo.GetAllowedTargetGroups())
+	assert.Nil(t, clientInfo.GetLimiter())
+
+	// Unknown clients are not kept, whether their connections end up allowed or denied.
+	again, _, _ := store.GetClientByCertificate(cert)
+	assert.NotSame(t, clientInfo, again)
+	assert.Equal(t, clientInfo.GetClientID(), again.GetClientID())
+}
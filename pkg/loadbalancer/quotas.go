@@ -0,0 +1,204 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+)
+
+const (
+	// QuotaResourceConnections counts the connections of a client.
+	QuotaResourceConnections = "connections"
+	// QuotaResourceBytes counts the bytes proxied for a client in both directions.
+	QuotaResourceBytes = "bytes"
+
+	defaultQuotaFlushInterval = 10 * time.Second
+)
+
+// clientQuota is a long horizon quota of a client.
+type clientQuota struct {
+	resource string
+	period   ratelimit.QuotaPeriod
+	limit    int64
+}
+
+func newClientQuota(config QuotaConfig) (clientQuota, error) {
+	switch config.Resource {
+	case QuotaResourceConnections, QuotaResourceBytes:
+	default:
+		return clientQuota{}, ErrUnknownQuotaResource(config.Resource)
+	}
+
+	period, err := ratelimit.ParseQuotaPeriod(config.Period)
+	if err != nil {
+		return clientQuota{}, err
+	}
+
+	return clientQuota{resource: config.Resource, period: period, limit: config.Limit}, nil
+}
+
+// key is the key the quota's usage is tracked under.
+func (q clientQuota) key(clientID string) string {
+	return clientID + "/" + q.resource + "/" + string(q.period)
+}
+
+// QuotaStatus is the usage of a client quota in its current period.
+type QuotaStatus struct {
+	Resource    string
+	Period      string
+	PeriodStart time.Time
+	Limit       int64
+	Remaining   int64
+}
+
+// QuotasStore tracks the usage of the clients' long horizon quotas and persists it.
+type QuotasStore struct {
+	tracker *ratelimit.QuotaTracker
+	clock   clock.Clock
+}
+
+// NewQuotasStore creates a QuotasStore persisting usage to the file at storePath. An empty path
+// keeps usage in memory only. Periods are tracked with clk, which defaults to the time package if
+// nil.
+func NewQuotasStore(storePath string, clk clock.Clock) (*QuotasStore, error) {
+	var storage ratelimit.QuotaStorage
+	if storePath != "" {
+		storage = ratelimit.NewFileQuotaStorage(storePath)
+	}
+
+	tracker, err := ratelimit.NewQuotaTracker(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QuotasStore{tracker: tracker, clock: clock.OrDefault(clk)}, nil
+}
+
+// CheckConnection checks the client's quotas for a new connection. The connection is rejected if
+// any quota is used up. It is only counted against the connection quotas by CountConnection, once
+// it reaches an upstream server, so that connections refused later on are not billed.
+func (q *QuotasStore) CheckConnection(clientInfo *ClientInfo) error {
+	now := q.clock.Now()
+	clientID := clientInfo.GetClientID()
+
+	for _, quota := range clientInfo.getQuotas() {
+		remaining := q.tracker.Remaining(quota.key(clientID), quota.period, quota.limit, now)
+		if remaining <= 0 {
+			return ErrQuotaExceeded(clientID, quota.resource, string(quota.period))
+		}
+	}
+
+	return nil
+}
+
+// CountConnection counts a connection that passed CheckConnection against the client's
+// connection quotas. Connections checked concurrently may take a quota past its limit by as many
+// connections, the next ones are then rejected.
+func (q *QuotasStore) CountConnection(clientInfo *ClientInfo) {
+	now := q.clock.Now()
+
+	for _, quota := range clientInfo.getQuotas() {
+		if quota.resource == QuotaResourceConnections {
+			q.tracker.Add(quota.key(clientInfo.GetClientID()), quota.period, 1, now)
+		}
+	}
+}
+
+// CountBytes wraps a reader of one of the client's streams so that the bytes read are counted
+// against the client's byte quotas. The reader is returned unchanged if the client has none.
+func (q *QuotasStore) CountBytes(clientInfo *ClientInfo, reader io.Reader) io.Reader {
+	var byteQuotas []clientQuota
+
+	for _, quota := range clientInfo.getQuotas() {
+		if quota.resource == QuotaResourceBytes {
+			byteQuotas = append(byteQuotas, quota)
+		}
+	}
+
+	if len(byteQuotas) == 0 {
+		return reader
+	}
+
+	return &quotaCountingReader{
+		reader:   reader,
+		tracker:  q.tracker,
+		clientID: clientInfo.GetClientID(),
+		quotas:   byteQuotas,
+		clock:    q.clock,
+	}
+}
+
+// GetQuotaStatus returns the usage of each of the client's quotas.
+func (q *QuotasStore) GetQuotaStatus(clientInfo *ClientInfo) []QuotaStatus {
+	now := q.clock.Now()
+	quotas := clientInfo.getQuotas()
+	status := make([]QuotaStatus, 0, len(quotas))
+
+	for _, quota := range quotas {
+		status = append(status, QuotaStatus{
+			Resource:    quota.resource,
+			Period:      string(quota.period),
+			PeriodStart: quota.period.Start(now),
+			Limit:       quota.limit,
+			Remaining:   q.tracker.Remaining(quota.key(clientInfo.GetClientID()), quota.period, quota.limit, now),
+		})
+	}
+
+	return status
+}
+
+// Flush persists the quota usage.
+func (q *QuotasStore) Flush() error {
+	return q.tracker.Flush()
+}
+
+// Run persists the quota usage every interval until ctx is done, and one last time after that.
+// Failed flushes are reported to onError.
+func (q *QuotasStore) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = defaultQuotaFlushInterval
+	}
+
+	ticker := q.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := q.Flush(); err != nil {
+				onError(err)
+			}
+
+			return
+		case <-ticker.C():
+			if err := q.Flush(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// quotaCountingReader counts the bytes read against byte quotas.
+type quotaCountingReader struct {
+	reader   io.Reader
+	tracker  *ratelimit.QuotaTracker
+	clientID string
+	quotas   []clientQuota
+	clock    clock.Clock
+}
+
+func (r *quotaCountingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		now := r.clock.Now()
+
+		for _, quota := range r.quotas {
+			r.tracker.Add(quota.key(r.clientID), quota.period, int64(n), now)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,94 @@
+package loadbalancer_test
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newQuotaClient(t *testing.T, quotas ...loadbalancer.QuotaConfig) *loadbalancer.ClientInfo {
+	t.Helper()
+
+	store := loadbalancer.NewClientStore()
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1", RequestsPerSecond: 100, Quotas: quotas},
+	})
+	require.NoError(t, err)
+
+	clientInfo, ok := store.GetClient("clientA")
+	require.True(t, ok)
+
+	return clientInfo
+}
+
+func TestQuotasStoreCheckConnection(t *testing.T) {
+	clientInfo := newQuotaClient(t, loadbalancer.QuotaConfig{Resource: "connections", Period: "day", Limit: 2})
+
+	store, err := loadbalancer.NewQuotasStore("", nil)
+	require.NoError(t, err)
+
+	// Checking alone does not use up the quota.
+	for range 3 {
+		require.NoError(t, store.CheckConnection(clientInfo))
+	}
+
+	store.CountConnection(clientInfo)
+	assert.NoError(t, store.CheckConnection(clientInfo))
+
+	store.CountConnection(clientInfo)
+	assert.ErrorIs(t, store.CheckConnection(clientInfo), loadbalancer.ErrQuotaUsedUp)
+
+	status := store.GetQuotaStatus(clientInfo)
+	require.Len(t, status, 1)
+	assert.Equal(t, "connections", status[0].Resource)
+	assert.Equal(t, "day", status[0].Period)
+	assert.Equal(t, int64(0), status[0].Remaining)
+}
+
+func TestQuotasStoreCountBytes(t *testing.T) {
+	clientInfo := newQuotaClient(t, loadbalancer.QuotaConfig{Resource: "bytes", Period: "month", Limit: 10})
+
+	store, err := loadbalancer.NewQuotasStore("", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, store.CheckConnection(clientInfo))
+
+	_, err = io.Copy(io.Discard, store.CountBytes(clientInfo, strings.NewReader("0123456789ab")))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(-2), store.GetQuotaStatus(clientInfo)[0].Remaining)
+	assert.ErrorIs(t, store.CheckConnection(clientInfo), loadbalancer.ErrQuotaUsedUp)
+}
+
+func TestQuotasStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	clientInfo := newQuotaClient(t, loadbalancer.QuotaConfig{Resource: "connections", Period: "hour", Limit: 5})
+
+	store, err := loadbalancer.NewQuotasStore(path, nil)
+	require.NoError(t, err)
+
+	store.CountConnection(clientInfo)
+	store.CountConnection(clientInfo)
+	require.NoError(t, store.Flush())
+
+	// Usage survives a restart.
+	store, err = loadbalancer.NewQuotasStore(path, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3), store.GetQuotaStatus(clientInfo)[0].Remaining)
+}
+
+func TestNewClientQuotaInvalid(t *testing.T) {
+	store := loadbalancer.NewClientStore()
+
+	err := store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", Quotas: []loadbalancer.QuotaConfig{{Resource: "requests", Period: "day", Limit: 1}}},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown quota resource requests")
+}
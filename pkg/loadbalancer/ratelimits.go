@@ -0,0 +1,360 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+)
+
+const (
+	// RateLimitLevelSource is the level of the per source IP rate limit checked before the TLS
+	// handshake.
+	RateLimitLevelSource = "source"
+	// RateLimitLevelGlobal is the level of the listener wide rate limit.
+	RateLimitLevelGlobal = "global"
+	// RateLimitLevelTargetGroup is the level of the per target group rate limits.
+	RateLimitLevelTargetGroup = "targetGroup"
+	// RateLimitLevelClient is the level of the per client rate limits.
+	RateLimitLevelClient = "client"
+)
+
+// RateLimitsStore holds the listener and target group rate limiters and admits connections
+// against them together with the client's own limiter.
+type RateLimitsStore struct {
+	hierarchy    ratelimit.Hierarchy
+	source       *SourceRateLimiter
+	global       *sharedRateLimit
+	targetGroups map[string]*sharedRateLimit
+	// rejections is a map of rate limit level to the number of connections it rejected.
+	rejections map[string]uint64
+	// shadowRejections is a map of rate limit level to the number of connections it would have
+	// rejected in dry run.
+	shadowRejections map[string]uint64
+	mu               sync.RWMutex
+}
+
+// sharedRateLimit is a rate limit shared by several clients.
+type sharedRateLimit struct {
+	limiter      ratelimit.Limiter
+	rejectAction *RejectAction
+	dryRun       bool
+}
+
+// ShadowDecision is what the dry run rate limits decided for a connection, next to the actual
+// outcome of Admit.
+type ShadowDecision struct {
+	// Evaluated is true if any dry run rate limit applied to the connection.
+	Evaluated bool
+	// RejectedLevels are the dry run levels that would have rejected the connection.
+	RejectedLevels []string
+}
+
+// Rejected reports whether the connection would have been rejected if the dry run rate limits
+// were enforced.
+func (s ShadowDecision) Rejected() bool {
+	return len(s.RejectedLevels) > 0
+}
+
+// NewRateLimitsStore creates the rate limiters for the listener and for every target group that
+// has a rate limit configured. The limiters tell the time with clk, which defaults to the time
+// package if nil.
+func NewRateLimitsStore(
+	global *RateLimitConfig,
+	targetGroups []TargetGroupConfig,
+	clk clock.Clock,
+) (*RateLimitsStore, error) {
+	store := &RateLimitsStore{
+		targetGroups:     make(map[string]*sharedRateLimit),
+		rejections:       make(map[string]uint64),
+		shadowRejections: make(map[string]uint64),
+	}
+
+	rateLimit, err := newSharedRateLimit(global, clk)
+	if err != nil {
+		return nil, err
+	}
+
+	store.global = rateLimit
+
+	for _, tg := range targetGroups {
+		rateLimit, err := newSharedRateLimit(tg.RateLimit, clk)
+		if err != nil {
+			return nil, ErrInvalidTargetGroupConfig(tg.Name, err)
+		}
+
+		if rateLimit != nil {
+			store.targetGroups[tg.Name] = rateLimit
+		}
+	}
+
+	return store, nil
+}
+
+// newSharedRateLimit builds the limiter and reject action for a rate limit config. It returns nil
+// if no rate limit is configured.
+func newSharedRateLimit(config *RateLimitConfig, clk clock.Clock) (*sharedRateLimit, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	algorithm, err := ratelimit.ParseAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := ratelimit.New(algorithm, ratelimit.Params{
+		Limit: config.RequestsPerSecond,
+		Burst: config.Burst,
+		Clock: clk,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rejectAction, err := newRejectAction(config.Rejection, clk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sharedRateLimit{limiter: limiter, rejectAction: rejectAction, dryRun: config.DryRun}, nil
+}
+
+func (s *sharedRateLimit) getLimiter() ratelimit.Limiter {
+	if s == nil {
+		return nil
+	}
+
+	return s.limiter
+}
+
+func (s *sharedRateLimit) getDryRun() bool {
+	return s != nil && s.dryRun
+}
+
+func (s *sharedRateLimit) getRejectAction() *RejectAction {
+	if s == nil {
+		return nil
+	}
+
+	return s.rejectAction
+}
+
+// SetSourceRateLimiter sets the per source IP rate limiter checked by AdmitSource.
+func (r *RateLimitsStore) SetSourceRateLimiter(source *SourceRateLimiter) {
+	r.source = source
+}
+
+// AdmitSource checks the per source IP rate limit for a connection that was just accepted,
+// before its TLS handshake.
+func (r *RateLimitsStore) AdmitSource(remoteAddr net.Addr) error {
+	if r.source == nil {
+		return nil
+	}
+
+	source, ok := r.source.Allow(remoteAddr)
+	if ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	r.rejections[RateLimitLevelSource]++
+	r.mu.Unlock()
+
+	return &RateLimitError{Level: RateLimitLevelSource, Key: source, Action: defaultRejectAction}
+}
+
+// Admit checks the global, target group and client rate limits for a new connection of the
+// client to the target group. Either all levels account for the connection or none does. A
+// rejection is returned as a *RateLimitError naming the level that rejected the connection and
+// what to do with it.
+//
+// If the client is in shape mode, Admit first waits for up to the client's max queue delay until
+// its own limit allows the connection, and only the global and target group levels can drop it.
+func (r *RateLimitsStore) Admit(ctx context.Context, clientInfo *ClientInfo, targetGroup string) error {
+	_, err := r.AdmitWithShadow(ctx, clientInfo, targetGroup)
+
+	return err
+}
+
+// AdmitWithShadow is like Admit but also returns what the dry run rate limits decided for the
+// connection. Dry run levels never reject connections.
+func (r *RateLimitsStore) AdmitWithShadow(
+	ctx context.Context,
+	clientInfo *ClientInfo,
+	targetGroup string,
+) (ShadowDecision, error) {
+	clientLevel := ratelimit.Level{
+		Name:    RateLimitLevelClient,
+		Limiter: clientInfo.GetLimiter(),
+		Key:     clientInfo.GetClientID(),
+		DryRun:  clientInfo.GetRateLimitDryRun(),
+	}
+
+	levels := []ratelimit.Level{
+		{
+			Name:    RateLimitLevelGlobal,
+			Limiter: r.global.getLimiter(),
+			Key:     RateLimitLevelGlobal,
+			DryRun:  r.global.getDryRun(),
+		},
+		{
+			Name:    RateLimitLevelTargetGroup,
+			Limiter: r.targetGroups[targetGroup].getLimiter(),
+			Key:     targetGroup,
+			DryRun:  r.targetGroups[targetGroup].getDryRun(),
+		},
+	}
+
+	if clientInfo.GetRateLimitMode() != RateLimitModeShape || clientLevel.DryRun {
+		return r.decide(append(levels, clientLevel), clientInfo)
+	}
+
+	queueCtx, cancel := context.WithTimeout(ctx, clientInfo.GetMaxQueueDelay())
+	err := clientLevel.Limiter.Wait(queueCtx, clientLevel.Key, 1)
+
+	cancel()
+
+	if err != nil {
+		// The queue is full for at least the max queue delay.
+		return r.shadow(levels), r.reject(clientLevel, clientInfo.GetMaxQueueDelay(), clientInfo)
+	}
+
+	shadow, err := r.decide(levels, clientInfo)
+	if err != nil {
+		clientLevel.Limiter.Cancel(clientLevel.Key, 1)
+	}
+
+	return shadow, err
+}
+
+func (r *RateLimitsStore) decide(levels []ratelimit.Level, clientInfo *ClientInfo) (ShadowDecision, error) {
+	decision := r.hierarchy.Decide(levels, 1)
+	shadow := r.recordShadow(levels, decision.ShadowRejected)
+
+	if decision.Allowed {
+		return shadow, nil
+	}
+
+	return shadow, r.reject(decision.Rejected, decision.RetryAfter, clientInfo)
+}
+
+// shadow evaluates only the dry run levels, for connections that were rejected before the other
+// levels were checked.
+func (r *RateLimitsStore) shadow(levels []ratelimit.Level) ShadowDecision {
+	var dryRunLevels []ratelimit.Level
+
+	for _, level := range levels {
+		if level.DryRun {
+			dryRunLevels = append(dryRunLevels, level)
+		}
+	}
+
+	if len(dryRunLevels) == 0 {
+		return ShadowDecision{}
+	}
+
+	decision := r.hierarchy.Decide(dryRunLevels, 1)
+
+	// The connection was rejected, so the dry run levels must not account for it.
+	for _, level := range dryRunLevels {
+		if level.Limiter != nil && !containsLevel(decision.ShadowRejected, level.Name) {
+			level.Limiter.Cancel(level.Key, 1)
+		}
+	}
+
+	return r.recordShadow(dryRunLevels, decision.ShadowRejected)
+}
+
+// recordShadow counts the dry run rejections and returns the shadow decision.
+func (r *RateLimitsStore) recordShadow(levels, shadowRejected []ratelimit.Level) ShadowDecision {
+	shadow := ShadowDecision{}
+
+	for _, level := range levels {
+		if level.DryRun && level.Limiter != nil {
+			shadow.Evaluated = true
+		}
+	}
+
+	if len(shadowRejected) == 0 {
+		return shadow
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, level := range shadowRejected {
+		r.shadowRejections[level.Name]++
+		shadow.RejectedLevels = append(shadow.RejectedLevels, level.Name)
+	}
+
+	return shadow
+}
+
+func containsLevel(levels []ratelimit.Level, name string) bool {
+	for _, level := range levels {
+		if level.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reject records a connection rejected by the given level and returns the rejection with the
+// level's reject action, falling back to the client's.
+func (r *RateLimitsStore) reject(level ratelimit.Level, retryAfter time.Duration, clientInfo *ClientInfo) error {
+	r.mu.Lock()
+	r.rejections[level.Name]++
+	r.mu.Unlock()
+
+	var rejectAction *RejectAction
+
+	switch level.Name {
+	case RateLimitLevelGlobal:
+		rejectAction = r.global.getRejectAction()
+	case RateLimitLevelTargetGroup:
+		rejectAction = r.targetGroups[level.Key].getRejectAction()
+	}
+
+	if rejectAction == nil {
+		rejectAction = clientInfo.GetRejectAction()
+	}
+
+	return &RateLimitError{
+		Level:      level.Name,
+		Key:        level.Key,
+		RetryAfter: retryAfter,
+		Action:     rejectAction,
+	}
+}
+
+// GetRejections returns the number of connections rejected by each rate limit level.
+func (r *RateLimitsStore) GetRejections() map[string]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rejections := make(map[string]uint64, len(r.rejections))
+	for level, count := range r.rejections {
+		rejections[level] = count
+	}
+
+	return rejections
+}
+
+// GetShadowRejections returns the number of connections each dry run rate limit level would have
+// rejected.
+func (r *RateLimitsStore) GetShadowRejections() map[string]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rejections := make(map[string]uint64, len(r.shadowRejections))
+	for level, count := range r.shadowRejections {
+		rejections[level] = count
+	}
+
+	return rejections
+}
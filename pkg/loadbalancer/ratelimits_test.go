@@ -0,0 +1,172 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitsStoreAdmit(t *testing.T) {
+	targetGroups := []loadbalancer.TargetGroupConfig{
+		{
+			Name:      "DBService",
+			RateLimit: &loadbalancer.RateLimitConfig{RequestsPerSecond: 3},
+		},
+	}
+
+	store, err := loadbalancer.NewRateLimitsStore(nil, targetGroups, nil)
+	require.NoError(t, err)
+
+	clients := loadbalancer.NewClientStore()
+	err = clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "DBService", RequestsPerSecond: 2},
+		{ClientId: "clientB", AllowedTargetGroup: "DBService", RequestsPerSecond: 2},
+	})
+	require.NoError(t, err)
+
+	clientA, _ := clients.GetClient("clientA")
+	clientB, _ := clients.GetClient("clientB")
+
+	assert.NoError(t, store.Admit(context.Background(), clientA, "DBService"))
+	assert.NoError(t, store.Admit(context.Background(), clientA, "DBService"))
+
+	err = store.Admit(context.Background(), clientA, "DBService")
+	assert.ErrorIs(t, err, loadbalancer.ErrRateLimitExceeded)
+	assert.Contains(t, err.Error(), loadbalancer.RateLimitLevelClient)
+
+	assert.NoError(t, store.Admit(context.Background(), clientB, "DBService"))
+
+	err = store.Admit(context.Background(), clientB, "DBService")
+	assert.ErrorIs(t, err, loadbalancer.ErrRateLimitExceeded)
+	assert.Contains(t, err.Error(), loadbalancer.RateLimitLevelTargetGroup)
+
+	assert.Equal(t, map[string]uint64{
+		loadbalancer.RateLimitLevelClient:      1,
+		loadbalancer.RateLimitLevelTargetGroup: 1,
+	}, store.GetRejections())
+}
+
+func TestRateLimitsStoreGlobal(t *testing.T) {
+	store, err := loadbalancer.NewRateLimitsStore(&loadbalancer.RateLimitConfig{RequestsPerSecond: 1}, nil, nil)
+	require.NoError(t, err)
+
+	clients := loadbalancer.NewClientStore()
+	err = clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "FrontEndService", RequestsPerSecond: 10},
+	})
+	require.NoError(t, err)
+
+	clientA, _ := clients.GetClient("clientA")
+
+	assert.NoError(t, store.Admit(context.Background(), clientA, "FrontEndService"))
+
+	err = store.Admit(context.Background(), clientA, "FrontEndService")
+	assert.ErrorIs(t, err, loadbalancer.ErrRateLimitExceeded)
+	assert.Contains(t, err.Error(), loadbalancer.RateLimitLevelGlobal)
+}
+
+func TestNewRateLimitsStoreInvalidAlgorithm(t *testing.T) {
+	_, err := loadbalancer.NewRateLimitsStore(nil, []loadbalancer.TargetGroupConfig{
+		{Name: "DBService", RateLimit: &loadbalancer.RateLimitConfig{Algorithm: "unknown"}},
+	}, nil)
+
+	assert.Error(t, err)
+}
+
+func TestRateLimitsStoreShapeMode(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+
+	store, err := loadbalancer.NewRateLimitsStore(nil, nil, fakeClock)
+	require.NoError(t, err)
+
+	clients := loadbalancer.NewClientStore()
+	clients.SetClock(fakeClock)
+	err = clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{
+			ClientId:           "clientA",
+			RequestsPerSecond:  20,
+			RateLimitAlgorithm: "leakyBucket",
+			RateLimitMode:      loadbalancer.RateLimitModeShape,
+			MaxQueueDelay:      75 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+
+	clientA, _ := clients.GetClient("clientA")
+
+	start := fakeClock.Now()
+
+	// The first connection leaves the queue right away and the second one after 50ms. The third
+	// one would have to wait 100ms, more than the max queue delay.
+	errs := make(chan error, 3)
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- store.Admit(context.Background(), clientA, "")
+		}()
+	}
+
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(50 * time.Millisecond)
+
+	rejected := 0
+
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			assert.ErrorIs(t, err, loadbalancer.ErrRateLimitExceeded)
+
+			rejected++
+		}
+	}
+
+	assert.Equal(t, 1, rejected)
+	assert.Equal(t, 50*time.Millisecond, fakeClock.Since(start))
+	assert.Equal(t, uint64(1), store.GetRejections()[loadbalancer.RateLimitLevelClient])
+}
+
+func TestRateLimitsStoreDryRun(t *testing.T) {
+	global := &loadbalancer.RateLimitConfig{RequestsPerSecond: 1, DryRun: true}
+
+	store, err := loadbalancer.NewRateLimitsStore(global, nil, nil)
+	require.NoError(t, err)
+
+	clients := loadbalancer.NewClientStore()
+	err = clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "FrontEndService", RequestsPerSecond: 1, RateLimitDryRun: true},
+		{ClientId: "clientB", AllowedTargetGroup: "FrontEndService", RequestsPerSecond: 1},
+	})
+	require.NoError(t, err)
+
+	clientA, _ := clients.GetClient("clientA")
+	clientB, _ := clients.GetClient("clientB")
+
+	shadow, err := store.AdmitWithShadow(context.Background(), clientA, "FrontEndService")
+	require.NoError(t, err)
+	assert.True(t, shadow.Evaluated)
+	assert.False(t, shadow.Rejected())
+
+	// Over both dry run limits, but still allowed.
+	shadow, err = store.AdmitWithShadow(context.Background(), clientA, "FrontEndService")
+	require.NoError(t, err)
+	assert.Equal(t, []string{loadbalancer.RateLimitLevelGlobal, loadbalancer.RateLimitLevelClient}, shadow.RejectedLevels)
+
+	// Enforced client limits still apply next to the dry run global limit.
+	shadow, err = store.AdmitWithShadow(context.Background(), clientB, "FrontEndService")
+	require.NoError(t, err)
+	assert.True(t, shadow.Rejected())
+
+	shadow, err = store.AdmitWithShadow(context.Background(), clientB, "FrontEndService")
+	assert.ErrorIs(t, err, loadbalancer.ErrRateLimitExceeded)
+	assert.Equal(t, []string{loadbalancer.RateLimitLevelGlobal}, shadow.RejectedLevels)
+
+	assert.Equal(t, map[string]uint64{loadbalancer.RateLimitLevelClient: 1}, store.GetRejections())
+	assert.Equal(t, map[string]uint64{
+		loadbalancer.RateLimitLevelGlobal: 3,
+		loadbalancer.RateLimitLevelClient: 1,
+	}, store.GetShadowRejections())
+}
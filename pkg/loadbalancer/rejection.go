@@ -0,0 +1,152 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+)
+
+const (
+	// RejectActionClose closes rejected connections gracefully. It is the default.
+	RejectActionClose = "close"
+	// RejectActionReset aborts rejected connections with a TCP RST.
+	RejectActionReset = "reset"
+	// RejectActionTarpit holds rejected connections open for a while before closing them.
+	RejectActionTarpit = "tarpit"
+
+	// retryAfterPlaceholder is replaced with the retry after hint in rejection payloads.
+	retryAfterPlaceholder = "{retryAfter}"
+
+	defaultTarpitDelay = 5 * time.Second
+
+	// MaxTarpittedConnections is how many rejected connections are held open by "tarpit" at once,
+	// across all rate limits. Connections rejected beyond it are closed right away, so that a flood
+	// of rejected connections does not pin as many file descriptors.
+	MaxTarpittedConnections = 1000
+)
+
+// tarpitSlots holds a slot for each connection held open by "tarpit".
+var tarpitSlots = make(chan struct{}, MaxTarpittedConnections)
+
+// RejectAction is what the load balancer does with a connection rejected by a rate limit.
+type RejectAction struct {
+	action      string
+	payload     string
+	tarpitDelay time.Duration
+	clock       clock.Clock
+}
+
+// defaultRejectAction closes rejected connections without writing anything.
+var defaultRejectAction = &RejectAction{action: RejectActionClose}
+
+// newRejectAction builds the RejectAction for a rejection config. It returns nil if no action is
+// configured. The tarpit delay is timed with clk, which defaults to the time package if nil.
+func newRejectAction(config *RejectionConfig, clk clock.Clock) (*RejectAction, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	rejectAction := &RejectAction{
+		action:      config.Action,
+		payload:     config.Payload,
+		tarpitDelay: config.TarpitDelay,
+		clock:       clock.OrDefault(clk),
+	}
+
+	switch config.Action {
+	case "":
+		rejectAction.action = RejectActionClose
+	case RejectActionClose, RejectActionReset:
+	case RejectActionTarpit:
+		if rejectAction.tarpitDelay <= 0 {
+			rejectAction.tarpitDelay = defaultTarpitDelay
+		}
+	default:
+		return nil, ErrUnknownRejectAction(config.Action)
+	}
+
+	return rejectAction, nil
+}
+
+// Reject applies the action to the connection and closes it. retryAfter is substituted in the
+// payload. A tarpit closes the connection right away if MaxTarpittedConnections are already held.
+func (a *RejectAction) Reject(ctx context.Context, conn net.Conn, retryAfter time.Duration) error {
+	if a.action == RejectActionReset {
+		return resetConn(conn)
+	}
+
+	if a.action == RejectActionTarpit {
+		a.tarpit(ctx)
+	}
+
+	if a.payload != "" {
+		payload := strings.ReplaceAll(a.payload, retryAfterPlaceholder, formatRetryAfter(retryAfter))
+
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			conn.Close()
+
+			return fmt.Errorf("failed to write rejection payload: %w", err)
+		}
+	}
+
+	return conn.Close()
+}
+
+// tarpit waits for the tarpit delay, unless ctx is done first or there is no tarpit slot left.
+func (a *RejectAction) tarpit(ctx context.Context) {
+	select {
+	case tarpitSlots <- struct{}{}:
+	default:
+		return
+	}
+
+	defer func() { <-tarpitSlots }()
+
+	timer := a.clock.NewTimer(a.tarpitDelay)
+
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C():
+	}
+}
+
+// resetConn closes the TCP connection under conn with SO_LINGER set to 0, so that a RST is sent
+// instead of a FIN.
+func resetConn(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetLinger(0); err != nil {
+			tcpConn.Close()
+
+			return err
+		}
+	}
+
+	return conn.Close()
+}
+
+// formatRetryAfter formats a retry after hint as whole seconds, rounded up. It is empty if the
+// limiter never expects to allow the connection, e.g. because it costs more than the burst.
+func formatRetryAfter(retryAfter time.Duration) string {
+	if retryAfter == ratelimit.InfDuration {
+		return ""
+	}
+
+	if retryAfter <= 0 {
+		return "0"
+	}
+
+	return strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10)
+}
@@ -0,0 +1,215 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectSecondConnection admits two connections for a client with a limit of 1 and returns the
+// rejection of the second one. The limiters and reject actions use clk, or the time package if nil.
+func rejectSecondConnection(
+	t *testing.T,
+	client loadbalancer.ClientConfig,
+	targetGroups []loadbalancer.TargetGroupConfig,
+	clk clock.Clock,
+) *loadbalancer.RateLimitError {
+	t.Helper()
+
+	client.ClientId = "clientA"
+	client.AllowedTargetGroup = "DBService"
+	client.RequestsPerSecond = 1
+
+	clients := loadbalancer.NewClientStore()
+	clients.SetClock(clk)
+	require.NoError(t, clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{client}))
+
+	clientInfo, _ := clients.GetClient("clientA")
+
+	store, err := loadbalancer.NewRateLimitsStore(nil, targetGroups, clk)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Admit(context.Background(), clientInfo, "DBService"))
+
+	err = store.Admit(context.Background(), clientInfo, "DBService")
+
+	var rateLimitErr *loadbalancer.RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr))
+
+	return rateLimitErr
+}
+
+func TestRejectActionPayload(t *testing.T) {
+	rateLimitErr := rejectSecondConnection(t, loadbalancer.ClientConfig{
+		RateLimitRejection: &loadbalancer.RejectionConfig{Payload: "RATE_LIMITED retry_after={retryAfter}\n"},
+	}, nil, nil)
+
+	assert.Greater(t, rateLimitErr.RetryAfter, time.Duration(0))
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		assert.NoError(t, rateLimitErr.Action.Reject(context.Background(), server, rateLimitErr.RetryAfter))
+	}()
+
+	payload, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "RATE_LIMITED retry_after=1\n", string(payload))
+}
+
+func TestRejectActionReset(t *testing.T) {
+	rateLimitErr := rejectSecondConnection(t, loadbalancer.ClientConfig{
+		RateLimitRejection: &loadbalancer.RejectionConfig{Action: loadbalancer.RejectActionReset},
+	}, nil, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	server, err := listener.Accept()
+	require.NoError(t, err)
+
+	require.NoError(t, rateLimitErr.Action.Reject(context.Background(), server, rateLimitErr.RetryAfter))
+
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+}
+
+func TestRejectActionPayloadWithoutRetryAfter(t *testing.T) {
+	rateLimitErr := rejectSecondConnection(t, loadbalancer.ClientConfig{
+		RateLimitRejection: &loadbalancer.RejectionConfig{Payload: "RATE_LIMITED retry_after={retryAfter}\n"},
+	}, nil, nil)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// A limiter that never allows the connection gives no hint.
+	go func() {
+		assert.NoError(t, rateLimitErr.Action.Reject(context.Background(), server, ratelimit.InfDuration))
+	}()
+
+	payload, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "RATE_LIMITED retry_after=\n", string(payload))
+}
+
+func TestRejectActionTarpit(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+
+	rateLimitErr := rejectSecondConnection(t, loadbalancer.ClientConfig{
+		RateLimitRejection: &loadbalancer.RejectionConfig{
+			Action:      loadbalancer.RejectActionTarpit,
+			TarpitDelay: time.Minute,
+		},
+	}, nil, fakeClock)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+
+	go func() { done <- rateLimitErr.Action.Reject(context.Background(), server, rateLimitErr.RetryAfter) }()
+
+	fakeClock.BlockUntil(1)
+
+	select {
+	case <-done:
+		t.Fatal("The connection should be held open for the tarpit delay")
+	default:
+	}
+
+	fakeClock.Advance(time.Minute)
+	assert.NoError(t, <-done)
+}
+
+func TestRejectActionTarpitIsBounded(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+
+	rateLimitErr := rejectSecondConnection(t, loadbalancer.ClientConfig{
+		RateLimitRejection: &loadbalancer.RejectionConfig{
+			Action:      loadbalancer.RejectActionTarpit,
+			TarpitDelay: time.Minute,
+		},
+	}, nil, fakeClock)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < loadbalancer.MaxTarpittedConnections; i++ {
+		server, client := net.Pipe()
+		defer client.Close()
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, rateLimitErr.Action.Reject(context.Background(), server, rateLimitErr.RetryAfter))
+		}()
+	}
+
+	fakeClock.BlockUntil(loadbalancer.MaxTarpittedConnections)
+
+	// Once the tarpit is full, rejected connections are closed right away.
+	server, client := net.Pipe()
+	defer client.Close()
+
+	require.NoError(t, rateLimitErr.Action.Reject(context.Background(), server, rateLimitErr.RetryAfter))
+
+	fakeClock.Advance(time.Minute)
+	wg.Wait()
+}
+
+func TestRejectActionOfTrippedLevel(t *testing.T) {
+	targetGroups := []loadbalancer.TargetGroupConfig{
+		{
+			Name: "DBService",
+			RateLimit: &loadbalancer.RateLimitConfig{
+				RequestsPerSecond: 1,
+				Rejection:         &loadbalancer.RejectionConfig{Payload: "DB_BUSY\n"},
+			},
+		},
+	}
+
+	rateLimitErr := rejectSecondConnection(t, loadbalancer.ClientConfig{
+		RateLimitRejection: &loadbalancer.RejectionConfig{Payload: "CLIENT_LIMITED\n"},
+	}, targetGroups, nil)
+
+	assert.Equal(t, loadbalancer.RateLimitLevelTargetGroup, rateLimitErr.Level)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		assert.NoError(t, rateLimitErr.Action.Reject(context.Background(), server, rateLimitErr.RetryAfter))
+	}()
+
+	payload, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "DB_BUSY\n", string(payload))
+}
+
+func TestUnknownRejectAction(t *testing.T) {
+	clients := loadbalancer.NewClientStore()
+	err := clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", RateLimitRejection: &loadbalancer.RejectionConfig{Action: "explode"}},
+	})
+
+	assert.Error(t, err)
+}
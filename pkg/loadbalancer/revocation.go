@@ -0,0 +1,415 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// RevocationModeSoftFail accepts client certificates whose revocation status cannot be
+	// determined, e.g. because the OCSP responder is down or the CRL is out of date.
+	RevocationModeSoftFail = "softFail"
+	// RevocationModeHardFail rejects client certificates whose revocation status cannot be
+	// determined.
+	RevocationModeHardFail = "hardFail"
+
+	defaultCRLReloadInterval = time.Minute
+	defaultOCSPTimeout       = 2 * time.Second
+	defaultOCSPCacheTTL      = time.Hour
+	// maxOCSPResponseSize bounds the OCSP responses read from responders.
+	maxOCSPResponseSize = 1 << 20
+	// maxOCSPCacheSize bounds the number of cached OCSP responses.
+	maxOCSPCacheSize = 10000
+)
+
+// revocationStatus is what a CRL or an OCSP responder says about a certificate.
+type revocationStatus int
+
+const (
+	revocationUnknown revocationStatus = iota
+	revocationGood
+	revocationRevoked
+)
+
+// ocspCacheEntry is a cached OCSP response. Once refreshAt is reached, the response is still used
+// while it is fetched again in the background, at most once at a time.
+type ocspCacheEntry struct {
+	status     revocationStatus
+	expires    time.Time
+	refreshAt  time.Time
+	refreshing bool
+}
+
+// RevocationChecker checks client certificates against CRLs and OCSP responders. It is plugged into
+// the listener's tls.Config as VerifyPeerCertificate, so it runs after the chain was verified
+// against the CA pool. There is a single checker, so its mode applies to every client certificate
+// the load balancer verifies.
+//
+// The first handshake of a certificate no up to date CRL covers waits for its OCSP responder, for
+// up to OCSPTimeout. Later handshakes use the cached response, which is refreshed in the background
+// halfway through its lifetime.
+type RevocationChecker struct {
+	config     RevocationConfig
+	clock      clock.Clock
+	httpClient *http.Client
+
+	mu   sync.RWMutex
+	crls []*x509.RevocationList
+
+	cacheMu   sync.Mutex
+	ocspCache map[string]ocspCacheEntry
+
+	// onSoftFail is called with the error of every certificate accepted in soft fail mode.
+	onSoftFail func(error)
+}
+
+// NewRevocationChecker creates a RevocationChecker and loads its CRL files. OCSP responses are
+// cached by the time of clk, which defaults to the time package if nil.
+func NewRevocationChecker(config *RevocationConfig, clk clock.Clock) (*RevocationChecker, error) {
+	r := &RevocationChecker{
+		config:     *config,
+		clock:      clock.OrDefault(clk),
+		ocspCache:  make(map[string]ocspCacheEntry),
+		onSoftFail: func(error) {},
+	}
+
+	switch r.config.Mode {
+	case "":
+		r.config.Mode = RevocationModeSoftFail
+	case RevocationModeSoftFail, RevocationModeHardFail:
+	default:
+		return nil, ErrUnknownRevocationMode(r.config.Mode)
+	}
+
+	if len(r.config.CRLFiles) == 0 && !r.config.OCSP {
+		return nil, ErrNoRevocationSource
+	}
+
+	if r.config.CRLReloadInterval == 0 {
+		r.config.CRLReloadInterval = defaultCRLReloadInterval
+	}
+
+	if r.config.OCSPTimeout <= 0 {
+		r.config.OCSPTimeout = defaultOCSPTimeout
+	}
+
+	if r.config.OCSPCacheTTL <= 0 {
+		r.config.OCSPCacheTTL = defaultOCSPCacheTTL
+	}
+
+	r.httpClient = &http.Client{Timeout: r.config.OCSPTimeout}
+
+	if err := r.ReloadCRLs(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SetSoftFailHandler sets the function called with the error of every client certificate that is
+// accepted although its revocation status could not be determined.
+func (r *RevocationChecker) SetSoftFailHandler(onSoftFail func(error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onSoftFail = onSoftFail
+}
+
+// ReloadCRLs loads the CRL files. If any of them fails to load, the CRLs loaded before are kept and
+// the error is returned.
+func (r *RevocationChecker) ReloadCRLs() error {
+	var crls []*x509.RevocationList
+
+	for _, path := range r.config.CRLFiles {
+		fileCRLs, err := loadCRLFile(path)
+		if err != nil {
+			return ErrLoadingCRL(path, err)
+		}
+
+		crls = append(crls, fileCRLs...)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.crls = crls
+
+	return nil
+}
+
+// loadCRLFile parses the CRLs of a file, either PEM encoded or a single DER encoded one.
+func loadCRLFile(path string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	var crls []*x509.RevocationList
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		crls = append(crls, crl)
+	}
+
+	if len(crls) == 0 {
+		return nil, ErrNoCRLs
+	}
+
+	return crls, nil
+}
+
+// Run reloads the CRL files every CRLReloadInterval until ctx is done. onError is called when a
+// reload fails.
+func (r *RevocationChecker) Run(ctx context.Context, onError func(error)) {
+	if len(r.config.CRLFiles) == 0 || r.config.CRLReloadInterval < 0 {
+		return
+	}
+
+	ticker := r.clock.NewTicker(r.config.CRLReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if err := r.ReloadCRLs(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// VerifyPeerCertificate checks that none of the certificates of the client's verified chain was
+// revoked. A revoked certificate is always rejected. A certificate whose status is unknown is
+// rejected in hard fail mode only.
+func (r *RevocationChecker) VerifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+
+	// All chains end in the same leaf, so checking one of them is enough. The root is trusted as
+	// is.
+	chain := verifiedChains[0]
+	for i := 0; i+1 < len(chain); i++ {
+		if err := r.check(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RevocationChecker) check(cert, issuer *x509.Certificate) error {
+	status := r.checkCRLs(cert, issuer)
+	if status == revocationRevoked {
+		return ErrCertificateRevoked(cert.SerialNumber.String(), "CRL")
+	}
+
+	var err error
+
+	if status == revocationUnknown && r.config.OCSP {
+		status, err = r.checkOCSP(cert, issuer)
+		if status == revocationRevoked {
+			return ErrCertificateRevoked(cert.SerialNumber.String(), "OCSP")
+		}
+	}
+
+	if status == revocationGood {
+		return nil
+	}
+
+	err = ErrRevocationStatusUnknown(cert.SerialNumber.String(), err)
+	if r.config.Mode == RevocationModeHardFail {
+		return err
+	}
+
+	r.mu.RLock()
+	onSoftFail := r.onSoftFail
+	r.mu.RUnlock()
+
+	onSoftFail(err)
+
+	return nil
+}
+
+// checkCRLs looks cert up in the CRLs issued by issuer. CRLs that are out of date are ignored.
+func (r *RevocationChecker) checkCRLs(cert, issuer *x509.Certificate) revocationStatus {
+	r.mu.RLock()
+	crls := r.crls
+	r.mu.RUnlock()
+
+	now := r.clock.Now()
+	status := revocationUnknown
+
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			continue
+		}
+
+		for _, revoked := range crl.RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return revocationRevoked
+			}
+		}
+
+		status = revocationGood
+	}
+
+	return status
+}
+
+// checkOCSP asks the OCSP responder of cert for its status, or uses the cached response.
+func (r *RevocationChecker) checkOCSP(cert, issuer *x509.Certificate) (revocationStatus, error) {
+	issuerHash := sha256.Sum256(issuer.Raw)
+	key := hex.EncodeToString(issuerHash[:]) + "/" + cert.SerialNumber.String()
+	now := r.clock.Now()
+
+	r.cacheMu.Lock()
+	entry, ok := r.ocspCache[key]
+
+	if ok && now.Before(entry.expires) {
+		if !entry.refreshing && !now.Before(entry.refreshAt) {
+			entry.refreshing = true
+			r.ocspCache[key] = entry
+
+			go func() { _, _ = r.fetchOCSP(key, cert, issuer) }()
+		}
+
+		r.cacheMu.Unlock()
+
+		return entry.status, nil
+	}
+
+	r.cacheMu.Unlock()
+
+	return r.fetchOCSP(key, cert, issuer)
+}
+
+// fetchOCSP asks the OCSP responder of cert for its status and caches the response under key. A
+// failed fetch leaves the cache as is, so a failed background refresh is only retried once the
+// cached response expired.
+func (r *RevocationChecker) fetchOCSP(key string, cert, issuer *x509.Certificate) (revocationStatus, error) {
+	response, err := r.queryOCSP(cert, issuer)
+	if err != nil {
+		return revocationUnknown, err
+	}
+
+	now := r.clock.Now()
+
+	if !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		return revocationUnknown, ErrStaleOCSPResponse
+	}
+
+	entry := ocspCacheEntry{expires: now.Add(r.config.OCSPCacheTTL)}
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(entry.expires) {
+		entry.expires = response.NextUpdate
+	}
+
+	entry.refreshAt = now.Add(entry.expires.Sub(now) / 2)
+
+	switch response.Status {
+	case ocsp.Good:
+		entry.status = revocationGood
+	case ocsp.Revoked:
+		entry.status = revocationRevoked
+	default:
+		return revocationUnknown, ErrOCSPStatusUnknown
+	}
+
+	r.cacheOCSPResponse(key, entry, now)
+
+	return entry.status, nil
+}
+
+// cacheOCSPResponse caches an OCSP response. When the cache is full, the expired responses are
+// dropped first, and the response is not cached if none were.
+func (r *RevocationChecker) cacheOCSPResponse(key string, entry ocspCacheEntry, now time.Time) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+
+	if _, ok := r.ocspCache[key]; !ok && len(r.ocspCache) >= maxOCSPCacheSize {
+		for k, cached := range r.ocspCache {
+			if !now.Before(cached.expires) {
+				delete(r.ocspCache, k)
+			}
+		}
+	}
+
+	if _, ok := r.ocspCache[key]; ok || len(r.ocspCache) < maxOCSPCacheSize {
+		r.ocspCache[key] = entry
+	}
+}
+
+func (r *RevocationChecker) queryOCSP(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	responder := r.config.OCSPResponder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, ErrNoOCSPResponder
+		}
+
+		responder = cert.OCSPServer[0]
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResponse, err := r.httpClient.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, ErrOCSPResponder(httpResponse.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
@@ -0,0 +1,257 @@
+package loadbalancer_test
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+// crl returns a PEM encoded CRL of the CA revoking the certificates, valid for an hour from now.
+func (ca *testCA) crl(t *testing.T, now time.Time, revoked ...*x509.Certificate) []byte {
+	t.Helper()
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, cert := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: now})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// ocspResponder is an OCSP responder of a testCA that answers with the status set for each serial
+// number, and ocsp.Unknown otherwise.
+type ocspResponder struct {
+	ca       *testCA
+	statuses map[string]int
+	requests atomic.Int32
+}
+
+func (o *ocspResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.requests.Add(1)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	status, ok := o.statuses[request.SerialNumber.String()]
+	if !ok {
+		status = ocsp.Unknown
+	}
+
+	response, err := ocsp.CreateResponse(o.ca.cert, o.ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+		RevokedAt:    time.Now().Add(-time.Minute),
+	}, o.ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	_, _ = w.Write(response)
+}
+
+func TestRevocationCheckerCRL(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	fakeClock := clock.NewFake(time.Now())
+
+	good := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "good"}}).Leaf
+	revoked := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}}).Leaf
+
+	crlFile := writeTestFile(t, dir, "ca.crl", ca.crl(t, fakeClock.Now(), revoked))
+
+	checker, err := loadbalancer.NewRevocationChecker(&loadbalancer.RevocationConfig{
+		CRLFiles: []string{crlFile},
+		Mode:     loadbalancer.RevocationModeHardFail,
+	}, fakeClock)
+	require.NoError(t, err)
+
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}))
+	assert.ErrorIs(t,
+		checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{revoked, ca.cert}}), loadbalancer.ErrRevoked)
+
+	// A new CRL is picked up on reload.
+	writeTestFile(t, dir, "ca.crl", ca.crl(t, fakeClock.Now(), revoked, good))
+	require.NoError(t, checker.ReloadCRLs())
+	assert.ErrorIs(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}), loadbalancer.ErrRevoked)
+
+	// A broken CRL file keeps the CRLs loaded before.
+	writeTestFile(t, dir, "ca.crl", []byte("-----BEGIN X509 CRL-----\nbroken\n-----END X509 CRL-----\n"))
+	assert.Error(t, checker.ReloadCRLs())
+	assert.ErrorIs(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}), loadbalancer.ErrRevoked)
+
+	// Once the CRL is out of date, the status is unknown.
+	writeTestFile(t, dir, "ca.crl", ca.crl(t, fakeClock.Now(), revoked))
+	require.NoError(t, checker.ReloadCRLs())
+	fakeClock.Advance(2 * time.Hour)
+	assert.ErrorIs(t,
+		checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}), loadbalancer.ErrRevocationUnknown)
+}
+
+func TestRevocationCheckerSoftFail(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	// The CRL of another CA says nothing about the certificate.
+	crlFile := writeTestFile(t, t.TempDir(), "other.crl", otherCA.crl(t, time.Now()))
+	cert := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}}).Leaf
+
+	checker, err := loadbalancer.NewRevocationChecker(&loadbalancer.RevocationConfig{
+		CRLFiles: []string{crlFile},
+	}, nil)
+	require.NoError(t, err)
+
+	var softFailures []error
+
+	checker.SetSoftFailHandler(func(err error) { softFailures = append(softFailures, err) })
+
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{cert, ca.cert}}))
+	require.Len(t, softFailures, 1)
+	assert.ErrorIs(t, softFailures[0], loadbalancer.ErrRevocationUnknown)
+}
+
+func TestRevocationCheckerOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	responder := &ocspResponder{ca: ca, statuses: make(map[string]int)}
+	server := httptest.NewServer(responder)
+
+	defer server.Close()
+
+	good := ca.issueTLS(t, &x509.Certificate{OCSPServer: []string{server.URL}}).Leaf
+	revoked := ca.issueTLS(t, &x509.Certificate{OCSPServer: []string{server.URL}}).Leaf
+	unknown := ca.issueTLS(t, &x509.Certificate{OCSPServer: []string{server.URL}}).Leaf
+
+	responder.statuses[good.SerialNumber.String()] = ocsp.Good
+	responder.statuses[revoked.SerialNumber.String()] = ocsp.Revoked
+
+	fakeClock := clock.NewFake(time.Now())
+
+	checker, err := loadbalancer.NewRevocationChecker(&loadbalancer.RevocationConfig{
+		OCSP:         true,
+		OCSPCacheTTL: time.Minute,
+		Mode:         loadbalancer.RevocationModeHardFail,
+	}, fakeClock)
+	require.NoError(t, err)
+
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}))
+	assert.ErrorIs(t,
+		checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{revoked, ca.cert}}), loadbalancer.ErrRevoked)
+	assert.ErrorIs(t,
+		checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{unknown, ca.cert}}), loadbalancer.ErrRevocationUnknown)
+	assert.Equal(t, int32(3), responder.requests.Load())
+
+	// Responses are cached until the cache TTL.
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}))
+	assert.Equal(t, int32(3), responder.requests.Load())
+
+	fakeClock.Advance(2 * time.Minute)
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}))
+	assert.Equal(t, int32(4), responder.requests.Load())
+
+	// An unreachable responder leaves the status unknown.
+	server.Close()
+	fakeClock.Advance(2 * time.Minute)
+	assert.ErrorIs(t,
+		checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}), loadbalancer.ErrRevocationUnknown)
+}
+
+func TestRevocationCheckerOCSPRefreshesInBackground(t *testing.T) {
+	ca := newTestCA(t)
+	responder := &ocspResponder{ca: ca, statuses: make(map[string]int)}
+	server := httptest.NewServer(responder)
+
+	defer server.Close()
+
+	good := ca.issueTLS(t, &x509.Certificate{OCSPServer: []string{server.URL}}).Leaf
+	responder.statuses[good.SerialNumber.String()] = ocsp.Good
+
+	fakeClock := clock.NewFake(time.Now())
+
+	checker, err := loadbalancer.NewRevocationChecker(&loadbalancer.RevocationConfig{
+		OCSP:         true,
+		OCSPCacheTTL: time.Minute,
+		Mode:         loadbalancer.RevocationModeHardFail,
+	}, fakeClock)
+	require.NoError(t, err)
+
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}))
+	assert.Equal(t, int32(1), responder.requests.Load())
+
+	// Halfway through its lifetime, the cached response is still used while it is refreshed.
+	fakeClock.Advance(40 * time.Second)
+	assert.NoError(t, checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}))
+	assert.Eventually(t, func() bool { return responder.requests.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	// The refreshed response lasts a full cache TTL again, so the responder can go away.
+	server.Close()
+	fakeClock.Advance(40 * time.Second)
+
+	assert.Eventually(t, func() bool {
+		return checker.VerifyPeerCertificate(nil, [][]*x509.Certificate{{good, ca.cert}}) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), responder.requests.Load())
+}
+
+func TestRevokedClientFailsHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	files := newCertFiles(t, ca, "lb")
+
+	clientCert := ca.issueTLS(t, &x509.Certificate{Subject: pkix.Name{CommonName: "clientA"}})
+	crlFile := writeTestFile(t, files.dir, "ca.crl", ca.crl(t, time.Now(), clientCert.Leaf))
+
+	reloader, err := loadbalancer.NewCertReloader(&files.params, nil)
+	require.NoError(t, err)
+
+	checker, err := loadbalancer.NewRevocationChecker(&loadbalancer.RevocationConfig{CRLFiles: []string{crlFile}}, nil)
+	require.NoError(t, err)
+
+	reloader.SetVerifyPeerCertificate(checker.VerifyPeerCertificate)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	_, err = handshake(t, reloader.TLSConfig(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "loadbalancer.test",
+		Certificates: []tls.Certificate{clientCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	assert.ErrorIs(t, err, loadbalancer.ErrRevoked)
+}
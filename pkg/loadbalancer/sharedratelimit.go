@@ -0,0 +1,120 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// SharedRateLimitBackendRedis keeps shared rate limiting state in Redis.
+	SharedRateLimitBackendRedis = "redis"
+
+	defaultSharedRateLimitKeyPrefix = "loadbalancer:ratelimit:"
+)
+
+// SharedRateLimit is the backend through which load balancer instances share the client rate
+// limits.
+type SharedRateLimit struct {
+	backend ratelimit.Backend
+	config  SharedRateLimitConfig
+
+	mu sync.Mutex
+	// degraded is true while the clients fall back to local rate limiting.
+	degraded bool
+	// onStateChange is called when the clients fall back to local rate limiting, with the backend
+	// error, and when they use the backend again, with nil.
+	onStateChange func(error)
+}
+
+// NewSharedRateLimit connects to the backend configured in config. It returns nil if config is
+// nil. Connecting is lazy, an unreachable backend only makes the clients fall back to local rate
+// limiting.
+func NewSharedRateLimit(config *SharedRateLimitConfig) (*SharedRateLimit, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	switch config.Backend {
+	case SharedRateLimitBackendRedis:
+		client := redis.NewClient(&redis.Options{
+			Addr:     config.Redis.Address,
+			Username: config.Redis.Username,
+			Password: config.Redis.Password,
+			DB:       config.Redis.DB,
+			// Limiters retry on their own after RetryInterval.
+			MaxRetries: -1,
+		})
+
+		return NewSharedRateLimitWithBackend(ratelimit.NewRedisBackend(client), config), nil
+	default:
+		return nil, ErrUnknownSharedRateLimitBackend(config.Backend)
+	}
+}
+
+// NewSharedRateLimitWithBackend creates a SharedRateLimit using the given backend, e.g. for other
+// backends than the built-in ones.
+func NewSharedRateLimitWithBackend(backend ratelimit.Backend, config *SharedRateLimitConfig) *SharedRateLimit {
+	return &SharedRateLimit{backend: backend, config: *config, onStateChange: func(error) {}}
+}
+
+// SetStateHandler sets the function called with the backend error when the clients fall back to
+// local rate limiting, i.e. every instance enforces the client limits on its own, and with nil when
+// the backend is used again. It is called once per outage, not once per client.
+func (s *SharedRateLimit) SetStateHandler(onStateChange func(error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onStateChange = onStateChange
+}
+
+// stateChanged is called by the limiters of the clients when they fall back to local rate limiting
+// or use the backend again. As they share the backend, only the first of them is reported.
+func (s *SharedRateLimit) stateChanged(err error) {
+	s.mu.Lock()
+
+	changed := s.degraded != (err != nil)
+	s.degraded = err != nil
+	onStateChange := s.onStateChange
+
+	s.mu.Unlock()
+
+	if changed {
+		onStateChange(err)
+	}
+}
+
+// wrap returns a limiter enforcing the client's limit through the backend, which falls back to
+// the client's local limiter. The shared limit is a sliding window counter whatever the client's
+// algorithm. A burst larger than requestsPerSecond is carried over by widening the window: burst
+// requests per burst/requestsPerSecond seconds keep the sustained rate while letting the burst
+// through.
+func (s *SharedRateLimit) wrap(
+	requestsPerSecond, burst int,
+	local ratelimit.Limiter,
+	clk clock.Clock,
+) ratelimit.Limiter {
+	keyPrefix := s.config.Redis.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = defaultSharedRateLimitKeyPrefix
+	}
+
+	limit, window := requestsPerSecond, ratelimit.DefaultWindow
+	if burst > requestsPerSecond && requestsPerSecond > 0 {
+		limit = burst
+		window = time.Duration(burst) * ratelimit.DefaultWindow / time.Duration(requestsPerSecond)
+	}
+
+	return ratelimit.NewDistributedLimiter(s.backend, local, ratelimit.DistributedParams{
+		Limit:         limit,
+		Window:        window,
+		KeyPrefix:     keyPrefix + "client:",
+		Timeout:       s.config.Timeout,
+		RetryInterval: s.config.RetryInterval,
+		Clock:         clk,
+		OnStateChange: s.stateChanged,
+	})
+}
@@ -0,0 +1,139 @@
+package loadbalancer_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSharedClient(t *testing.T, config *loadbalancer.SharedRateLimitConfig) *loadbalancer.ClientInfo {
+	t.Helper()
+
+	shared, err := loadbalancer.NewSharedRateLimit(config)
+	require.NoError(t, err)
+
+	store := loadbalancer.NewClientStore()
+	store.SetSharedRateLimit(shared)
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1", RequestsPerSecond: 3},
+	}))
+
+	clientInfo, ok := store.GetClient("clientA")
+	require.True(t, ok)
+
+	return clientInfo
+}
+
+func TestSharedRateLimitAcrossInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := &loadbalancer.SharedRateLimitConfig{
+		Backend: loadbalancer.SharedRateLimitBackendRedis,
+		Redis:   loadbalancer.RedisConfig{Address: server.Addr()},
+	}
+
+	// The same client as seen by two load balancer instances.
+	instanceA := newSharedClient(t, config)
+	instanceB := newSharedClient(t, config)
+
+	allowed := 0
+
+	for i := 0; i < 3; i++ {
+		if instanceA.GetLimiter().Allow(instanceA.GetClientID(), 1) {
+			allowed++
+		}
+
+		if instanceB.GetLimiter().Allow(instanceB.GetClientID(), 1) {
+			allowed++
+		}
+	}
+
+	assert.Equal(t, 3, allowed, "The instances should enforce one combined limit")
+}
+
+func TestSharedRateLimitKeepsBurst(t *testing.T) {
+	server := miniredis.RunT(t)
+	fakeClock := clock.NewFake(time.Now())
+
+	shared, err := loadbalancer.NewSharedRateLimit(&loadbalancer.SharedRateLimitConfig{
+		Backend: loadbalancer.SharedRateLimitBackendRedis,
+		Redis:   loadbalancer.RedisConfig{Address: server.Addr()},
+	})
+	require.NoError(t, err)
+
+	store := loadbalancer.NewClientStore()
+	store.SetSharedRateLimit(shared)
+	store.SetClock(fakeClock)
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{
+			ClientId:           "clientA",
+			AllowedTargetGroup: "group1",
+			RequestsPerSecond:  2,
+			Burst:              6,
+			RateLimitAlgorithm: "tokenBucket",
+		},
+	}))
+
+	clientA, _ := store.GetClient("clientA")
+
+	// The burst is allowed at once, as with the client's own token bucket.
+	for i := 0; i < 6; i++ {
+		assert.True(t, clientA.GetLimiter().Allow("clientA", 1), i)
+	}
+
+	assert.False(t, clientA.GetLimiter().Allow("clientA", 1))
+	assert.NoError(t, clientA.GetLimiter().(*ratelimit.DistributedLimiter).Degraded())
+}
+
+func TestSharedRateLimitReportsFallback(t *testing.T) {
+	server := miniredis.RunT(t)
+	fakeClock := clock.NewFake(time.Now())
+
+	shared, err := loadbalancer.NewSharedRateLimit(&loadbalancer.SharedRateLimitConfig{
+		Backend:       loadbalancer.SharedRateLimitBackendRedis,
+		Redis:         loadbalancer.RedisConfig{Address: server.Addr()},
+		RetryInterval: time.Second,
+	})
+	require.NoError(t, err)
+
+	var stateChanges []error
+
+	shared.SetStateHandler(func(err error) { stateChanges = append(stateChanges, err) })
+
+	store := loadbalancer.NewClientStore()
+	store.SetSharedRateLimit(shared)
+	store.SetClock(fakeClock)
+	require.NoError(t, store.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroup: "group1", RequestsPerSecond: 3},
+		{ClientId: "clientB", AllowedTargetGroup: "group1", RequestsPerSecond: 3},
+	}))
+
+	clientA, _ := store.GetClient("clientA")
+	clientB, _ := store.GetClient("clientB")
+
+	server.Close()
+
+	// The outage is reported once, however many clients notice it.
+	assert.True(t, clientA.GetLimiter().Allow("clientA", 1))
+	assert.True(t, clientB.GetLimiter().Allow("clientB", 1))
+	require.Len(t, stateChanges, 1)
+	assert.Error(t, stateChanges[0])
+
+	require.NoError(t, server.Restart())
+	fakeClock.Advance(2 * time.Second)
+
+	assert.True(t, clientA.GetLimiter().Allow("clientA", 1))
+	assert.True(t, clientB.GetLimiter().Allow("clientB", 1))
+	require.Len(t, stateChanges, 2)
+	assert.NoError(t, stateChanges[1])
+}
+
+func TestSharedRateLimitUnknownBackend(t *testing.T) {
+	_, err := loadbalancer.NewSharedRateLimit(&loadbalancer.SharedRateLimitConfig{Backend: "gossip"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/ari23/loadbalancer/lib/clock"
+	"github.com/ari23/loadbalancer/lib/ratelimit"
+)
+
+const (
+	defaultIPv4PrefixLength = 32
+	defaultIPv6PrefixLength = 64
+	defaultMaxSources       = 100000
+)
+
+// SourceRateLimiter limits the rate of new connections per source IP, or per source CIDR when the
+// prefix lengths are shorter than the address lengths.
+type SourceRateLimiter struct {
+	limiter          ratelimit.Limiter
+	ipv4PrefixLength int
+	ipv6PrefixLength int
+	allowList        []netip.Prefix
+}
+
+// NewSourceRateLimiter creates a SourceRateLimiter telling the time with clk, which defaults to the
+// time package if nil. It returns nil if config is nil.
+func NewSourceRateLimiter(config *SourceRateLimitConfig, clk clock.Clock) (*SourceRateLimiter, error) {
+	if config == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	algorithm, err := ratelimit.ParseAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSources := config.MaxSources
+	if maxSources <= 0 {
+		maxSources = defaultMaxSources
+	}
+
+	limiter, err := ratelimit.New(algorithm, ratelimit.Params{
+		Limit:   config.RequestsPerSecond,
+		Burst:   config.Burst,
+		MaxKeys: maxSources,
+		Clock:   clk,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sourceRateLimiter := &SourceRateLimiter{
+		limiter:          limiter,
+		ipv4PrefixLength: config.IPv4PrefixLength,
+		ipv6PrefixLength: config.IPv6PrefixLength,
+	}
+
+	if sourceRateLimiter.ipv4PrefixLength <= 0 || sourceRateLimiter.ipv4PrefixLength > 32 {
+		sourceRateLimiter.ipv4PrefixLength = defaultIPv4PrefixLength
+	}
+
+	if sourceRateLimiter.ipv6PrefixLength <= 0 || sourceRateLimiter.ipv6PrefixLength > 128 {
+		sourceRateLimiter.ipv6PrefixLength = defaultIPv6PrefixLength
+	}
+
+	for _, cidr := range config.AllowList {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, ErrInvalidCIDR(cidr, err)
+		}
+
+		sourceRateLimiter.allowList = append(sourceRateLimiter.allowList, prefix.Masked())
+	}
+
+	return sourceRateLimiter, nil
+}
+
+// Allow reports whether a new connection from the given remote address is allowed. Connections
+// from allow-listed sources, and from addresses that are not IP addresses, are always allowed. The
+// returned key is the source the connection was accounted under.
+func (s *SourceRateLimiter) Allow(remoteAddr net.Addr) (string, bool) {
+	ip, ok := addrIP(remoteAddr)
+	if !ok {
+		return "", true
+	}
+
+	for _, prefix := range s.allowList {
+		if prefix.Contains(ip) {
+			return "", true
+		}
+	}
+
+	prefixLength := s.ipv6PrefixLength
+	if ip.Is4() {
+		prefixLength = s.ipv4PrefixLength
+	}
+
+	source, err := ip.Prefix(prefixLength)
+	if err != nil {
+		return "", true
+	}
+
+	key := source.String()
+
+	return key, s.limiter.Allow(key, 1)
+}
+
+// addrIP returns the IP of a TCP address, with IPv4-mapped IPv6 addresses unmapped.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+
+	return ip.Unmap(), ok
+}
@@ -0,0 +1,70 @@
+package loadbalancer_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestSourceRateLimiterPerPrefix(t *testing.T) {
+	limiter, err := loadbalancer.NewSourceRateLimiter(&loadbalancer.SourceRateLimitConfig{
+		RequestsPerSecond: 1,
+		IPv4PrefixLength:  24,
+	}, nil)
+	require.NoError(t, err)
+
+	source, ok := limiter.Allow(tcpAddr("10.0.0.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.0/24", source)
+
+	_, ok = limiter.Allow(tcpAddr("10.0.0.2"))
+	assert.False(t, ok, "Sources in the same /24 should share a limit")
+
+	_, ok = limiter.Allow(tcpAddr("10.0.1.1"))
+	assert.True(t, ok, "Sources in another /24 should have their own limit")
+
+	source, ok = limiter.Allow(tcpAddr("2001:db8::1"))
+	assert.True(t, ok)
+	assert.Equal(t, "2001:db8::/64", source)
+}
+
+func TestSourceRateLimiterAllowList(t *testing.T) {
+	limiter, err := loadbalancer.NewSourceRateLimiter(&loadbalancer.SourceRateLimitConfig{
+		RequestsPerSecond: 1,
+		AllowList:         []string{"192.168.0.0/16"},
+	}, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, ok := limiter.Allow(tcpAddr("192.168.1.1"))
+		assert.True(t, ok, "Allow-listed sources should bypass the limit")
+	}
+
+	_, err = loadbalancer.NewSourceRateLimiter(&loadbalancer.SourceRateLimitConfig{
+		AllowList: []string{"not-a-cidr"},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestRateLimitsStoreAdmitSource(t *testing.T) {
+	store, err := loadbalancer.NewRateLimitsStore(nil, nil, nil)
+	require.NoError(t, err)
+
+	assert.NoError(t, store.AdmitSource(tcpAddr("10.0.0.1")), "No source limit should admit everything")
+
+	limiter, err := loadbalancer.NewSourceRateLimiter(&loadbalancer.SourceRateLimitConfig{RequestsPerSecond: 1}, nil)
+	require.NoError(t, err)
+
+	store.SetSourceRateLimiter(limiter)
+
+	assert.NoError(t, store.AdmitSource(tcpAddr("10.0.0.1")))
+	assert.ErrorIs(t, store.AdmitSource(tcpAddr("10.0.0.1")), loadbalancer.ErrRateLimitExceeded)
+	assert.Equal(t, uint64(1), store.GetRejections()[loadbalancer.RateLimitLevelSource])
+}
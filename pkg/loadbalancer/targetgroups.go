@@ -2,8 +2,10 @@ package loadbalancer
 
 import (
 	"context"
+	"strings"
 	"sync"
 
+	"github.com/ari23/loadbalancer/lib/clock"
 	"github.com/ari23/loadbalancer/lib/loadbalance"
 )
 
@@ -11,34 +13,124 @@ import (
 type TargetGroupsStore struct {
 	// targetGroups is a map of target group name to upstream servers.
 	targetGroups map[string][]loadbalance.UpstreamServerInterface
-	mu           sync.RWMutex
-	netDialer    loadbalance.NetDialerInterface
+	// serverNames is a map of TLS server name to the target group it routes to.
+	serverNames map[string]string
+	// upstreamDialers are the dialers of the target groups that re-encrypt towards their
+	// upstream servers.
+	upstreamDialers map[string]*TLSDialer
+	// plainHealthChecks are the target groups whose health checks skip the TLS handshake.
+	plainHealthChecks map[string]bool
+	// passthrough are the target groups only reachable through the passthrough listener.
+	passthrough map[string]bool
+	mu          sync.RWMutex
+	netDialer   loadbalance.NetDialerInterface
+	// clock schedules the health checks.
+	clock clock.Clock
 }
 
-func NewTargetGroupsStore(dialer loadbalance.NetDialerInterface) *TargetGroupsStore {
+// NewTargetGroupsStore creates a TargetGroupsStore whose health checks dial with dialer and are
+// scheduled on clk, which defaults to the time package if nil.
+func NewTargetGroupsStore(dialer loadbalance.NetDialerInterface, clk clock.Clock) *TargetGroupsStore {
 	return &TargetGroupsStore{
-		targetGroups: make(map[string][]loadbalance.UpstreamServerInterface),
-		netDialer:    dialer,
+		targetGroups:      make(map[string][]loadbalance.UpstreamServerInterface),
+		serverNames:       make(map[string]string),
+		upstreamDialers:   make(map[string]*TLSDialer),
+		plainHealthChecks: make(map[string]bool),
+		passthrough:       make(map[string]bool),
+		netDialer:         dialer,
+		clock:             clk,
 	}
 }
 
-func (t *TargetGroupsStore) AddTargetGroups(targetGroups []TargetGroupConfig) {
+// AddTargetGroups adds the target groups and the TLS server names routing to them. A server name
+// can only route to one target group.
+func (t *TargetGroupsStore) AddTargetGroups(targetGroups []TargetGroupConfig) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	for _, tg := range targetGroups {
+		if tg.Passthrough && tg.UpstreamTLS != nil {
+			return ErrInvalidTargetGroupConfig(tg.Name, ErrPassthroughUpstreamTLS)
+		}
+
+		t.passthrough[tg.Name] = tg.Passthrough
+
+		if tg.UpstreamTLS != nil {
+			tlsConfig, err := NewUpstreamTLSConfig(tg.UpstreamTLS)
+			if err != nil {
+				return ErrInvalidTargetGroupConfig(tg.Name, err)
+			}
+
+			t.upstreamDialers[tg.Name] = NewTLSDialer(t.netDialer, tlsConfig)
+			t.plainHealthChecks[tg.Name] = tg.UpstreamTLS.PlainHealthChecks
+		}
+
 		upstreamServers := make([]loadbalance.UpstreamServerInterface, len(tg.UpstreamServers))
 		for i, address := range tg.UpstreamServers {
 			upstreamServers[i] = NewUpstreamServer(address)
 		}
 
 		t.targetGroups[tg.Name] = upstreamServers
+
+		for _, serverName := range tg.ServerNames {
+			serverName = normalizeServerName(serverName)
+			if other, ok := t.serverNames[serverName]; ok && other != tg.Name {
+				return ErrInvalidTargetGroupConfig(tg.Name, ErrDuplicateServerName(serverName, other))
+			}
+
+			t.serverNames[serverName] = tg.Name
+		}
+	}
+
+	return nil
+}
+
+// GetTargetGroupByServerName returns the target group a TLS server name routes to.
+func (t *TargetGroupsStore) GetTargetGroupByServerName(serverName string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	targetGroup, ok := t.serverNames[normalizeServerName(serverName)]
+
+	return targetGroup, ok
+}
+
+// normalizeServerName lower cases a server name and drops its trailing dot, as server names are
+// compared case insensitively.
+func normalizeServerName(serverName string) string {
+	return strings.TrimSuffix(strings.ToLower(serverName), ".")
+}
+
+// GetDialer returns the dialer of the connections towards the upstream servers of a target group.
+func (t *TargetGroupsStore) GetDialer(targetGroupName string) loadbalance.NetDialerInterface {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if dialer, ok := t.upstreamDialers[targetGroupName]; ok {
+		return dialer
 	}
+
+	return t.netDialer
+}
+
+// IsPassthrough reports whether a target group is only reachable through the passthrough
+// listener.
+func (t *TargetGroupsStore) IsPassthrough(targetGroupName string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.passthrough[targetGroupName]
 }
 
-// StartHealthChecks starts the health checks for all the target groups.
+// StartHealthChecks starts the health checks for all the target groups. The health checks of the
+// target groups with upstream TLS complete the TLS handshake.
 func (t *TargetGroupsStore) StartHealthChecks(ctx context.Context, wg *sync.WaitGroup) {
-	for _, upstreamServers := range t.targetGroups {
+	for name, upstreamServers := range t.targetGroups {
+		dialer := t.GetDialer(name)
+		if t.plainHealthChecks[name] {
+			dialer = t.netDialer
+		}
+
 		for _, upstream := range upstreamServers {
 			wg.Add(1)
 
@@ -48,7 +140,7 @@ func (t *TargetGroupsStore) StartHealthChecks(ctx context.Context, wg *sync.Wait
 				case <-ctx.Done():
 					return
 				default:
-					loadbalance.HealthCheck(ctx, server, t.netDialer)
+					loadbalance.HealthCheck(ctx, server, dialer, t.clock)
 				}
 			}(upstream)
 		}
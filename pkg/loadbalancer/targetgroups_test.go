@@ -6,16 +6,17 @@ import (
 	"github.com/ari23/loadbalancer/pkg/loadbalancer"
 	"github.com/ari23/loadbalancer/tests/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewTargetGroupsStore(t *testing.T) {
-	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{})
+	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{}, nil)
 	assert.NotNil(t, store, "NewTargetGroupsStore() should not return nil")
 	assert.Empty(t, store.GetTargetGroups(), "targetGroups map should be empty")
 }
 
 func TestAddTargetGroups(t *testing.T) {
-	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{})
+	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{}, nil)
 	configs := []loadbalancer.TargetGroupConfig{
 		{
 			Name:            "group1",
@@ -23,14 +24,14 @@ func TestAddTargetGroups(t *testing.T) {
 		},
 	}
 
-	store.AddTargetGroups(configs)
+	require.NoError(t, store.AddTargetGroups(configs))
 
 	assert.Len(t, store.GetTargetGroups(), 1, "There should be 1 target group")
 	assert.Len(t, store.GetTargetGroups()["group1"], 2, "There should be 2 upstream servers in 'group1'")
 }
 
 func TestGetNextUpstreamServer(t *testing.T) {
-	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{})
+	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{}, nil)
 	configs := []loadbalancer.TargetGroupConfig{
 		{
 			Name:            "group1",
@@ -38,7 +39,7 @@ func TestGetNextUpstreamServer(t *testing.T) {
 		},
 	}
 
-	store.AddTargetGroups(configs)
+	require.NoError(t, store.AddTargetGroups(configs))
 
 	server, err := store.GetNextUpstreamServer("group1")
 	assert.NoError(t, err, "Should not error when getting next upstream server for an existing group")
@@ -49,7 +50,7 @@ func TestGetNextUpstreamServer(t *testing.T) {
 }
 
 func TestGetTargetGroups(t *testing.T) {
-	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{})
+	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{}, nil)
 	configs := []loadbalancer.TargetGroupConfig{
 		{
 			Name:            "group1",
@@ -57,9 +58,29 @@ func TestGetTargetGroups(t *testing.T) {
 		},
 	}
 
-	store.AddTargetGroups(configs)
+	require.NoError(t, store.AddTargetGroups(configs))
 
 	targetGroups := store.GetTargetGroups()
 	assert.Len(t, targetGroups, 1, "There should be 1 target group")
 	assert.Len(t, targetGroups["group1"], 2, "There should be 2 upstream servers in 'group1'")
 }
+
+func TestAddTargetGroupsServerNames(t *testing.T) {
+	store := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{}, nil)
+	require.NoError(t, store.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "DBService", ServerNames: []string{"db.lb.internal"}},
+		{Name: "FrontEndService", ServerNames: []string{"www.lb.internal", "web.lb.internal"}},
+	}))
+
+	targetGroup, ok := store.GetTargetGroupByServerName("DB.lb.internal.")
+	assert.True(t, ok)
+	assert.Equal(t, "DBService", targetGroup)
+
+	_, ok = store.GetTargetGroupByServerName("unknown.lb.internal")
+	assert.False(t, ok)
+
+	err := store.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "ReportsService", ServerNames: []string{"db.lb.internal"}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,121 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ari23/loadbalancer/lib/loadbalance"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewUpstreamTLSConfig creates the tls.Config of the connections towards the upstream servers of a
+// target group.
+func NewUpstreamTLSConfig(config *UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		NextProtos:         config.ALPN,
+		InsecureSkipVerify: config.InsecureSkipVerify, //nolint:gosec
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, ErrUnknownTLSVersion(config.MinVersion)
+		}
+
+		tlsConfig.MinVersion = version
+	}
+
+	if config.CACertificate != "" {
+		caCert, err := os.ReadFile(config.CACertificate)
+		if err != nil {
+			return nil, ErrLoadingCACert(err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, ErrLoadingCACert(ErrNoCACertificates)
+		}
+	}
+
+	if config.Certificate != "" || config.PrivateKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.Certificate, config.PrivateKey)
+		if err != nil {
+			return nil, ErrLoadingKeyPair(err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// TLSDialer dials TLS connections on top of the connections of another dialer. The TLS handshake
+// is part of the dial.
+type TLSDialer struct {
+	dialer loadbalance.NetDialerInterface
+	config *tls.Config
+}
+
+// NewTLSDialer creates a TLSDialer. If config has no ServerName, the host of the dialed address is
+// used.
+func NewTLSDialer(dialer loadbalance.NetDialerInterface, config *tls.Config) *TLSDialer {
+	return &TLSDialer{dialer: dialer, config: config}
+}
+
+// Dial makes a TLS connection to the specified address.
+func (d *TLSDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext makes a TLS connection to the specified address. The dial and the handshake are
+// aborted as soon as ctx is done.
+func (d *TLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := d.config
+	if config.ServerName == "" {
+		config = config.Clone()
+
+		config.ServerName, _, err = net.SplitHostPort(address)
+		if err != nil {
+			config.ServerName = address
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+
+		return nil, ErrUpstreamTLSHandshakeFailed(address, err)
+	}
+
+	return tlsConn, nil
+}
+
+func (d *TLSDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *TLSDialer) GetTimeout() time.Duration {
+	return d.dialer.GetTimeout()
+}
+
+func (d *TLSDialer) GetRetryLimit() int {
+	return d.dialer.GetRetryLimit()
+}
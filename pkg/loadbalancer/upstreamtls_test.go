@@ -0,0 +1,143 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/ari23/loadbalancer/pkg/loadbalancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsUpstream is an upstream server that requires a client certificate from the CA and reports
+// the common name of each client it accepts.
+func tlsUpstream(t *testing.T, ca *testCA) (string, <-chan string) {
+	t.Helper()
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{ca.issueTLS(t, &x509.Certificate{DNSNames: []string{"db.internal"}})},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		NextProtos:   []string{"postgresql"},
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { listener.Close() })
+
+	clients := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err == nil {
+				clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), clients
+}
+
+func TestTLSDialerMTLS(t *testing.T) {
+	ca := newTestCA(t)
+	address, clients := tlsUpstream(t, ca)
+
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "loadbalancer"}})
+
+	tlsConfig, err := loadbalancer.NewUpstreamTLSConfig(&loadbalancer.UpstreamTLSConfig{
+		CACertificate: writeTestFile(t, dir, "ca.pem", ca.pem),
+		Certificate:   writeTestFile(t, dir, "lb.crt", certPEM),
+		PrivateKey:    writeTestFile(t, dir, "lb.key", keyPEM),
+		ServerName:    "db.internal",
+		ALPN:          []string{"postgresql"},
+		MinVersion:    "1.3",
+	})
+	require.NoError(t, err)
+
+	netDialer, err := loadbalancer.NewNetDialer(time.Second, 1, nil)
+	require.NoError(t, err)
+
+	conn, err := loadbalancer.NewTLSDialer(netDialer, tlsConfig).DialContext(context.Background(), "tcp", address)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	assert.Equal(t, "postgresql", state.NegotiatedProtocol)
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	assert.Equal(t, "loadbalancer", <-clients)
+}
+
+func TestTLSDialerVerifiesUpstream(t *testing.T) {
+	address, _ := tlsUpstream(t, newTestCA(t))
+
+	netDialer, err := loadbalancer.NewNetDialer(time.Second, 1, nil)
+	require.NoError(t, err)
+
+	// The upstream certificate is not issued by the trusted CA.
+	otherCA := newTestCA(t)
+	tlsConfig, err := loadbalancer.NewUpstreamTLSConfig(&loadbalancer.UpstreamTLSConfig{
+		CACertificate: writeTestFile(t, t.TempDir(), "ca.pem", otherCA.pem),
+		ServerName:    "db.internal",
+	})
+	require.NoError(t, err)
+
+	_, err = loadbalancer.NewTLSDialer(netDialer, tlsConfig).DialContext(context.Background(), "tcp", address)
+	assert.Error(t, err)
+
+	// Nor is it issued for the address.
+	tlsConfig.ServerName = ""
+
+	_, err = loadbalancer.NewTLSDialer(netDialer, tlsConfig).DialContext(context.Background(), "tcp", address)
+	assert.Error(t, err)
+}
+
+func TestNewUpstreamTLSConfigInvalid(t *testing.T) {
+	_, err := loadbalancer.NewUpstreamTLSConfig(&loadbalancer.UpstreamTLSConfig{MinVersion: "1.1"})
+	assert.Error(t, err)
+
+	_, err = loadbalancer.NewUpstreamTLSConfig(&loadbalancer.UpstreamTLSConfig{CACertificate: "missing.pem"})
+	assert.Error(t, err)
+
+	_, err = loadbalancer.NewUpstreamTLSConfig(&loadbalancer.UpstreamTLSConfig{Certificate: "missing.crt"})
+	assert.Error(t, err)
+}
+
+func TestTargetGroupsStoreUpstreamDialer(t *testing.T) {
+	netDialer, err := loadbalancer.NewNetDialer(time.Second, 1, nil)
+	require.NoError(t, err)
+
+	store := loadbalancer.NewTargetGroupsStore(netDialer, nil)
+	require.NoError(t, store.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "FrontEndService", UpstreamServers: []string{"127.0.0.1:8081"}},
+		{
+			Name:            "DBService",
+			UpstreamServers: []string{"127.0.0.1:8085"},
+			UpstreamTLS:     &loadbalancer.UpstreamTLSConfig{ServerName: "db.internal"},
+		},
+	}))
+
+	assert.Same(t, netDialer, store.GetDialer("FrontEndService"))
+	assert.IsType(t, &loadbalancer.TLSDialer{}, store.GetDialer("DBService"))
+
+	err = store.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "Broken", UpstreamTLS: &loadbalancer.UpstreamTLSConfig{MinVersion: "1.0"}},
+	})
+	assert.Error(t, err)
+}
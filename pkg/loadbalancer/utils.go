@@ -2,16 +2,15 @@ package loadbalancer
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net"
-
-	"github.com/ari23/loadbalancer/lib/loadbalance"
-	"github.com/ari23/loadbalancer/lib/ratelimit"
+	"time"
 )
 
 func GetClientConfigFromConn(
 	conn net.Conn,
 	authorizedClientsStore *ClientsStore,
-) (ratelimit.ClientInfoInterface, error) {
+) (*ClientInfo, error) {
 	if conn == nil {
 		return nil, ErrNilConnection
 	}
@@ -25,39 +24,100 @@ func GetClientConfigFromConn(
 		return nil, ErrTLSHandshakeFailed(err)
 	}
 
-	clientName, err := GetClientName(tlsConn)
-	if err != nil {
-		return nil, err
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, ErrClientNameNotFound
 	}
 
-	clientConfig, ok := authorizedClientsStore.GetClient(clientName)
+	clientConfig, _, ok := authorizedClientsStore.GetClientByCertificate(state.PeerCertificates[0])
 	if !ok {
-		return nil, ErrClientNotAuthorized(clientName)
+		return nil, ErrClientNotAuthorized(certificateName(state.PeerCertificates[0]))
+	}
+
+	if err := clientConfig.VerifyPins(state.PeerCertificates[0]); err != nil {
+		return nil, err
 	}
 
 	return clientConfig, nil
 }
 
-func GetClientName(conn *tls.Conn) (string, error) {
-	state := conn.ConnectionState()
-	for _, cert := range state.PeerCertificates {
-		return cert.Subject.CommonName, nil
+// certificateName names a client certificate in errors, by its CommonName or else its first SAN.
+func certificateName(cert *x509.Certificate) string {
+	identities := GetCertificateIdentities(cert, []string{
+		IdentityTypeCommonName,
+		IdentityTypeURI,
+		IdentityTypeDNS,
+		IdentityTypeEmail,
+	})
+	if len(identities) == 0 {
+		return ""
 	}
 
-	return "", ErrClientNameNotFound
+	return identities[0].String()
 }
 
-func GetNextUpstreamServer(
-	clientInfo ratelimit.ClientInfoInterface,
+// GetServerName returns the TLS server name (SNI) the client asked for, or "" if the connection is
+// not a TLS connection or the client did not send one.
+func GetServerName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	return tlsConn.ConnectionState().ServerName
+}
+
+// NewAuthzRequest describes a client connection for authorization policies. clientInfo is nil if
+// the client is unknown, as on the passthrough listener.
+func NewAuthzRequest(conn net.Conn, clientInfo *ClientInfo, now time.Time) *AuthzRequest {
+	request := &AuthzRequest{
+		ServerName: GetServerName(conn),
+		Time:       now,
+	}
+
+	if clientInfo != nil {
+		request.ClientID = clientInfo.GetClientID()
+	}
+
+	request.SourceIP, _ = addrIP(conn.RemoteAddr())
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			request.Certificate = certs[0]
+		}
+	}
+
+	return request
+}
+
+// SelectTargetGroup chooses the target group of a client connection by its TLS server name. A
+// server name mapped to a target group the client is not allowed to access is rejected. If the
+// server name is not mapped, the connection goes to the client's only target group, and is
+// rejected if the client has several.
+func SelectTargetGroup(
+	clientInfo *ClientInfo,
+	serverName string,
 	targetGroupsStore *TargetGroupsStore,
-) (loadbalance.UpstreamServerInterface, error) {
+) (string, error) {
 	if clientInfo == nil {
-		return nil, ErrNilClientConfig
+		return "", ErrNilClientConfig
 	}
 
 	if targetGroupsStore == nil {
-		return nil, ErrNilTargetGroupsStore
+		return "", ErrNilTargetGroupsStore
+	}
+
+	if targetGroup, ok := targetGroupsStore.GetTargetGroupByServerName(serverName); ok {
+		if !clientInfo.IsTargetGroupAllowed(targetGroup) {
+			return "", ErrTargetGroupNotAllowed(clientInfo.GetClientID(), targetGroup)
+		}
+
+		return targetGroup, nil
+	}
+
+	if allowed := clientInfo.GetAllowedTargetGroups(); len(allowed) == 1 {
+		return allowed[0], nil
 	}
 
-	return targetGroupsStore.GetNextUpstreamServer(clientInfo.GetAllowedTargetGroup())
+	return "", ErrNoTargetGroupForServerName(clientInfo.GetClientID(), serverName)
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/ari23/loadbalancer/tests/mocks"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetClientConfigFromConnNotTLS(t *testing.T) {
@@ -24,3 +25,52 @@ func TestGetClientConfigFromConnNotTLS(t *testing.T) {
 
 	assert.Error(t, err, "Expected error when getting client config from non-TLS connection")
 }
+
+func TestSelectTargetGroup(t *testing.T) {
+	targetGroups := loadbalancer.NewTargetGroupsStore(&mocks.MockNetDialerInterface{}, nil)
+	require.NoError(t, targetGroups.AddTargetGroups([]loadbalancer.TargetGroupConfig{
+		{Name: "DBService", ServerNames: []string{"db.lb.internal"}},
+		{Name: "FrontEndService", ServerNames: []string{"www.lb.internal"}},
+		{Name: "ReportsService", ServerNames: []string{"reports.lb.internal"}},
+	}))
+
+	clients := loadbalancer.NewClientStore()
+	require.NoError(t, clients.AddClientsFromClientConfigList([]loadbalancer.ClientConfig{
+		{ClientId: "clientA", AllowedTargetGroups: []string{"FrontEndService", "DBService"}},
+		{ClientId: "clientB", AllowedTargetGroup: "FrontEndService"},
+	}))
+
+	clientA, _ := clients.GetClient("clientA")
+	clientB, _ := clients.GetClient("clientB")
+
+	tests := []struct {
+		name       string
+		clientInfo *loadbalancer.ClientInfo
+		serverName string
+		expected   string
+	}{
+		{"mapped server name", clientA, "db.lb.internal", "DBService"},
+		{"other mapped server name", clientA, "www.lb.internal", "FrontEndService"},
+		{"single target group without server name", clientB, "", "FrontEndService"},
+		{"single target group with unmapped server name", clientB, "lb.internal", "FrontEndService"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			targetGroup, err := loadbalancer.SelectTargetGroup(test.clientInfo, test.serverName, targetGroups)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, targetGroup)
+		})
+	}
+
+	// Server names of target groups the client is not allowed are rejected.
+	_, err := loadbalancer.SelectTargetGroup(clientA, "reports.lb.internal", targetGroups)
+	assert.Error(t, err)
+
+	_, err = loadbalancer.SelectTargetGroup(clientB, "db.lb.internal", targetGroups)
+	assert.Error(t, err)
+
+	// Without a mapped server name, a client with several target groups is ambiguous.
+	_, err = loadbalancer.SelectTargetGroup(clientA, "", targetGroups)
+	assert.Error(t, err)
+}
@@ -36,6 +36,7 @@ func main() {
 		clientCert  string
 		clientKey   string
 		rootCAcert  string
+		serverName  string
 	)
 
 	flag.StringVar(&serverAddr, "server", "127.0.0.1:8080", "Server address in the format host:port")
@@ -44,9 +45,11 @@ func main() {
 	flag.StringVar(&clientCert, "client-cert", "certs/clientA.crt", "Client certificate")
 	flag.StringVar(&clientKey, "client-key", "certs/clientA.key", "Client private key")
 	flag.StringVar(&rootCAcert, "root-ca", "certs/rootCA.pem", "Root CA certificate")
+	flag.StringVar(&serverName, "server-name", "frontend.loadbalancer.foodomain.com",
+		"TLS server name, which selects the target group")
 	flag.Parse()
 
-	tlsConfig, err := LoadTLSConfig(clientCert, clientKey, rootCAcert)
+	tlsConfig, err := LoadTLSConfig(clientCert, clientKey, rootCAcert, serverName)
 	if err != nil {
 		log.Fatalf("client: load tls config: %s", err)
 	}
@@ -66,7 +69,7 @@ func main() {
 	}
 }
 
-func LoadTLSConfig(clientCert, clientKey, rootCAcert string) (*tls.Config, error) {
+func LoadTLSConfig(clientCert, clientKey, rootCAcert, serverName string) (*tls.Config, error) {
 	// Load client's certificate and private key
 	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
 	if err != nil {
@@ -85,6 +88,7 @@ func LoadTLSConfig(clientCert, clientKey, rootCAcert string) (*tls.Config, error
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		RootCAs:      caCertPool,
+		ServerName:   serverName,
 		MinVersion:   tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,   //nolint:nosnakecase
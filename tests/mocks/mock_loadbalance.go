@@ -5,6 +5,7 @@
 package mocks
 
 import (
+	context "context"
 	net "net"
 	reflect "reflect"
 	time "time"
@@ -151,6 +152,21 @@ func (mr *MockNetDialerInterfaceMockRecorder) Dial(network, address interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dial", reflect.TypeOf((*MockNetDialerInterface)(nil).Dial), network, address)
 }
 
+// DialContext mocks base method.
+func (m *MockNetDialerInterface) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DialContext", ctx, network, address)
+	ret0, _ := ret[0].(net.Conn)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DialContext indicates an expected call of DialContext.
+func (mr *MockNetDialerInterfaceMockRecorder) DialContext(ctx, network, address interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DialContext", reflect.TypeOf((*MockNetDialerInterface)(nil).DialContext), ctx, network, address)
+}
+
 // DialTimeout mocks base method.
 func (m *MockNetDialerInterface) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
 	m.ctrl.T.Helper()